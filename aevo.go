@@ -1,24 +1,117 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"strconv"
 	"strings"
-	"time"
-
-	"nhooyr.io/websocket"
 )
 
 const AevoHttp string = "https://api.aevo.xyz"
 const AevoWss string = "wss://ws.aevo.xyz"
 
-func aevoMarkets(asset string) []interface{} {
-	url := AevoHttp + "/markets?asset=" + asset + "&instrument_type=OPTION"
+// aevo sends a snapshot and then updates of the changed levels on orderbook:{instrument}, applied to a local book
+// per instrument. updates carry no previous sequence number, so gaps are only detected from last_updated going
+// backwards or an update without a snapshot, the frames' checksum isn't verified
+type Aevo struct {
+	Http string
+	Wss  string
+
+	books LocalBooks
+}
+
+type aevoMarket struct {
+	InstrumentId   string `json:"instrument_id"` //orders reference instruments by id
+	InstrumentName string `json:"instrument_name"`
+	InstrumentType string `json:"instrument_type"`
+	IsActive       bool   `json:"is_active"`
+}
+
+type aevoError struct {
+	Error string `json:"error"`
+}
+
+// every ws frame, orderbook frames have channel orderbook:{instrument} and the book in data,
+// subscribe acks only have id and data, errors only error
+type aevoMessage struct {
+	Channel string          `json:"channel"`
+	Data    json.RawMessage `json:"data"`
+	Error   string          `json:"error"`
+}
+
+type aevoOrderbookData struct {
+	Type           string       `json:"type"` //snapshot or update
+	InstrumentName string       `json:"instrument_name"`
+	Bids           []priceLevel `json:"bids"` //[[price, amount, iv]...]
+	Asks           []priceLevel `json:"asks"`
+	LastUpdated    string       `json:"last_updated"` //unix ns
+}
+
+func init() {
+	registerExchange(&Aevo{Http: AevoHttp, Wss: AevoWss})
+}
+
+func (a *Aevo) Name() string {
+	return "aevo"
+}
+
+func (a *Aevo) WssUrl() string {
+	return a.Wss
+}
+
+func (a *Aevo) SetEndpoints(httpUrl string, wssUrl string) {
+	if httpUrl != "" {
+		a.Http = httpUrl
+	}
+	if wssUrl != "" {
+		a.Wss = wssUrl
+	}
+}
+
+func (a *Aevo) Instruments(asset string) ([]string, error) {
+	markets, err := aevoMarkets(a.Http, asset)
+	if err != nil {
+		return nil, err
+	}
+
+	return optionInstruments("aevo", aevoInstruments(markets)), nil
+}
+
+func (a *Aevo) OrderbookJson(instruments []string) []byte {
+	return aevoOrderbookJson(instruments)
+}
+
+func (a *Aevo) UnsubscribeJson(instruments []string) []byte {
+	return aevoChannelsJson("unsubscribe", instruments)
+}
+
+func (a *Aevo) ParseFrame(raw []byte) (*BookUpdate, error) {
+	var res aevoMessage
+	err := json.Unmarshal(raw, &res)
+	if err != nil {
+		return nil, fmt.Errorf("aevoParseFrame: error unmarshaling orderbookRaw: %v\n(response): %v", err, string(raw))
+	}
+
+	if res.Error != "" {
+		return nil, fmt.Errorf("aevoParseFrame: error response: %v", res.Error)
+	}
+	if !strings.HasPrefix(res.Channel, "orderbook:") { //subscribe acks have no channel
+		return nil, nil
+	}
+
+	var data aevoOrderbookData
+	err = json.Unmarshal(res.Data, &data)
+	if err != nil {
+		return nil, fmt.Errorf("aevoParseFrame: error unmarshaling orderbook: %v\n(response): %v", err, string(raw))
+	}
+
+	return a.updateBook(data)
+}
+
+func aevoMarkets(httpUrl string, asset string) ([]aevoMarket, error) {
+	url := httpUrl + "/markets?asset=" + asset + "&instrument_type=OPTION"
 
 	req, _ := http.NewRequest("GET", url, nil) //NewRequest + Client.Do used to pass headers, otherwise http.Get can be used
 
@@ -26,34 +119,33 @@ func aevoMarkets(asset string) []interface{} {
 
 	res, err := http.DefaultClient.Do(req)
 	if err != nil {
-		log.Fatalf("aevoMarkets request error: %v", err)
+		return nil, fmt.Errorf("aevoMarkets request error: %v", err)
 	}
 
 	defer res.Body.Close() //Client.Do, http.Get, http.Post, etc all need response Body to be closed when done reading from it
 	// defer defers execution until enclosing function returns
 
-	var markets []interface{}
-
 	decoder := json.NewDecoder(res.Body)
+	if res.StatusCode != http.StatusOK {
+		var apiErr aevoError
+		decoder.Decode(&apiErr)
+		return nil, fmt.Errorf("aevoMarkets: %v: %v", res.Status, apiErr.Error)
+	}
+
+	var markets []aevoMarket
 	err = decoder.Decode(&markets)
 	if err != nil {
-		log.Fatalf("aevoMarkets json decode error: %v", err)
+		return nil, fmt.Errorf("aevoMarkets json decode error: %v", err)
 	}
 
-	return markets
+	return markets, nil
 }
 
-func aevoInstruments(markets []interface{}) []string {
+func aevoInstruments(markets []aevoMarket) []string {
 	var instruments []string
-	var market map[string]interface{}
-	var isActive bool
-	var instrumentName string
-	for _, item := range markets {
-		market = item.(map[string]interface{})
-		isActive = market["is_active"].(bool)
-		if isActive {
-			instrumentName = market["instrument_name"].(string)
-			instruments = append(instruments, instrumentName)
+	for _, market := range markets {
+		if market.IsActive && market.InstrumentType == "OPTION" {
+			instruments = append(instruments, market.InstrumentName)
 		}
 	}
 
@@ -61,13 +153,17 @@ func aevoInstruments(markets []interface{}) []string {
 }
 
 func aevoOrderbookJson(instruments []string) []byte {
+	return aevoChannelsJson("subscribe", instruments)
+}
+
+func aevoChannelsJson(op string, instruments []string) []byte {
 	var orderbooks []string
 	for _, instrument := range instruments {
 		orderbooks = append(orderbooks, "orderbook:"+instrument)
 	}
 
 	data := WssData{
-		Op:   "subscribe",
+		Op:   op,
 		Data: orderbooks,
 	}
 
@@ -79,115 +175,26 @@ func aevoOrderbookJson(instruments []string) []byte {
 	return jsonData
 }
 
-func aevoWssReqOrderbook(instruments []string, ctx context.Context, c *websocket.Conn) {
-	var data []byte
-	for i := 0; true; i += 20 {
-		if i+20 < len(instruments) {
-			data = aevoOrderbookJson(instruments[i : i+20])
-		} else {
-			data = aevoOrderbookJson(instruments[i:])
-		}
-
-		// fmt.Printf("subscribe: %v\n\n", string(data))
-		err := c.Write(ctx, 1, data)
-		if err != nil {
-			log.Fatalf("Write error: %v\n", err)
-		}
-
-		if i+20 > len(instruments) {
-			break
-		}
-
-		time.Sleep(100 * time.Millisecond)
-	}
-}
-
-func aevoUpdateOrderbooks(res map[string]interface{}) error {
-	//takes unmarshaled ws response and updates Orderbooks
-
-	data, ok := res["data"].(map[string]interface{})
-	if !ok {
-		return fmt.Errorf("aevoUpdateOrderbooks: unable to cast response to type map[string]interface{}: response: %+v", res)
-	}
-
-	// if len(data) <= 3 { //check for ping response, not very robust and inappropriate to catch here, might need to fix later
-	// 	return
-	// }
-
-	instrument, ok := data["instrument_name"].(string)
-	if !ok {
-		return fmt.Errorf("aevoUpdateOrderbooks: unable to cast data['instrument_name'] to type string: response: %+v", res)
-	}
-	components := strings.Split(instrument, "-")
-	expiryTime, err1 := time.Parse("02Jan06", components[1])
-	expiry := expiryTime.Unix()
-	strike, err2 := strconv.ParseFloat(components[2], 64)
-	optionType := components[3]
-	if err1 != nil || err2 != nil {
-		return fmt.Errorf("unpackOrders error: \n%v\n%v", err1, err2)
-	}
-
-	bidsRaw, bidsOk := data["bids"].([]interface{})
-	asksRaw, asksOk := data["asks"].([]interface{})
-	if !bidsOk || !asksOk {
-		return fmt.Errorf("aevoUpdateOrderbooks: unable to convert field: response: %+v", res)
-	}
-
-	if len(bidsRaw) <= 0 && len(asksRaw) <= 0 { //if instrument has no bids/asks its discarded
-		// should be && or when there are multiple exchanges used and || when only one, fix
-		return errors.New("no bids and asks")
-	}
-
-	bids, bidsErr := unpackOrders(bidsRaw, strike, optionType, "aevo")
-	asks, asksErr := unpackOrders(asksRaw, strike, optionType, "aevo")
-	if bidsErr != nil && asksErr != nil {
-		return fmt.Errorf("unpackOrders error: \n%v\n%v", bidsErr, asksErr)
-	}
-
-	updateOrderbook(expiry, bids, asks)
-
-	return nil
-}
-
-func aevoWssRead(ctx context.Context, c *websocket.Conn) { //add exit condition, add ping or use Reader instead of Read to automatically manage ping, disconnect, etc
-	//reads for ws response and updates Orderbooks
+func (a *Aevo) updateBook(data aevoOrderbookData) (*BookUpdate, error) {
+	//applies the decoded orderbook of a ws frame to the local book and returns the resulting update
 
-	var res map[string]interface{}
-	raw, err := wssRead(ctx, c)
+	instrument, err := parseInstrument("aevo", data.InstrumentName)
 	if err != nil {
-		log.Printf("aevoWssRead: %v\n(response): %v\n\n", err, string(raw))
-		return
+		return nil, err
 	}
-
-	err = json.Unmarshal(raw, &res)
-	if err != nil {
-		log.Printf("aevoWssRead: error unmarshaling orderbookRaw: %v\n\n", err)
-		return
+	if data.Type != "snapshot" && data.Type != "update" {
+		return nil, fmt.Errorf("aevoUpdateBook: unknown orderbook type %q", data.Type)
 	}
-
-	channel, ok := res["channel"].(string)
-	if !ok {
-		log.Printf("aevoWssRead: unable to convert response 'channel' to string\n\n")
-		return
+	lastUpdated, err := strconv.ParseInt(data.LastUpdated, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("aevoUpdateBook: invalid last_updated %q", data.LastUpdated)
 	}
 
-	if strings.Contains(channel, "orderbook") {
-		aevoUpdateOrderbooks(res)
-		// fmt.Printf("%+v\n\n", len(BoxContainer.Boxes))
-		// fmt.Printf("%+v\n\n", Boxes)
-		// fmt.Printf("%+v\n\n", res)
+	delta := bookDelta{Snapshot: data.Type == "snapshot", Seq: lastUpdated, Bids: data.Bids, Asks: data.Asks}
+	bids, asks, err := a.books.Apply("aevo", data.InstrumentName, delta)
+	if err != nil || (bids == nil && asks == nil) {
+		return nil, err
 	}
-}
-
-func aevoWssReqLoop(ctx context.Context, c *websocket.Conn) {
-	for {
-		markets := aevoMarkets("ETH")
-		instruments := aevoInstruments(markets)
-		fmt.Printf("Aevo number of instruments: %v\n\n", len(instruments))
 
-		aevoWssReqOrderbook(instruments, ctx, c)
-		log.Printf("Requested Aevo Orderbooks")
-
-		time.Sleep(time.Minute * 10)
-	}
+	return bookUpdate(instrument, bids, asks), nil
 }
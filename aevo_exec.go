@@ -0,0 +1,663 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+const AevoOrderScale = 1e6 //order prices and amounts are sent as fixed point integers with 6 decimals
+
+var AevoOrderTimeout = 10 * time.Second //POST /orders is given up on after this, the order's outcome is then unknown
+var AevoAuthTimeout = 10 * time.Second  //the private websocket is redialed if auth isn't acknowledged within this
+
+// status of a LiveTrade
+const LiveSubmitted = "submitted" //orders sent, waiting for acks and fills
+const LiveFilled = "filled"       //every leg filled completely
+const LivePartial = "partial"     //some legs filled partially or not at all
+const LiveUnfilled = "unfilled"   //no leg filled
+const LiveFailed = "failed"       //no order was accepted
+const LiveUnknown = "unknown"     //an order was sent but not acknowledged, whether it filled has to be checked on aevo
+
+// POST /orders body, an IOC limit order signed with the account's signing key
+type aevoOrderRequest struct {
+	Instrument  int64  `json:"instrument"`
+	Maker       string `json:"maker"`
+	IsBuy       bool   `json:"is_buy"`
+	Amount      string `json:"amount"`      //fixed point, AevoOrderScale
+	LimitPrice  string `json:"limit_price"` //fixed point, AevoOrderScale
+	Salt        string `json:"salt"`
+	Signature   string `json:"signature"`
+	Timestamp   string `json:"timestamp"` //unix seconds
+	PostOnly    bool   `json:"post_only"`
+	ReduceOnly  bool   `json:"reduce_only"`
+	TimeInForce string `json:"time_in_force"`
+	Mmp         bool   `json:"mmp"`
+}
+
+// POST /orders response, IOC orders are acknowledged with their final status
+type aevoOrderAck struct {
+	OrderId        string `json:"order_id"`
+	InstrumentName string `json:"instrument_name"`
+	Side           string `json:"side"`
+	Amount         string `json:"amount"`
+	Price          string `json:"price"`
+	Filled         string `json:"filled"`
+	AvgPrice       string `json:"avg_price"`
+	OrderStatus    string `json:"order_status"` //filled, partial or cancelled
+}
+
+// fills channel of the private websocket
+type aevoFillData struct {
+	Timestamp string   `json:"timestamp"`
+	Fill      aevoFill `json:"fill"`
+}
+
+type aevoFill struct {
+	TradeId        string `json:"trade_id"`
+	OrderId        string `json:"order_id"`
+	InstrumentName string `json:"instrument_name"`
+	Price          string `json:"price"`
+	Side           string `json:"side"`
+	Fees           string `json:"fees"`
+	Filled         string `json:"filled"`
+	OrderStatus    string `json:"order_status"`
+}
+
+type aevoAuthJson struct {
+	Id   int64             `json:"id"`
+	Op   string            `json:"op"`
+	Data map[string]string `json:"data"`
+}
+
+// answer to the auth message, matched by id
+type aevoAuthAck struct {
+	Id   int64 `json:"id"`
+	Data struct {
+		Success bool `json:"success"`
+	} `json:"data"`
+	Error string `json:"error"`
+}
+
+const aevoAuthId = 1
+
+// one fill of a live order, confirmed by the private websocket
+type liveFill struct {
+	TradeId string
+	Price   float64
+	Amount  float64
+	Fee     float64
+}
+
+// one leg of a live trade, legs are in the order of Box: short call, long call, short put, long put
+type liveLeg struct {
+	Instrument Instrument
+	Name       string //aevo instrument name, empty until its market is found
+	Side       string //Buy or Sell
+	Limit      float64
+	Amount     float64
+	OrderId    string //empty until acknowledged
+	Status     string //order_status of the ack, LiveUnknown when the order wasn't acknowledged
+	Filled     float64
+	AvgPrice   float64
+	Fills      []liveFill //fills received on the private websocket, Filled is confirmed once they add up to it
+	Error      string     //submission error
+}
+
+// LiveTrade is one execution of the four legs of a box on aevo
+type LiveTrade struct {
+	Id        int
+	Key       BoxKey
+	Size      float64
+	Submitted time.Time
+	Completed time.Time
+	Status    string
+	Legs      [4]liveLeg
+}
+
+func (t *LiveTrade) copy() *LiveTrade {
+	copied := *t
+	for i := range copied.Legs {
+		copied.Legs[i].Fills = append([]liveFill(nil), t.Legs[i].Fills...)
+	}
+
+	return &copied
+}
+
+// AevoExecutor signs and submits box leg orders to aevo's REST api and tracks their fills on the private websocket.
+// it uses the aevo exchange's endpoints, so -endpoint aevo=... points it at a local stand-in
+type AevoExecutor struct {
+	Http        string
+	Wss         string
+	ApiKey      string
+	ApiSecret   string
+	Account     string //maker address
+	ChainId     int64
+	FillTimeout time.Duration
+
+	signer *aevoSigner
+
+	mu           sync.Mutex
+	connected    bool
+	markets      map[Instrument]aevoMarket
+	fills        map[string][]liveFill //order id: fills
+	fillsChanged chan struct{}         //closed and replaced whenever a fill arrives
+	trades       []*LiveTrade
+}
+
+func newAevoExecutor(cfg AevoExecution) (*AevoExecutor, error) {
+	signer, err := newAevoSigner(cfg.SigningKey)
+	if err != nil {
+		return nil, err
+	}
+	aevo := ExchangeRegistry["aevo"].(*Aevo)
+
+	return &AevoExecutor{
+		Http:         aevo.Http,
+		Wss:          aevo.Wss,
+		ApiKey:       cfg.ApiKey,
+		ApiSecret:    cfg.ApiSecret,
+		Account:      cfg.Account,
+		ChainId:      cfg.ChainId,
+		FillTimeout:  cfg.FillTimeout.Duration,
+		signer:       signer,
+		markets:      make(map[Instrument]aevoMarket),
+		fills:        make(map[string][]liveFill),
+		fillsChanged: make(chan struct{}),
+	}, nil
+}
+
+func aevoFixed(value float64) *big.Int {
+	return big.NewInt(int64(math.Round(value * AevoOrderScale)))
+}
+
+func parseAevoFloat(name string, value string) (float64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %v %q", name, value)
+	}
+
+	return parsed, nil
+}
+
+// market returns the aevo market of instrument, the markets of its asset are fetched again when it isn't known yet
+func (x *AevoExecutor) market(instrument Instrument) (aevoMarket, error) {
+	x.mu.Lock()
+	market, ok := x.markets[instrument]
+	x.mu.Unlock()
+	if ok {
+		return market, nil
+	}
+
+	markets, err := aevoMarkets(x.Http, instrument.Asset)
+	if err != nil {
+		return aevoMarket{}, err
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for _, market := range markets {
+		parsed, err := parseInstrument("aevo", market.InstrumentName)
+		if err != nil {
+			continue
+		}
+		x.markets[parsed] = market
+	}
+	market, ok = x.markets[instrument]
+	if !ok {
+		return aevoMarket{}, fmt.Errorf("market: no aevo market for %v %v %v %v", instrument.Asset, formatExpiry(instrument.Expiry), instrument.Strike, instrument.Type)
+	}
+
+	return market, nil
+}
+
+// signedOrder builds the IOC order of leg for instrument id
+func (x *AevoExecutor) signedOrder(id int64, leg liveLeg) (aevoOrderRequest, error) {
+	saltBytes := make([]byte, 8)
+	_, err := rand.Read(saltBytes)
+	if err != nil {
+		return aevoOrderRequest{}, fmt.Errorf("signedOrder: %v", err)
+	}
+	salt := new(big.Int).SetBytes(saltBytes)
+	timestamp := time.Now().Unix()
+	limitPrice, amount := aevoFixed(leg.Limit), aevoFixed(leg.Amount)
+	isBuy := leg.Side == Buy
+
+	digest, err := aevoOrderDigest(x.ChainId, x.Account, isBuy, limitPrice, amount, salt, big.NewInt(id), timestamp)
+	if err != nil {
+		return aevoOrderRequest{}, err
+	}
+
+	return aevoOrderRequest{
+		Instrument:  id,
+		Maker:       x.Account,
+		IsBuy:       isBuy,
+		Amount:      amount.String(),
+		LimitPrice:  limitPrice.String(),
+		Salt:        salt.String(),
+		Signature:   "0x" + hex.EncodeToString(x.signer.Sign(digest)),
+		Timestamp:   strconv.FormatInt(timestamp, 10),
+		TimeInForce: "IOC",
+	}, nil
+}
+
+// postOrder sends order and returns its ack. errors after the request may have reached aevo wrap ErrOrderUnknown, the
+// others mean the order was rejected or never sent
+func (x *AevoExecutor) postOrder(ctx context.Context, order aevoOrderRequest) (aevoOrderAck, error) {
+	body, err := json.Marshal(order)
+	if err != nil {
+		return aevoOrderAck{}, fmt.Errorf("postOrder: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, AevoOrderTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", x.Http+"/orders", bytes.NewReader(body))
+	if err != nil {
+		return aevoOrderAck{}, fmt.Errorf("postOrder: %v", err)
+	}
+	req.Header.Add("accept", "application/json")
+	req.Header.Add("content-type", "application/json")
+	req.Header.Add("AEVO-KEY", x.ApiKey)
+	req.Header.Add("AEVO-SECRET", x.ApiSecret)
+
+	res, err := http.DefaultClient.Do(req)
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" { //nothing was sent
+		return aevoOrderAck{}, fmt.Errorf("postOrder request error: %v", err)
+	}
+	if err != nil {
+		return aevoOrderAck{}, fmt.Errorf("postOrder request error: %w: %v", ErrOrderUnknown, err)
+	}
+	defer res.Body.Close()
+
+	decoder := json.NewDecoder(res.Body)
+	if res.StatusCode != http.StatusOK {
+		var apiErr aevoError
+		decoder.Decode(&apiErr)
+		if res.StatusCode >= 500 { //a gateway error or crash may come after the order was matched
+			return aevoOrderAck{}, fmt.Errorf("postOrder: %v: %w: %v", res.Status, ErrOrderUnknown, apiErr.Error)
+		}
+		return aevoOrderAck{}, fmt.Errorf("postOrder: %v: %v", res.Status, apiErr.Error)
+	}
+
+	var ack aevoOrderAck
+	err = decoder.Decode(&ack)
+	if err != nil {
+		return aevoOrderAck{}, fmt.Errorf("postOrder json decode error: %w: %v", ErrOrderUnknown, err)
+	}
+	if ack.OrderId == "" {
+		return aevoOrderAck{}, fmt.Errorf("postOrder: %w: ack without order_id", ErrOrderUnknown)
+	}
+
+	return ack, nil
+}
+
+// submitLeg signs and submits the order of leg and fills in its ack, errors are also set on leg and mark it LiveUnknown
+// when they wrap ErrOrderUnknown
+func (x *AevoExecutor) submitLeg(ctx context.Context, leg *liveLeg) error {
+	market, err := x.market(leg.Instrument)
+	var id int64
+	if err == nil {
+		leg.Name = market.InstrumentName
+		id, err = strconv.ParseInt(market.InstrumentId, 10, 64)
+		if err != nil {
+			err = fmt.Errorf("submitLeg: invalid instrument_id %q of %v", market.InstrumentId, market.InstrumentName)
+		}
+	}
+	if err == nil {
+		var order aevoOrderRequest
+		order, err = x.signedOrder(id, *leg)
+		if err == nil {
+			var ack aevoOrderAck
+			ack, err = x.postOrder(ctx, order)
+			if err == nil {
+				leg.OrderId, leg.Status = ack.OrderId, ack.OrderStatus
+				leg.Filled, err = parseAevoFloat("filled", ack.Filled)
+				if err == nil {
+					leg.AvgPrice, err = parseAevoFloat("avg_price", ack.AvgPrice)
+				}
+				if err != nil { //accepted, but how much filled can't be read
+					err = fmt.Errorf("submitLeg: order %v: %w: %v", ack.OrderId, ErrOrderUnknown, err)
+				}
+			}
+		}
+	}
+	if errors.Is(err, ErrOrderUnknown) {
+		leg.Status = LiveUnknown
+	}
+	if err != nil {
+		leg.Error = err.Error()
+	}
+
+	return err
+}
+
+// waitFills waits until the websocket fills of orderId add up to filled or FillTimeout passes, the fills are then
+// dropped from x.fills
+func (x *AevoExecutor) waitFills(ctx context.Context, orderId string, filled float64) []liveFill {
+	timeout := time.NewTimer(x.FillTimeout)
+	defer timeout.Stop()
+	defer func() {
+		x.mu.Lock()
+		delete(x.fills, orderId)
+		x.mu.Unlock()
+	}()
+
+	for {
+		x.mu.Lock()
+		fills := append([]liveFill(nil), x.fills[orderId]...)
+		changed := x.fillsChanged
+		x.mu.Unlock()
+
+		total := 0.0
+		for _, fill := range fills {
+			total += fill.Amount
+		}
+		if total >= filled-1/AevoOrderScale {
+			return fills
+		}
+
+		select {
+		case <-changed:
+		case <-timeout.C:
+			log.Printf("AevoExecutor: order %v acknowledged %v filled, only %v confirmed by fills\n\n", orderId, filled, total)
+			return fills
+		case <-ctx.Done():
+			return fills
+		}
+	}
+}
+
+// ExecuteBox sends IOC limit orders for size boxes of key at the observed top of book prices of its four legs, which
+// all have to be quoted on aevo, and returns once every acknowledged fill is confirmed by the private websocket
+func (x *AevoExecutor) ExecuteBox(ctx context.Context, key BoxKey, size float64) (*LiveTrade, error) {
+	if !(size > 0) || math.IsInf(size, 1) {
+		return nil, fmt.Errorf("ExecuteBox: size must be positive, got %v", size)
+	}
+
+	x.mu.Lock()
+	connected := x.connected
+	x.mu.Unlock()
+	if !connected {
+		return nil, fmt.Errorf("ExecuteBox: private websocket isn't connected, fills couldn't be tracked")
+	}
+
+	BoxContainer.Mu.Lock()
+	box, ok := BoxContainer.Boxes[key]
+	BoxContainer.Mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("ExecuteBox: no %v box %v %v %v/%v", key.Direction, key.Asset, key.Expiry, key.K1, key.K2)
+	}
+	tops := [4]Order{box.ShortCallBids[0], box.LongCallAsks[0], box.ShortPutBids[0], box.LongPutAsks[0]}
+	for _, top := range tops {
+		if top.Exchange != "aevo" {
+			return nil, fmt.Errorf("ExecuteBox: best %v %v level is on %v, only aevo legs can be executed", formatFloat(top.Strike), top.OptionType, top.Exchange)
+		}
+	}
+	size = math.Min(size, box.Amount)
+
+	trade := &LiveTrade{Key: key, Size: size, Submitted: now(), Status: LiveSubmitted}
+	sides := [4]string{Sell, Buy, Sell, Buy}
+	for i, top := range tops {
+		instrument := Instrument{Asset: key.Asset, Expiry: key.Expiry, Strike: top.Strike, Type: top.OptionType, Venue: "aevo"}
+		trade.Legs[i] = liveLeg{Instrument: instrument, Side: sides[i], Limit: top.Price, Amount: size}
+	}
+
+	x.mu.Lock()
+	trade.Id = len(x.trades) + 1
+	x.trades = append(x.trades, trade)
+	x.mu.Unlock()
+
+	//legs are filled in on copies and published at the end, Trades never sees a half written leg
+	legs := trade.Legs
+	var wg sync.WaitGroup
+	for i := range legs {
+		wg.Add(1)
+		go func(leg *liveLeg) {
+			defer wg.Done()
+			x.submitLeg(ctx, leg)
+			if leg.OrderId != "" && leg.Filled > 0 {
+				leg.Fills = x.waitFills(ctx, leg.OrderId, leg.Filled)
+			}
+		}(&legs[i])
+	}
+	wg.Wait()
+
+	accepted, unknown, filled, complete := 0, 0, 0, 0
+	for _, leg := range legs {
+		if leg.OrderId != "" {
+			accepted++
+		}
+		if leg.Status == LiveUnknown {
+			unknown++
+		}
+		if leg.Filled > 0 {
+			filled++
+		}
+		if leg.Filled >= leg.Amount-1/AevoOrderScale {
+			complete++
+		}
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	trade.Legs = legs
+	trade.Completed = now()
+	switch {
+	case unknown > 0:
+		trade.Status = LiveUnknown
+	case accepted == 0:
+		trade.Status = LiveFailed
+	case filled == 0:
+		trade.Status = LiveUnfilled
+	case complete == len(legs):
+		trade.Status = LiveFilled
+	default:
+		trade.Status = LivePartial
+	}
+
+	return trade.copy(), nil
+}
+
+// ExecuteLeg sends one IOC limit order for the LegRiskController and returns its acknowledged fill, fees are those of
+// the fills confirmed by the private websocket. errors wrap ErrOrderUnknown when the order may have filled
+func (x *AevoExecutor) ExecuteLeg(ctx context.Context, order LegOrder) (LegFill, error) {
+	if order.Instrument.Venue != "aevo" {
+		return LegFill{}, fmt.Errorf("ExecuteLeg: %v orders can't be sent to aevo", order.Instrument.Venue)
+	}
+	x.mu.Lock()
+	connected := x.connected
+	x.mu.Unlock()
+	if !connected {
+		return LegFill{}, fmt.Errorf("ExecuteLeg: private websocket isn't connected, fills couldn't be tracked")
+	}
+
+	leg := liveLeg{Instrument: order.Instrument, Side: order.Side, Limit: order.Limit, Amount: order.Amount}
+	err := x.submitLeg(ctx, &leg)
+	if err != nil {
+		return LegFill{}, fmt.Errorf("ExecuteLeg: %w", err)
+	}
+	if leg.Filled <= 0 {
+		return LegFill{}, nil
+	}
+
+	fees := 0.0
+	for _, fill := range x.waitFills(ctx, leg.OrderId, leg.Filled) {
+		fees += fill.Fee
+	}
+
+	return LegFill{leg.Filled, leg.AvgPrice, fees}, nil
+}
+
+// Trades returns copies of every live trade, newest first
+func (x *AevoExecutor) Trades() []*LiveTrade {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	trades := make([]*LiveTrade, len(x.trades))
+	for i, trade := range x.trades {
+		trades[len(trades)-1-i] = trade.copy()
+	}
+
+	return trades
+}
+
+func (x *AevoExecutor) handleFrame(raw []byte) {
+	var res aevoMessage
+	err := json.Unmarshal(raw, &res)
+	if err != nil {
+		log.Printf("AevoExecutor: error unmarshaling frame: %v\n(response): %v\n\n", err, string(raw))
+		return
+	}
+	if res.Error != "" {
+		log.Printf("AevoExecutor: error response: %v\n\n", res.Error)
+		return
+	}
+	if res.Channel != "fills" {
+		return
+	}
+
+	var data aevoFillData
+	err = json.Unmarshal(res.Data, &data)
+	if err != nil {
+		log.Printf("AevoExecutor: error unmarshaling fill: %v\n(response): %v\n\n", err, string(raw))
+		return
+	}
+	price, err := parseAevoFloat("price", data.Fill.Price)
+	if err != nil {
+		log.Printf("AevoExecutor: fill %v: %v\n\n", data.Fill.TradeId, err)
+		return
+	}
+	amount, err := parseAevoFloat("filled", data.Fill.Filled)
+	if err != nil {
+		log.Printf("AevoExecutor: fill %v: %v\n\n", data.Fill.TradeId, err)
+		return
+	}
+	fee, err := parseAevoFloat("fees", data.Fill.Fees)
+	if err != nil {
+		log.Printf("AevoExecutor: fill %v: %v\n\n", data.Fill.TradeId, err)
+		return
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.fills[data.Fill.OrderId] = append(x.fills[data.Fill.OrderId], liveFill{data.Fill.TradeId, price, amount, fee})
+	close(x.fillsChanged)
+	x.fillsChanged = make(chan struct{})
+}
+
+// authenticate sends the api key and waits for aevo to acknowledge it, frames before the ack are dropped
+func (x *AevoExecutor) authenticate(ctx context.Context, c *websocket.Conn) error {
+	auth, _ := json.Marshal(aevoAuthJson{aevoAuthId, "auth", map[string]string{"key": x.ApiKey, "secret": x.ApiSecret}})
+	err := c.Write(ctx, 1, auth)
+	if err != nil {
+		return fmt.Errorf("Write error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, AevoAuthTimeout)
+	defer cancel()
+	for {
+		raw, err := wssRead(ctx, c)
+		if err != nil {
+			return fmt.Errorf("authenticate: no auth ack: %v", err)
+		}
+		var ack aevoAuthAck
+		if json.Unmarshal(raw, &ack) != nil || ack.Id != aevoAuthId {
+			continue
+		}
+		if ack.Error != "" {
+			return fmt.Errorf("authenticate: auth rejected: %v", ack.Error)
+		}
+		if !ack.Data.Success {
+			return fmt.Errorf("authenticate: auth not successful: %s", raw)
+		}
+
+		return nil
+	}
+}
+
+func (x *AevoExecutor) subscribeFills(ctx context.Context, c *websocket.Conn) error {
+	subscribe, _ := json.Marshal(WssData{Op: "subscribe", Data: []string{"fills"}})
+	err := c.Write(ctx, 1, subscribe)
+	if err != nil {
+		return fmt.Errorf("Write error: %v", err)
+	}
+
+	return nil
+}
+
+// Run keeps the private websocket connected and authenticated, redialing with backoff like ConnSupervisor.Run. orders
+// are only sent while connected, which is set once auth is acknowledged and fills are subscribed
+func (x *AevoExecutor) Run(ctx context.Context) {
+	backoff := MinBackoff
+
+	for ctx.Err() == nil {
+		conn, err := dialWss(ctx, x.Wss)
+		if err == nil {
+			err = x.authenticate(conn.Ctx, conn.Conn)
+			if err == nil {
+				err = x.subscribeFills(conn.Ctx, conn.Conn)
+			}
+			if err != nil {
+				conn.Cancel()
+				conn.Conn.CloseNow()
+			}
+		}
+		if err != nil {
+			log.Printf("AevoExecutor: %v, retrying in ~%v\n\n", err, backoff)
+			if !sleepCtx(ctx, jitter(backoff)) {
+				return
+			}
+			backoff = min(backoff*2, MaxBackoff)
+			continue
+		}
+		connectedAt := time.Now()
+		log.Printf("AevoExecutor: private websocket connected")
+
+		x.mu.Lock()
+		x.connected = true
+		x.mu.Unlock()
+
+		go keepAlive(ctx, conn)
+		for {
+			raw, err := wssRead(conn.Ctx, conn.Conn)
+			if err != nil {
+				log.Printf("AevoExecutor: %v\n\n", err)
+				break
+			}
+			x.handleFrame(raw)
+		}
+
+		x.mu.Lock()
+		x.connected = false
+		x.mu.Unlock()
+		conn.Cancel()
+		conn.Conn.CloseNow()
+
+		if time.Since(connectedAt) > MaxBackoff {
+			backoff = MinBackoff
+		}
+		log.Printf("AevoExecutor: private websocket disconnected, redialing in ~%v\n\n", backoff)
+		if !sleepCtx(ctx, jitter(backoff)) {
+			return
+		}
+		backoff = min(backoff*2, MaxBackoff)
+	}
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+const aevoStandInMarkets = `[
+	{"instrument_id":"12001","instrument_name":"ETH-31DEC27-2000-C","instrument_type":"OPTION","is_active":true},
+	{"instrument_id":"12002","instrument_name":"ETH-31DEC27-2000-P","instrument_type":"OPTION","is_active":true},
+	{"instrument_id":"12003","instrument_name":"ETH-31DEC27-2100-C","instrument_type":"OPTION","is_active":true},
+	{"instrument_id":"12004","instrument_name":"ETH-31DEC27-2100-P","instrument_type":"OPTION","is_active":true},
+	{"instrument_id":"1","instrument_name":"ETH-PERP","instrument_type":"PERPETUAL","is_active":true}
+]`
+
+var standInExpiry = time.Date(2027, 12, 31, SettlementHour, 0, 0, 0, time.UTC).Unix()
+
+// aevoStandIn stands in for aevo's markets, POST /orders and private websocket
+type aevoStandIn struct {
+	server     *httptest.Server
+	auths      atomic.Int32 //auth messages received, one per connection
+	subscribed atomic.Int32 //fills subscriptions received
+}
+
+// newAevoStandIn answers every signed order with orders and the auth message with the lines of authAck, or not at all
+// when it's empty. frames sent on fills are written to the subscribed websocket, closing fills drops it
+func newAevoStandIn(t *testing.T, authAck string, fills <-chan string, orders func(order aevoOrderRequest) (int, string)) *aevoStandIn {
+	s := &aevoStandIn{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /markets", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(aevoStandInMarkets))
+	})
+	mux.HandleFunc("POST /orders", func(w http.ResponseWriter, r *http.Request) {
+		var order aevoOrderRequest
+		if err := json.NewDecoder(r.Body).Decode(&order); err != nil {
+			t.Errorf("order: %v", err)
+		}
+		if r.Header.Get("AEVO-KEY") != "key" || r.Header.Get("AEVO-SECRET") != "secret" {
+			t.Errorf("order without api key headers: %v", r.Header)
+		}
+		if signer, err := orderSigner(1, order); err != nil || signer != testSigningAddress {
+			t.Errorf("order %+v signed by %v, %v, want %v", order, signer, err, testSigningAddress)
+		}
+		if order.Maker != testAccount || order.TimeInForce != "IOC" {
+			t.Errorf("order %+v: want an IOC order of %v", order, testAccount)
+		}
+
+		status, body := orders(order)
+		if status == 0 { //hang until the client gives up
+			<-r.Context().Done()
+			return
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	})
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		c, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Errorf("accept: %v", err)
+			return
+		}
+		defer c.CloseNow()
+
+		_, raw, err := c.Read(r.Context())
+		var auth aevoAuthJson
+		if err != nil || json.Unmarshal(raw, &auth) != nil || auth.Op != "auth" || auth.Data["key"] != "key" || auth.Data["secret"] != "secret" {
+			t.Errorf("unexpected auth %s, %v", raw, err)
+			return
+		}
+		s.auths.Add(1)
+		if authAck == "" {
+			c.Read(r.Context()) //until the client gives up
+			return
+		}
+		for _, frame := range strings.Split(authAck, "\n") {
+			if c.Write(r.Context(), websocket.MessageText, []byte(frame)) != nil {
+				return
+			}
+		}
+
+		_, raw, err = c.Read(r.Context())
+		if err != nil { //closed after a rejected auth
+			return
+		}
+		var subscribe WssData
+		if json.Unmarshal(raw, &subscribe) != nil || subscribe.Op != "subscribe" || strings.Join(subscribe.Data, ",") != "fills" {
+			t.Errorf("unexpected subscribe %s", raw)
+			return
+		}
+		s.subscribed.Add(1)
+
+		ctx := c.CloseRead(r.Context())
+		for {
+			select {
+			case frame, ok := <-fills:
+				if !ok {
+					return
+				}
+				if c.Write(ctx, websocket.MessageText, []byte(frame)) != nil {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+
+	s.server = httptest.NewServer(mux)
+	t.Cleanup(s.server.Close)
+
+	return s
+}
+
+// executor returns an AevoExecutor of the stand-in
+func (s *aevoStandIn) executor(t *testing.T, fillTimeout time.Duration) *AevoExecutor {
+	t.Helper()
+
+	x, err := newAevoExecutor(AevoExecution{ApiKey: "key", ApiSecret: "secret", SigningKey: testSigningKey, Account: testAccount, ChainId: 1, FillTimeout: Duration{fillTimeout}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	x.Http, x.Wss = s.server.URL, "ws"+strings.TrimPrefix(s.server.URL, "http")+"/ws"
+
+	return x
+}
+
+// runExecutor runs x until the test ends or stop is called, done is closed once Run returns
+func runExecutor(t *testing.T, x *AevoExecutor) (stop func(), done <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	finished := make(chan struct{})
+	go func() {
+		x.Run(ctx)
+		close(finished)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-finished
+	})
+
+	return cancel, finished
+}
+
+func isConnected(x *AevoExecutor) bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	return x.connected
+}
+
+func waitConnected(t *testing.T, x *AevoExecutor, want bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for isConnected(x) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("connected: got %v, want %v", !want, want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func pendingFills(x *AevoExecutor) int {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	return len(x.fills)
+}
+
+func fillFrame(orderId string, tradeId string, price string, filled string, fees string) string {
+	return `{"channel":"fills","data":{"timestamp":"1","fill":{"trade_id":"` + tradeId + `","order_id":"` + orderId +
+		`","instrument_name":"ETH-31DEC27-2000-C","price":"` + price + `","side":"buy","fees":"` + fees + `","filled":"` + filled + `","order_status":"filled"}}}`
+}
+
+func callOrder(amount float64) LegOrder {
+	instrument := Instrument{Asset: "ETH", Expiry: standInExpiry, Strike: 2000, Type: Call, Venue: "aevo"}
+	return LegOrder{Instrument: instrument, Side: Buy, Limit: 271, Amount: amount}
+}
+
+const authOk = `{"id":1,"data":{"success":true}}`
+
+func TestAevoExecutorConfirmsFills(t *testing.T) {
+	fills := make(chan string, 4)
+	s := newAevoStandIn(t, authOk, fills, func(order aevoOrderRequest) (int, string) {
+		if order.Instrument != 12001 || !order.IsBuy || order.Amount != "2000000" || order.LimitPrice != "271000000" {
+			t.Errorf("unexpected order %+v", order)
+		}
+		fills <- fillFrame("o1", "t1", "270", "1.5", "0.3") //fills can arrive before the ack
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			fills <- fillFrame("o1", "t2", "272", "0.5", "0.1")
+		}()
+		return http.StatusOK, `{"order_id":"o1","instrument_name":"ETH-31DEC27-2000-C","side":"buy","amount":"2","price":"271","filled":"2","avg_price":"270.5","order_status":"filled"}`
+	})
+	x := s.executor(t, 2*time.Second)
+	runExecutor(t, x)
+	waitConnected(t, x, true)
+
+	fill, err := x.ExecuteLeg(context.Background(), callOrder(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fill.Filled != 2 || fill.AvgPrice != 270.5 || !almostEqual(fill.Fees, 0.4) {
+		t.Errorf("got %+v, want the ack's fill with the fees of both fills", fill)
+	}
+	if n := pendingFills(x); n != 0 {
+		t.Errorf("%v orders' fills kept after they were confirmed", n)
+	}
+}
+
+func TestAevoExecutorFillTimeout(t *testing.T) {
+	fills := make(chan string, 4)
+	s := newAevoStandIn(t, authOk, fills, func(order aevoOrderRequest) (int, string) {
+		fills <- fillFrame("o1", "t1", "270", "1.5", "0.3")
+		return http.StatusOK, `{"order_id":"o1","filled":"2","avg_price":"270.5","order_status":"filled"}`
+	})
+	x := s.executor(t, 100*time.Millisecond)
+	runExecutor(t, x)
+	waitConnected(t, x, true)
+
+	start := time.Now()
+	fill, err := x.ExecuteLeg(context.Background(), callOrder(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("returned after %v, before the fill timeout", elapsed)
+	}
+	if fill.Filled != 2 || !almostEqual(fill.Fees, 0.3) {
+		t.Errorf("got %+v, want the ack's fill with the fees of the fill received", fill)
+	}
+	if n := pendingFills(x); n != 0 {
+		t.Errorf("%v orders' fills kept after the timeout", n)
+	}
+}
+
+func TestAevoExecutorDisconnect(t *testing.T) {
+	fills := make(chan string)
+	s := newAevoStandIn(t, authOk, fills, func(order aevoOrderRequest) (int, string) {
+		t.Errorf("order %+v sent while disconnected", order)
+		return http.StatusBadRequest, `{"error":"DISCONNECTED"}`
+	})
+	x := s.executor(t, time.Second)
+	stop, done := runExecutor(t, x)
+	waitConnected(t, x, true)
+
+	close(fills) //the stand-in drops the websocket
+	waitConnected(t, x, false)
+	if _, err := x.ExecuteLeg(context.Background(), callOrder(1)); err == nil || !strings.Contains(err.Error(), "isn't connected") {
+		t.Errorf("got error %v, want the order refused while disconnected", err)
+	}
+
+	stop()
+	select {
+	case <-done:
+	case <-time.After(200 * time.Millisecond):
+		t.Errorf("Run kept waiting out its backoff after ctx was cancelled")
+	}
+}
+
+func TestAevoExecutorAuth(t *testing.T) {
+	defer func(previous time.Duration) { AevoAuthTimeout = previous }(AevoAuthTimeout)
+	AevoAuthTimeout = 50 * time.Millisecond
+
+	tests := []struct {
+		name      string
+		authAck   string
+		connected bool
+	}{
+		{"acknowledged", authOk, true},
+		{"acknowledged after other frames", `{"channel":"heartbeat"}` + "\n" + `{"id":7,"data":{"success":true}}` + "\n" + authOk, true},
+		{"rejected", `{"id":1,"error":"INVALID_API_KEY"}`, false},
+		{"not successful", `{"id":1,"data":{"success":false}}`, false},
+		{"never answered", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newAevoStandIn(t, test.authAck, make(chan string), func(order aevoOrderRequest) (int, string) {
+				return http.StatusBadRequest, `{"error":"UNEXPECTED"}`
+			})
+			x := s.executor(t, time.Second)
+			stop, done := runExecutor(t, x)
+
+			if test.connected {
+				waitConnected(t, x, true)
+			} else {
+				for s.auths.Load() == 0 {
+					time.Sleep(5 * time.Millisecond)
+				}
+				time.Sleep(2 * AevoAuthTimeout)
+				if isConnected(x) || s.subscribed.Load() != 0 {
+					t.Errorf("connected %v with %v fills subscriptions, want neither without an auth ack", isConnected(x), s.subscribed.Load())
+				}
+			}
+
+			stop()
+			select {
+			case <-done:
+			case <-time.After(200 * time.Millisecond):
+				t.Errorf("Run didn't return after ctx was cancelled")
+			}
+		})
+	}
+}
+
+func TestAevoExecutorOrderOutcomes(t *testing.T) {
+	defer func(previous time.Duration) { AevoOrderTimeout = previous }(AevoOrderTimeout)
+	AevoOrderTimeout = 50 * time.Millisecond
+
+	tests := []struct {
+		name    string
+		status  int //0 doesn't answer
+		body    string
+		want    LegFill
+		err     string //part of the expected error, empty for none
+		unknown bool
+	}{
+		{"cancelled", http.StatusOK, `{"order_id":"o1","filled":"0","order_status":"cancelled"}`, LegFill{}, "", false},
+		{"rejected", http.StatusBadRequest, `{"error":"INSUFFICIENT_MARGIN"}`, LegFill{}, "INSUFFICIENT_MARGIN", false},
+		{"rate limited", http.StatusTooManyRequests, `{"error":"RATE_LIMITED"}`, LegFill{}, "RATE_LIMITED", false},
+		{"bad gateway", http.StatusBadGateway, ``, LegFill{}, "502", true},
+		{"server error", http.StatusInternalServerError, `{"error":"INTERNAL"}`, LegFill{}, "INTERNAL", true},
+		{"timeout", 0, ``, LegFill{}, "deadline exceeded", true},
+		{"malformed ack", http.StatusOK, `{"order_id":`, LegFill{}, "decode", true},
+		{"ack without order id", http.StatusOK, `{"filled":"1","order_status":"filled"}`, LegFill{}, "without order_id", true},
+		{"invalid filled", http.StatusOK, `{"order_id":"o1","filled":"lots","order_status":"filled"}`, LegFill{}, "invalid filled", true},
+	}
+	for _, test := range tests {
+		s := newAevoStandIn(t, "", nil, func(order aevoOrderRequest) (int, string) {
+			return test.status, test.body
+		})
+		x := s.executor(t, 10*time.Millisecond)
+		x.connected = true //fills aren't needed, no order fills
+
+		fill, err := x.ExecuteLeg(context.Background(), callOrder(1))
+		if test.err == "" {
+			if err != nil || fill != test.want {
+				t.Errorf("%v: got %+v, %v, want %+v", test.name, fill, err, test.want)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) || errors.Is(err, ErrOrderUnknown) != test.unknown {
+			t.Errorf("%v: got %+v, %v, want an error containing %q, unknown outcome %v", test.name, fill, err, test.err, test.unknown)
+		}
+	}
+
+	//nothing was sent when the connection is refused
+	s := newAevoStandIn(t, "", nil, nil)
+	x := s.executor(t, time.Second)
+	s.server.Close()
+	order, err := x.signedOrder(12001, liveLeg{Side: Buy, Limit: 271, Amount: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := x.postOrder(context.Background(), order); err == nil || errors.Is(err, ErrOrderUnknown) {
+		t.Errorf("refused connection: got error %v, want a rejection", err)
+	}
+}
+
+func TestAevoExecuteBoxStatus(t *testing.T) {
+	resetState(t)
+	key := BoxKey{"ETH", standInExpiry, 2000, 2100, BoxLong}
+	level := func(strike float64, optionType string, price float64) []Order {
+		return []Order{{Asset: "ETH", Price: price, Amount: 4, Strike: strike, OptionType: optionType, Exchange: "aevo"}}
+	}
+	BoxContainer.Boxes[key] = &Box{Key: key, ShortCallBids: level(2100, Call, 250), LongCallAsks: level(2000, Call, 330), ShortPutBids: level(2000, Put, 150), LongPutAsks: level(2100, Put, 160), Amount: 4}
+
+	filled := `{"order_id":"o","filled":"1","avg_price":"1","order_status":"filled"}`
+	legIds := [4]int64{12003, 12001, 12002, 12004} //2100 call, 2000 call, 2000 put, 2100 put
+	tests := []struct {
+		name     string
+		statuses map[int64]int //instrument id: status of its order, filled when missing
+		want     string
+	}{
+		{"filled", nil, LiveFilled},
+		{"one rejected", map[int64]int{12003: http.StatusBadRequest}, LivePartial},
+		{"one unknown", map[int64]int{12003: http.StatusBadGateway}, LiveUnknown},
+		{"all rejected", map[int64]int{12001: 400, 12002: 400, 12003: 400, 12004: 400}, LiveFailed},
+		{"unknown beats rejected", map[int64]int{12001: 400, 12002: 400, 12003: 503, 12004: 400}, LiveUnknown},
+	}
+	for _, test := range tests {
+		s := newAevoStandIn(t, "", nil, func(order aevoOrderRequest) (int, string) {
+			status, ok := test.statuses[order.Instrument]
+			if !ok {
+				return http.StatusOK, filled
+			}
+			return status, `{"error":"SCRIPTED"}`
+		})
+		x := s.executor(t, 10*time.Millisecond)
+		x.connected = true
+
+		trade, err := x.ExecuteBox(context.Background(), key, 1)
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		if trade.Status != test.want {
+			t.Errorf("%v: got status %v, want %v", test.name, trade.Status, test.want)
+		}
+		for i, leg := range trade.Legs {
+			if unknown := test.statuses[legIds[i]] >= 500; (leg.Status == LiveUnknown) != unknown {
+				t.Errorf("%v: leg %v has status %v, error %q, want unknown %v", test.name, i, leg.Status, leg.Error, unknown)
+			}
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+	"golang.org/x/crypto/sha3"
+)
+
+// aevo orders are signed with the account's signing key as EIP-712 typed data: keccak256 hashing and secp256k1 ECDSA
+// signatures with a recovery id from decred's secp256k1
+
+// keccak256 is the original Keccak padding used by ethereum, not SHA3-256
+func keccak256(data ...[]byte) []byte {
+	hash := sha3.NewLegacyKeccak256()
+	for _, d := range data {
+		hash.Write(d)
+	}
+
+	return hash.Sum(nil)
+}
+
+func bytes32(n *big.Int) []byte {
+	return n.FillBytes(make([]byte, 32))
+}
+
+// aevoSigner signs with a secp256k1 private key
+type aevoSigner struct {
+	key     *secp256k1.PrivateKey
+	address string //0x prefixed, lowercase
+}
+
+func newAevoSigner(hexKey string) (*aevoSigner, error) {
+	raw, err := hex.DecodeString(strings.TrimPrefix(hexKey, "0x"))
+	if err != nil || len(raw) != 32 {
+		return nil, fmt.Errorf("newAevoSigner: signing key must be 32 hex encoded bytes")
+	}
+	var scalar secp256k1.ModNScalar
+	if overflow := scalar.SetByteSlice(raw); overflow || scalar.IsZero() {
+		return nil, fmt.Errorf("newAevoSigner: signing key is out of range")
+	}
+
+	key := secp256k1.NewPrivateKey(&scalar)
+	public := key.PubKey().SerializeUncompressed() //0x04 || x || y
+	address := keccak256(public[1:])[12:]
+
+	return &aevoSigner{key, "0x" + hex.EncodeToString(address)}, nil
+}
+
+// Sign returns the 65 byte r || s || v signature of a 32 byte digest with low s and v = 27 + recovery id. the nonce is
+// RFC 6979's and the scalar multiplications are constant time, so signing doesn't leak the key through timing
+func (s *aevoSigner) Sign(digest []byte) []byte {
+	compact := ecdsa.SignCompact(s.key, digest, false) //27 + recovery id || r || s
+
+	return append(compact[1:], compact[0])
+}
+
+const aevoOrderType = "Order(address maker,bool isBuy,uint256 limitPrice,uint256 amount,uint256 salt,uint256 instrument,uint256 timestamp)"
+const eip712DomainType = "EIP712Domain(string name,string version,uint256 chainId)"
+
+func aevoDomainName(chainId int64) string {
+	if chainId == 1 {
+		return "Aevo Mainnet"
+	}
+
+	return "Aevo Testnet"
+}
+
+// aevoOrderDigest is the EIP-712 digest of an order, amounts and prices are the 6 decimal fixed point integers sent
+func aevoOrderDigest(chainId int64, maker string, isBuy bool, limitPrice *big.Int, amount *big.Int, salt *big.Int, instrument *big.Int, timestamp int64) ([]byte, error) {
+	makerBytes, err := hex.DecodeString(strings.TrimPrefix(maker, "0x"))
+	if err != nil || len(makerBytes) != 20 {
+		return nil, fmt.Errorf("aevoOrderDigest: invalid maker address %q", maker)
+	}
+
+	domain := keccak256(
+		keccak256([]byte(eip712DomainType)),
+		keccak256([]byte(aevoDomainName(chainId))),
+		keccak256([]byte("1")),
+		bytes32(big.NewInt(chainId)),
+	)
+
+	buy := big.NewInt(0)
+	if isBuy {
+		buy.SetInt64(1)
+	}
+	order := keccak256(
+		keccak256([]byte(aevoOrderType)),
+		bytes32(new(big.Int).SetBytes(makerBytes)),
+		bytes32(buy),
+		bytes32(limitPrice),
+		bytes32(amount),
+		bytes32(salt),
+		bytes32(instrument),
+		bytes32(big.NewInt(timestamp)),
+	)
+
+	return keccak256([]byte{0x19, 0x01}, domain, order), nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+)
+
+// the private key of web3.js' account docs, whose signature of "Some data" is published there
+const testSigningKey = "0x4c0883a69102937d6231471b5dbb6204fe5129617082792ae468d01a3f362318"
+const testSigningAddress = "0x2c7536e3605d9c16a7a3d7b1898e529396a65c23"
+const testAccount = "0x7e5f4552091a69125d5dfcb7b8c2659029395bdf"
+
+// orderSigner recovers the address that signed order, as aevo does before accepting it
+func orderSigner(chainId int64, order aevoOrderRequest) (string, error) {
+	ints := make([]*big.Int, 4)
+	for i, value := range []string{order.LimitPrice, order.Amount, order.Salt, order.Timestamp} {
+		n, ok := new(big.Int).SetString(value, 10)
+		if !ok {
+			return "", fmt.Errorf("invalid integer %q", value)
+		}
+		ints[i] = n
+	}
+	digest, err := aevoOrderDigest(chainId, order.Maker, order.IsBuy, ints[0], ints[1], ints[2], big.NewInt(order.Instrument), ints[3].Int64())
+	if err != nil {
+		return "", err
+	}
+
+	return recoverAddress(order.Signature, digest)
+}
+
+// recoverAddress recovers the address of an r || s || v signature of digest
+func recoverAddress(signature string, digest []byte) (string, error) {
+	sig, err := hex.DecodeString(strings.TrimPrefix(signature, "0x"))
+	if err != nil || len(sig) != 65 {
+		return "", fmt.Errorf("invalid signature %q", signature)
+	}
+	public, _, err := ecdsa.RecoverCompact(append([]byte{sig[64]}, sig[:64]...), digest)
+	if err != nil {
+		return "", err
+	}
+
+	return "0x" + hex.EncodeToString(keccak256(public.SerializeUncompressed()[1:])[12:]), nil
+}
+
+func TestAevoSignerAddress(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string //empty for an invalid key
+	}{
+		{"0x0000000000000000000000000000000000000000000000000000000000000001", testAccount},
+		{testSigningKey, testSigningAddress},
+		{strings.TrimPrefix(testSigningKey, "0x"), testSigningAddress},
+		{"", ""},
+		{"0x1234", ""},
+		{"0xzz0883a69102937d6231471b5dbb6204fe5129617082792ae468d01a3f362318", ""},
+		{"0x0000000000000000000000000000000000000000000000000000000000000000", ""},
+		{"0xfffffffffffffffffffffffffffffffebaaedce6af48a03bbfd25e8cd0364141", ""}, //the group order
+		{"0xffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff", ""},
+	}
+	for _, test := range tests {
+		signer, err := newAevoSigner(test.key)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("%q: got address %v, want an error", test.key, signer.address)
+			}
+			continue
+		}
+		if err != nil || signer.address != test.want {
+			t.Errorf("%q: got %+v, %v, want address %v", test.key, signer, err, test.want)
+		}
+	}
+}
+
+func TestAevoSignerSign(t *testing.T) {
+	satoshi := sha256.Sum256([]byte("Satoshi Nakamoto"))
+	tests := []struct {
+		key    string
+		digest []byte
+		want   string //r || s || v
+	}{
+		//RFC 6979 secp256k1 vectors, r and s as published with the recovery id appended
+		{"0x0000000000000000000000000000000000000000000000000000000000000001", satoshi[:],
+			"934b1ea10a4b3c1757e2b0c017d0b6143ce3c9a7e6a4a49860d7a6ab210ee3d82442ce9d2b916064108014783e923ec36b49743e2ffa1c4496f01a512aafd9e51c"},
+		{"0xfffffffffffffffffffffffffffffffebaaedce6af48a03bbfd25e8cd0364140", satoshi[:],
+			"fd567d121db66e382991534ada77a6bd3106f0a1098c231e47993447cd6af2d06b39cd0eb1bc8603e159ef5c20a5c8ad685a45b06ce9bebed3f153d10d93bed51b"},
+		//web3.js' eth.accounts.sign("Some data") example
+		{testSigningKey, keccak256([]byte("\x19Ethereum Signed Message:\n9Some data")),
+			"b91467e570a6466aa9e9876cbcd013baba02900b8979d43fe208a4a4f339f5fd6007e74cd82e037b800186422fc2da167c747ef045e5d18a5f5d4300f8e1a0291c"},
+	}
+	halfOrder := new(big.Int).Rsh(hexBig(t, "fffffffffffffffffffffffffffffffebaaedce6af48a03bbfd25e8cd0364141"), 1)
+	for _, test := range tests {
+		signer, err := newAevoSigner(test.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig := signer.Sign(test.digest)
+		if got := hex.EncodeToString(sig); got != test.want {
+			t.Errorf("%v: got %v, want %v", test.key, got, test.want)
+		}
+		if s := new(big.Int).SetBytes(sig[32:64]); s.Cmp(halfOrder) > 0 {
+			t.Errorf("%v: s is high", test.key)
+		}
+		if address, err := recoverAddress(hex.EncodeToString(sig), test.digest); err != nil || address != signer.address {
+			t.Errorf("%v: recovered %v, %v, want %v", test.key, address, err, signer.address)
+		}
+	}
+}
+
+func hexBig(t *testing.T, s string) *big.Int {
+	t.Helper()
+	n, ok := new(big.Int).SetString(s, 16)
+	if !ok {
+		t.Fatalf("invalid hex %q", s)
+	}
+
+	return n
+}
+
+func TestAevoOrderDigest(t *testing.T) {
+	//cross-checked with a generic EIP-712 encoder
+	order := func(chainId int64, maker string, isBuy bool, limitPrice int64, timestamp int64) ([]byte, error) {
+		return aevoOrderDigest(chainId, maker, isBuy, big.NewInt(limitPrice), big.NewInt(2000000), big.NewInt(42), big.NewInt(1234), timestamp)
+	}
+	digest, err := order(1, "0x7E5F4552091A69125d5DfCb7b8C2659029395Bdf", true, 1234500000, 1700000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(digest); got != "64c2f7a01bd4596623773cfad2b343873534f07a75f4e8d17746108efbf48c17" {
+		t.Errorf("got digest %v", got)
+	}
+
+	//every field is signed
+	for i, changed := range []func() ([]byte, error){
+		func() ([]byte, error) { return order(11155111, testAccount, true, 1234500000, 1700000000) },
+		func() ([]byte, error) { return order(1, testSigningAddress, true, 1234500000, 1700000000) },
+		func() ([]byte, error) { return order(1, testAccount, false, 1234500000, 1700000000) },
+		func() ([]byte, error) { return order(1, testAccount, true, 1234500001, 1700000000) },
+		func() ([]byte, error) { return order(1, testAccount, true, 1234500000, 1700000001) },
+	} {
+		other, err := changed()
+		if err != nil || bytes.Equal(other, digest) {
+			t.Errorf("change %v: got %x, %v, want another digest", i, other, err)
+		}
+	}
+
+	for _, maker := range []string{"", "0x7e5f", "7e5f4552091a69125d5dfcb7b8c2659029395bdf00", "0xzz5f4552091a69125d5dfcb7b8c2659029395bdf"} {
+		if _, err := order(1, maker, true, 1, 1); err == nil {
+			t.Errorf("maker %q: no error", maker)
+		}
+	}
+}
@@ -0,0 +1,850 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// bumped on any breaking change to the JSON schemas below
+const ApiVersion = 1
+
+type apiLevel struct {
+	Exchange  string    `json:"exchange"`
+	Price     float64   `json:"price"`
+	Amount    float64   `json:"amount"`
+	Iv        float64   `json:"iv"` //-1 when the exchange doesn't send IV
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type apiBox struct {
+	Asset         string     `json:"asset"`
+	Expiry        int64      `json:"expiry"`
+	ExpiryTime    time.Time  `json:"expiry_time"`
+	K1            float64    `json:"k1"`
+	K2            float64    `json:"k2"`
+	Direction     string     `json:"direction"` //long (lending) or short (borrowing)
+	ShortCallBids []apiLevel `json:"short_call_bids"`
+	LongCallAsks  []apiLevel `json:"long_call_asks"`
+	ShortPutBids  []apiLevel `json:"short_put_bids"`
+	LongPutAsks   []apiLevel `json:"long_put_asks"`
+	Payoff        float64    `json:"payoff"`
+	Cost          float64    `json:"cost"`
+	Amount        float64    `json:"amount"`
+	Profit        float64    `json:"profit"`
+	Fees          float64    `json:"fees"`
+	NetProfit     float64    `json:"net_profit"`
+	RelProfit     float64    `json:"rel_profit"`
+	Apy           float64    `json:"apy"`
+	BorrowRate    float64    `json:"borrow_rate"` //short boxes only
+	MaxSize       float64    `json:"max_size"`
+	VwapCost      float64    `json:"vwap_cost"`
+	TotalProfit   float64    `json:"total_profit"`
+}
+
+type apiBoxesResponse struct {
+	Version int      `json:"version"`
+	Boxes   []apiBox `json:"boxes"`
+}
+
+type apiOrderbook struct {
+	Asset    string                `json:"asset"`
+	Expiry   int64                 `json:"expiry"`
+	Strike   float64               `json:"strike"`
+	CallBids map[string][]apiLevel `json:"call_bids"` //exchange: levels
+	CallAsks map[string][]apiLevel `json:"call_asks"`
+	PutBids  map[string][]apiLevel `json:"put_bids"`
+	PutAsks  map[string][]apiLevel `json:"put_asks"`
+}
+
+type apiOrderbooksResponse struct {
+	Version    int            `json:"version"`
+	Orderbooks []apiOrderbook `json:"orderbooks"` //one per asset with the requested expiry and strike
+}
+
+type apiExchangeInstruments struct {
+	Connected   bool     `json:"connected"`
+	Instruments []string `json:"instruments"`
+}
+
+type apiInstrumentsResponse struct {
+	Version   int                               `json:"version"`
+	Exchanges map[string]apiExchangeInstruments `json:"exchanges"`
+}
+
+type apiPaperFill struct {
+	Exchange string  `json:"exchange"`
+	Price    float64 `json:"price"`
+	Amount   float64 `json:"amount"`
+	Fee      float64 `json:"fee"`
+}
+
+type apiPaperLeg struct {
+	Strike     float64        `json:"strike"`
+	OptionType string         `json:"option_type"` //C or P
+	Side       string         `json:"side"`        //buy or sell
+	Limit      float64        `json:"limit"`
+	Amount     float64        `json:"amount"`
+	Filled     float64        `json:"filled"`
+	AvgPrice   float64        `json:"avg_price"`
+	Fills      []apiPaperFill `json:"fills"`
+}
+
+type apiPaperTrade struct {
+	Id             int           `json:"id"`
+	Asset          string        `json:"asset"`
+	Expiry         int64         `json:"expiry"`
+	K1             float64       `json:"k1"`
+	K2             float64       `json:"k2"`
+	Direction      string        `json:"direction"`
+	Size           float64       `json:"size"`
+	Status         string        `json:"status"` //pending, filled, partial or unfilled
+	Submitted      time.Time     `json:"submitted"`
+	Executed       *time.Time    `json:"executed"` //null while pending
+	Legs           []apiPaperLeg `json:"legs"`     //short call, long call, short put, long put
+	ExpectedProfit float64       `json:"expected_profit"`
+	Boxes          float64       `json:"boxes"` //complete boxes filled
+	RealizedProfit float64       `json:"realized_profit"`
+}
+
+type apiPaperTradesResponse struct {
+	Version int             `json:"version"`
+	Trades  []apiPaperTrade `json:"trades"` //newest first
+}
+
+// body of POST /api/paper/trades and /api/live/trades
+type apiBoxTradeRequest struct {
+	Asset     string  `json:"asset"`
+	Expiry    int64   `json:"expiry"`
+	K1        float64 `json:"k1"`
+	K2        float64 `json:"k2"`
+	Direction string  `json:"direction"` //defaults to long
+	Size      float64 `json:"size"`
+}
+
+type apiPaperTradeResponse struct {
+	Version int           `json:"version"`
+	Trade   apiPaperTrade `json:"trade"`
+}
+
+type apiPaperPosition struct {
+	Asset      string  `json:"asset"`
+	Expiry     int64   `json:"expiry"`
+	Strike     float64 `json:"strike"`
+	OptionType string  `json:"option_type"`
+	Exchange   string  `json:"exchange"`
+	Amount     float64 `json:"amount"` //negative when short
+}
+
+type apiPaperCashFlow struct {
+	Time     time.Time `json:"time"`
+	TradeId  int       `json:"trade_id"`
+	Exchange string    `json:"exchange"`
+	Name     string    `json:"name"`
+	Kind     string    `json:"kind"`   //premium or fee
+	Amount   float64   `json:"amount"` //negative when paid
+}
+
+type apiPaperPositionsResponse struct {
+	Version   int                `json:"version"`
+	Positions []apiPaperPosition `json:"positions"`
+	CashFlows []apiPaperCashFlow `json:"cash_flows"` //oldest first
+	Cash      float64            `json:"cash"`       //sum of the cash flows
+}
+
+type apiLiveFill struct {
+	TradeId string  `json:"trade_id"`
+	Price   float64 `json:"price"`
+	Amount  float64 `json:"amount"`
+	Fee     float64 `json:"fee"`
+}
+
+type apiLiveLeg struct {
+	Instrument string        `json:"instrument"` //aevo instrument name, empty when its market wasn't found
+	Side       string        `json:"side"`
+	Limit      float64       `json:"limit"`
+	Amount     float64       `json:"amount"`
+	OrderId    string        `json:"order_id"`     //empty when the order wasn't accepted
+	Status     string        `json:"order_status"` //of the acknowledgment
+	Filled     float64       `json:"filled"`
+	AvgPrice   float64       `json:"avg_price"`
+	Fills      []apiLiveFill `json:"fills"` //confirmed by the private websocket
+	Error      string        `json:"error,omitempty"`
+}
+
+type apiLiveTrade struct {
+	Id        int          `json:"id"`
+	Asset     string       `json:"asset"`
+	Expiry    int64        `json:"expiry"`
+	K1        float64      `json:"k1"`
+	K2        float64      `json:"k2"`
+	Direction string       `json:"direction"`
+	Size      float64      `json:"size"`
+	Status    string       `json:"status"` //submitted, filled, partial, unfilled, failed or unknown
+	Submitted time.Time    `json:"submitted"`
+	Completed *time.Time   `json:"completed"` //null while submitted
+	Legs      []apiLiveLeg `json:"legs"`      //short call, long call, short put, long put
+}
+
+type apiLiveTradesResponse struct {
+	Version int            `json:"version"`
+	Trades  []apiLiveTrade `json:"trades"` //newest first
+}
+
+type apiLiveTradeResponse struct {
+	Version int          `json:"version"`
+	Trade   apiLiveTrade `json:"trade"`
+}
+
+type apiExecutionLeg struct {
+	Strike         float64 `json:"strike"`
+	OptionType     string  `json:"option_type"`
+	Exchange       string  `json:"exchange"`
+	Side           string  `json:"side"`
+	Limit          float64 `json:"limit"`     //of the first order, retries move it by the price tolerance
+	Amount         float64 `json:"amount"`    //requested
+	Liquidity      float64 `json:"liquidity"` //quoted within the limit when the execution started
+	Attempts       int     `json:"attempts"`
+	Filled         float64 `json:"filled"`
+	AvgPrice       float64 `json:"avg_price"`
+	Unwound        float64 `json:"unwound"` //closed again by opposite orders
+	UnwindAvgPrice float64 `json:"unwind_avg_price"`
+	Fees           float64 `json:"fees"`
+	Unknown        bool    `json:"unknown"` //an order's outcome is unknown, filled and unwound may be short
+}
+
+type apiLegDecision struct {
+	Time   time.Time `json:"time"`
+	Leg    int       `json:"leg"` //index into legs, -1 for the whole box
+	Action string    `json:"action"`
+	Detail string    `json:"detail"`
+}
+
+type apiExecution struct {
+	Id        int               `json:"id"`
+	Mode      string            `json:"mode"` //paper or live
+	Asset     string            `json:"asset"`
+	Expiry    int64             `json:"expiry"`
+	K1        float64           `json:"k1"`
+	K2        float64           `json:"k2"`
+	Direction string            `json:"direction"`
+	Size      float64           `json:"size"`
+	Boxes     float64           `json:"boxes"`  //completed boxes
+	Status    string            `json:"status"` //running, filled, reduced, unwound or exposed
+	Started   time.Time         `json:"started"`
+	Finished  *time.Time        `json:"finished"` //null while running
+	Legs      []apiExecutionLeg `json:"legs"`     //short call, long call, short put, long put
+	Decisions []apiLegDecision  `json:"decisions"`
+}
+
+type apiExecutionsResponse struct {
+	Version    int            `json:"version"`
+	Executions []apiExecution `json:"executions"` //newest first
+}
+
+type apiExecutionResponse struct {
+	Version   int          `json:"version"`
+	Execution apiExecution `json:"execution"`
+}
+
+type apiError struct {
+	Version int    `json:"version"`
+	Error   string `json:"error"`
+}
+
+// BoxFilter selects boxes by the query parameters asset, expiry, direction, min_apy, min_profit, min_size, exchange and
+// exchanges, zero values match everything
+type BoxFilter struct {
+	Asset     string
+	Expiry    int64
+	Direction string
+	MinApy    float64
+	MinProfit float64 //net profit per box, 0 also matches short boxes below a positive max_borrow_rate, whose net profit is negative
+	MinSize   float64
+	Exchange  string          //box has at least one leg on this exchange
+	Exchanges map[string]bool //every leg is on one of these exchanges, comma separated or repeated
+}
+
+func parseBoxFilter(query url.Values) (BoxFilter, error) {
+	var filter BoxFilter
+	var err error
+
+	filter.Asset = query.Get("asset")
+	filter.Exchange = query.Get("exchange")
+	filter.Direction = query.Get("direction")
+	if filter.Direction != "" && filter.Direction != BoxLong && filter.Direction != BoxShort {
+		return filter, fmt.Errorf("direction: expected %v or %v, got %q", BoxLong, BoxShort, filter.Direction)
+	}
+	if value := query.Get("expiry"); value != "" {
+		filter.Expiry, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return filter, fmt.Errorf("expiry: expected unix timestamp, got %q", value)
+		}
+	}
+	if value := query.Get("min_apy"); value != "" {
+		filter.MinApy, err = strconv.ParseFloat(value, 64)
+		if err != nil {
+			return filter, fmt.Errorf("min_apy: expected number, got %q", value)
+		}
+	}
+	if value := query.Get("min_profit"); value != "" {
+		filter.MinProfit, err = strconv.ParseFloat(value, 64)
+		if err != nil {
+			return filter, fmt.Errorf("min_profit: expected number, got %q", value)
+		}
+	}
+	if value := query.Get("min_size"); value != "" {
+		filter.MinSize, err = strconv.ParseFloat(value, 64)
+		if err != nil {
+			return filter, fmt.Errorf("min_size: expected number, got %q", value)
+		}
+	}
+	for _, value := range query["exchanges"] {
+		for _, exchange := range splitList(value) {
+			if filter.Exchanges == nil {
+				filter.Exchanges = make(map[string]bool)
+			}
+			filter.Exchanges[exchange] = true
+		}
+	}
+
+	return filter, nil
+}
+
+func (f BoxFilter) Match(box *Box) bool {
+	if f.Asset != "" && box.Key.Asset != f.Asset {
+		return false
+	}
+	if f.Expiry != 0 && box.Key.Expiry != f.Expiry {
+		return false
+	}
+	if f.Direction != "" && box.Key.Direction != f.Direction {
+		return false
+	}
+	if box.Apy < f.MinApy || box.MaxSize < f.MinSize {
+		return false
+	}
+	if f.MinProfit != 0 && box.NetProfit < f.MinProfit {
+		return false
+	}
+
+	legs := [][]Order{box.ShortCallBids, box.LongCallAsks, box.ShortPutBids, box.LongPutAsks}
+	if f.Exchanges != nil {
+		for _, leg := range legs {
+			if len(leg) > 0 && !f.Exchanges[leg[0].Exchange] {
+				return false
+			}
+		}
+	}
+	if f.Exchange != "" {
+		for _, leg := range legs {
+			if len(leg) > 0 && leg[0].Exchange == f.Exchange {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+// sort keys accepted by /api/boxes and the dashboard as sort=, order=asc|desc (default desc)
+var boxSortKeys = map[string]func(box *Box) float64{
+	"apy":          func(box *Box) float64 { return box.Apy },
+	"net_profit":   func(box *Box) float64 { return box.NetProfit },
+	"total_profit": func(box *Box) float64 { return box.TotalProfit },
+	"rel_profit":   func(box *Box) float64 { return box.RelProfit },
+	"size":         func(box *Box) float64 { return box.MaxSize },
+	"expiry":       func(box *Box) float64 { return float64(box.Key.Expiry) },
+	"k1":           func(box *Box) float64 { return box.Key.K1 },
+	"k2":           func(box *Box) float64 { return box.Key.K2 },
+	"cost":         func(box *Box) float64 { return box.Cost },
+	"payoff":       func(box *Box) float64 { return box.Payoff },
+	"amount":       func(box *Box) float64 { return box.Amount },
+	"profit":       func(box *Box) float64 { return box.Profit },
+	"fees":         func(box *Box) float64 { return box.Fees },
+	"vwap_cost":    func(box *Box) float64 { return box.VwapCost },
+	"borrow_rate":  func(box *Box) float64 { return box.BorrowRate },
+}
+
+// parseBoxSort returns the sort key function and direction of the query parameters sort and order
+func parseBoxSort(query url.Values) (func(box *Box) float64, bool, error) {
+	sortKey := query.Get("sort")
+	if sortKey == "" {
+		sortKey = "apy"
+	}
+	sortValue, ok := boxSortKeys[sortKey]
+	if !ok {
+		return nil, false, fmt.Errorf("sort: unknown key %q", sortKey)
+	}
+	order := query.Get("order")
+	if order != "" && order != "asc" && order != "desc" {
+		return nil, false, fmt.Errorf("order: expected asc or desc, got %q", order)
+	}
+
+	return sortValue, order == "asc", nil
+}
+
+func sortBoxes(boxes []*Box, sortValue func(box *Box) float64, asc bool) {
+	sort.SliceStable(boxes, func(i, j int) bool {
+		if asc {
+			return sortValue(boxes[i]) < sortValue(boxes[j])
+		}
+		return sortValue(boxes[i]) > sortValue(boxes[j])
+	})
+}
+
+// filteredBoxes returns the boxes matching filter, sorted
+func filteredBoxes(filter BoxFilter, sortValue func(box *Box) float64, asc bool) []*Box {
+	boxes := make([]*Box, 0)
+	BoxContainer.Mu.Lock()
+	for _, box := range BoxContainer.Boxes {
+		if filter.Match(box) {
+			boxes = append(boxes, box)
+		}
+	}
+	BoxContainer.Mu.Unlock()
+
+	sortBoxes(boxes, sortValue, asc)
+
+	return boxes
+}
+
+func toApiLevels(orders []Order) []apiLevel {
+	levels := make([]apiLevel, len(orders))
+	for i, order := range orders {
+		levels[i] = apiLevel{order.Exchange, order.Price, order.Amount, order.Iv, order.Timestamp}
+	}
+
+	return levels
+}
+
+func toApiBook(book map[string][]Order) map[string][]apiLevel {
+	levels := make(map[string][]apiLevel, len(book))
+	for exchange, orders := range book {
+		levels[exchange] = toApiLevels(orders)
+	}
+
+	return levels
+}
+
+func toApiBox(box *Box) apiBox {
+	return apiBox{
+		Asset:         box.Key.Asset,
+		Expiry:        box.Key.Expiry,
+		ExpiryTime:    time.Unix(box.Key.Expiry, 0).UTC(),
+		K1:            box.Key.K1,
+		K2:            box.Key.K2,
+		Direction:     box.Key.Direction,
+		ShortCallBids: toApiLevels(box.ShortCallBids),
+		LongCallAsks:  toApiLevels(box.LongCallAsks),
+		ShortPutBids:  toApiLevels(box.ShortPutBids),
+		LongPutAsks:   toApiLevels(box.LongPutAsks),
+		Payoff:        box.Payoff,
+		Cost:          box.Cost,
+		Amount:        box.Amount,
+		Profit:        box.Profit,
+		Fees:          box.Fees,
+		NetProfit:     box.NetProfit,
+		RelProfit:     box.RelProfit,
+		Apy:           box.Apy,
+		BorrowRate:    box.BorrowRate,
+		MaxSize:       box.MaxSize,
+		VwapCost:      box.VwapCost,
+		TotalProfit:   box.TotalProfit,
+	}
+}
+
+func toApiPaperTrade(trade *PaperTrade) apiPaperTrade {
+	legs := make([]apiPaperLeg, len(trade.Legs))
+	for i, leg := range trade.Legs {
+		fills := make([]apiPaperFill, len(leg.Fills))
+		for k, fill := range leg.Fills {
+			fills[k] = apiPaperFill{fill.Exchange, fill.Price, fill.Amount, fill.Fee}
+		}
+		filled, avgPrice, _ := leg.filled()
+		legs[i] = apiPaperLeg{leg.Instrument.Strike, leg.Instrument.Type, leg.Side, leg.Limit, leg.Amount, filled, avgPrice, fills}
+	}
+
+	var executed *time.Time
+	if trade.Status != PaperPending {
+		executed = &trade.Executed
+	}
+
+	return apiPaperTrade{
+		Id:             trade.Id,
+		Asset:          trade.Key.Asset,
+		Expiry:         trade.Key.Expiry,
+		K1:             trade.Key.K1,
+		K2:             trade.Key.K2,
+		Direction:      trade.Key.Direction,
+		Size:           trade.Size,
+		Status:         trade.Status,
+		Submitted:      trade.Submitted,
+		Executed:       executed,
+		Legs:           legs,
+		ExpectedProfit: trade.ExpectedProfit,
+		Boxes:          trade.Boxes,
+		RealizedProfit: trade.RealizedProfit,
+	}
+}
+
+func toApiLiveTrade(trade *LiveTrade) apiLiveTrade {
+	legs := make([]apiLiveLeg, len(trade.Legs))
+	for i, leg := range trade.Legs {
+		fills := make([]apiLiveFill, len(leg.Fills))
+		for k, fill := range leg.Fills {
+			fills[k] = apiLiveFill{fill.TradeId, fill.Price, fill.Amount, fill.Fee}
+		}
+		legs[i] = apiLiveLeg{leg.Name, leg.Side, leg.Limit, leg.Amount, leg.OrderId, leg.Status, leg.Filled, leg.AvgPrice, fills, leg.Error}
+	}
+
+	var completed *time.Time
+	if trade.Status != LiveSubmitted {
+		completed = &trade.Completed
+	}
+
+	return apiLiveTrade{
+		Id:        trade.Id,
+		Asset:     trade.Key.Asset,
+		Expiry:    trade.Key.Expiry,
+		K1:        trade.Key.K1,
+		K2:        trade.Key.K2,
+		Direction: trade.Key.Direction,
+		Size:      trade.Size,
+		Status:    trade.Status,
+		Submitted: trade.Submitted,
+		Completed: completed,
+		Legs:      legs,
+	}
+}
+
+func toApiExecution(exec *BoxExecution) apiExecution {
+	legs := make([]apiExecutionLeg, len(exec.Legs))
+	for i, leg := range exec.Legs {
+		instrument := leg.Order.Instrument
+		legs[i] = apiExecutionLeg{
+			instrument.Strike, instrument.Type, instrument.Venue, leg.Order.Side, leg.Order.Limit, leg.Order.Amount,
+			leg.Liquidity, leg.Attempts, leg.Filled, leg.AvgPrice, leg.Unwound, leg.UnwindAvg, leg.Fees, leg.Unknown,
+		}
+	}
+	decisions := make([]apiLegDecision, len(exec.Decisions))
+	for i, decision := range exec.Decisions {
+		decisions[i] = apiLegDecision{decision.Time, decision.Leg, decision.Action, decision.Detail}
+	}
+
+	var finished *time.Time
+	if exec.Status != ExecRunning {
+		finished = &exec.Finished
+	}
+
+	return apiExecution{
+		Id:        exec.Id,
+		Mode:      exec.Mode,
+		Asset:     exec.Key.Asset,
+		Expiry:    exec.Key.Expiry,
+		K1:        exec.Key.K1,
+		K2:        exec.Key.K2,
+		Direction: exec.Key.Direction,
+		Size:      exec.Size,
+		Boxes:     exec.Boxes,
+		Status:    exec.Status,
+		Started:   exec.Started,
+		Finished:  finished,
+		Legs:      legs,
+		Decisions: decisions,
+	}
+}
+
+// writeJson encodes v before writing the status, so an encoding error is answered with a 500 instead of a truncated body
+func writeJson(w http.ResponseWriter, status int, v any) {
+	var body bytes.Buffer
+	err := json.NewEncoder(&body).Encode(v)
+	if err != nil {
+		log.Printf("writeJson: %v\n\n", err)
+		status = http.StatusInternalServerError
+		body.Reset()
+		json.NewEncoder(&body).Encode(apiError{ApiVersion, "encoding response: " + err.Error()})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body.Bytes())
+}
+
+func writeJsonError(w http.ResponseWriter, status int, err error) {
+	writeJson(w, status, apiError{ApiVersion, err.Error()})
+}
+
+func apiBoxesHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter, err := parseBoxFilter(query)
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	sortValue, asc, err := parseBoxSort(query)
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	//converted outside filteredBoxes so BoxContainer.Mu isn't held while copying levels
+	boxes := make([]apiBox, 0)
+	for _, box := range filteredBoxes(filter, sortValue, asc) {
+		boxes = append(boxes, toApiBox(box))
+	}
+
+	writeJson(w, http.StatusOK, apiBoxesResponse{ApiVersion, boxes})
+}
+
+func apiOrderbookHandler(w http.ResponseWriter, r *http.Request) {
+	expiry, err := strconv.ParseInt(r.PathValue("expiry"), 10, 64)
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, fmt.Errorf("expiry: expected unix timestamp, got %q", r.PathValue("expiry")))
+		return
+	}
+	strike, err := strconv.ParseFloat(r.PathValue("strike"), 64)
+	if err != nil || math.IsNaN(strike) {
+		writeJsonError(w, http.StatusBadRequest, fmt.Errorf("strike: expected number, got %q", r.PathValue("strike")))
+		return
+	}
+	asset := r.URL.Query().Get("asset")
+
+	orderbooks := make([]apiOrderbook, 0)
+	for chain, strikes := range Orderbooks.Snapshot() {
+		if chain.Expiry != expiry || (asset != "" && chain.Asset != asset) {
+			continue
+		}
+		for _, orders := range strikes {
+			if orders.Strike != strike {
+				continue
+			}
+			orderbooks = append(orderbooks, apiOrderbook{
+				Asset:    chain.Asset,
+				Expiry:   chain.Expiry,
+				Strike:   orders.Strike,
+				CallBids: toApiBook(orders.CallBids),
+				CallAsks: toApiBook(orders.CallAsks),
+				PutBids:  toApiBook(orders.PutBids),
+				PutAsks:  toApiBook(orders.PutAsks),
+			})
+		}
+	}
+
+	if len(orderbooks) == 0 {
+		writeJsonError(w, http.StatusNotFound, fmt.Errorf("no orderbook for expiry %v strike %v", expiry, strike))
+		return
+	}
+	sort.Slice(orderbooks, func(i, j int) bool { return orderbooks[i].Asset < orderbooks[j].Asset })
+
+	writeJson(w, http.StatusOK, apiOrderbooksResponse{ApiVersion, orderbooks})
+}
+
+func apiInstrumentsHandler(supervisors []*ConnSupervisor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		exchanges := make(map[string]apiExchangeInstruments, len(supervisors))
+		for _, supervisor := range supervisors {
+			connected, instruments := supervisor.Status()
+			if instruments == nil {
+				instruments = []string{}
+			}
+			exchanges[supervisor.Ex.Name()] = apiExchangeInstruments{connected, instruments}
+		}
+
+		writeJson(w, http.StatusOK, apiInstrumentsResponse{ApiVersion, exchanges})
+	}
+}
+
+func apiPaperTradesHandler(w http.ResponseWriter, r *http.Request) {
+	trades := make([]apiPaperTrade, 0)
+	for _, trade := range Paper.Trades() {
+		trades = append(trades, toApiPaperTrade(trade))
+	}
+
+	writeJson(w, http.StatusOK, apiPaperTradesResponse{ApiVersion, trades})
+}
+
+func (r apiBoxTradeRequest) boxKey() (BoxKey, error) {
+	if r.Direction == "" {
+		r.Direction = BoxLong
+	}
+	if r.Direction != BoxLong && r.Direction != BoxShort {
+		return BoxKey{}, fmt.Errorf("direction: expected %v or %v, got %q", BoxLong, BoxShort, r.Direction)
+	}
+
+	return BoxKey{r.Asset, r.Expiry, r.K1, r.K2, r.Direction}, nil
+}
+
+func decodeBoxTradeRequest(r *http.Request) (apiBoxTradeRequest, error) {
+	var request apiBoxTradeRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&request)
+	if err != nil {
+		return request, fmt.Errorf("invalid request body: %v", err)
+	}
+
+	return request, nil
+}
+
+func apiPaperSubmitHandler(w http.ResponseWriter, r *http.Request) {
+	request, err := decodeBoxTradeRequest(r)
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, err)
+		return
+	}
+	key, err := request.boxKey()
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	trade, err := Paper.Submit(key, request.Size)
+	if err != nil {
+		writeJsonError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	writeJson(w, http.StatusAccepted, apiPaperTradeResponse{ApiVersion, toApiPaperTrade(trade)})
+}
+
+func apiPaperPositionsHandler(w http.ResponseWriter, r *http.Request) {
+	positions, cashFlows := Paper.Positions()
+
+	response := apiPaperPositionsResponse{
+		Version:   ApiVersion,
+		Positions: make([]apiPaperPosition, len(positions)),
+		CashFlows: make([]apiPaperCashFlow, len(cashFlows)),
+	}
+	for i, position := range positions {
+		instrument := position.Instrument
+		response.Positions[i] = apiPaperPosition{instrument.Asset, instrument.Expiry, instrument.Strike, instrument.Type, instrument.Venue, position.Amount}
+	}
+	for i, flow := range cashFlows {
+		response.CashFlows[i] = apiPaperCashFlow{flow.Time, flow.TradeId, flow.Exchange, flow.Name, flow.Kind, flow.Amount}
+		response.Cash += flow.Amount
+	}
+
+	writeJson(w, http.StatusOK, response)
+}
+
+func registerApiHandlers(mux *http.ServeMux, supervisors []*ConnSupervisor) {
+	mux.HandleFunc("GET /api/boxes", apiBoxesHandler)
+	mux.HandleFunc("GET /api/orderbooks/{expiry}/{strike}", apiOrderbookHandler)
+	mux.HandleFunc("GET /api/instruments", apiInstrumentsHandler(supervisors))
+	mux.HandleFunc("GET /api/paper/trades", apiPaperTradesHandler)
+	mux.HandleFunc("POST /api/paper/trades", apiPaperSubmitHandler)
+	mux.HandleFunc("GET /api/paper/positions", apiPaperPositionsHandler)
+}
+
+func apiLiveTradesHandler(executor *AevoExecutor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		trades := make([]apiLiveTrade, 0)
+		for _, trade := range executor.Trades() {
+			trades = append(trades, toApiLiveTrade(trade))
+		}
+
+		writeJson(w, http.StatusOK, apiLiveTradesResponse{ApiVersion, trades})
+	}
+}
+
+// apiLiveSubmitHandler executes a box on aevo and responds once its orders are acknowledged and their fills confirmed.
+// like apiExecuteHandler the execution isn't cancelled when the client goes away, the orders may already be on the book
+func apiLiveSubmitHandler(executor *AevoExecutor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		request, err := decodeBoxTradeRequest(r)
+		if err != nil {
+			writeJsonError(w, http.StatusBadRequest, err)
+			return
+		}
+		key, err := request.boxKey()
+		if err != nil {
+			writeJsonError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		trade, err := executor.ExecuteBox(context.WithoutCancel(r.Context()), key, request.Size)
+		if err != nil {
+			writeJsonError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+
+		writeJson(w, http.StatusOK, apiLiveTradeResponse{ApiVersion, toApiLiveTrade(trade)})
+	}
+}
+
+// registerLiveHandlers is only called with live execution enabled, mux is served behind requireToken or on a loopback
+// listener, see AevoExecution
+func registerLiveHandlers(mux *http.ServeMux, executor *AevoExecutor) {
+	mux.HandleFunc("GET /api/live/trades", apiLiveTradesHandler(executor))
+	mux.HandleFunc("POST /api/live/trades", apiLiveSubmitHandler(executor))
+}
+
+// requireToken passes only requests with an "Authorization: Bearer <token>" header on to next
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="live"`)
+			writeJsonError(w, http.StatusUnauthorized, errors.New("requireToken: missing or invalid bearer token"))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func apiExecutionsHandler(controller *LegRiskController) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		executions := make([]apiExecution, 0)
+		for _, exec := range controller.Executions() {
+			executions = append(executions, toApiExecution(exec))
+		}
+
+		writeJson(w, http.StatusOK, apiExecutionsResponse{ApiVersion, executions})
+	}
+}
+
+// apiExecuteHandler executes a box leg by leg and responds once every leg is filled or unwound. the execution isn't
+// cancelled when the client goes away, stopping between legs would leave the filled ones exposed
+func apiExecuteHandler(controller *LegRiskController) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		request, err := decodeBoxTradeRequest(r)
+		if err != nil {
+			writeJsonError(w, http.StatusBadRequest, err)
+			return
+		}
+		key, err := request.boxKey()
+		if err != nil {
+			writeJsonError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		exec, err := controller.Execute(context.WithoutCancel(r.Context()), key, request.Size)
+		if err != nil {
+			writeJsonError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+
+		writeJson(w, http.StatusOK, apiExecutionResponse{ApiVersion, toApiExecution(exec)})
+	}
+}
+
+// registerExecutionHandlers serves the executions of controller under /api/{mode}/executions
+func registerExecutionHandlers(mux *http.ServeMux, controller *LegRiskController) {
+	mux.HandleFunc("GET /api/"+controller.Mode+"/executions", apiExecutionsHandler(controller))
+	mux.HandleFunc("POST /api/"+controller.Mode+"/executions", apiExecuteHandler(controller))
+}
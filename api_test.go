@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveApi answers one request with the handlers of registerApiHandlers, decoding the body into v unless nil
+func serveApi(t *testing.T, supervisors []*ConnSupervisor, method string, target string, v any) *httptest.ResponseRecorder {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	registerApiHandlers(mux, supervisors)
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(method, target, nil))
+
+	if ct := recorder.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("%v %v: content type %q", method, target, ct)
+	}
+	if v != nil {
+		if err := json.Unmarshal(recorder.Body.Bytes(), v); err != nil {
+			t.Fatalf("%v %v: %v in %s", method, target, err, recorder.Body.Bytes())
+		}
+	}
+
+	return recorder
+}
+
+func TestApiBoxes(t *testing.T) {
+	resetState(t)
+
+	expiry := now().Add(30 * 24 * time.Hour).Unix()
+	leg := func(exchange string) []Order { return []Order{{Price: 1, Amount: 1, Exchange: exchange}} }
+	boxes := []*Box{
+		{Key: BoxKey{"ETH", expiry, 2000, 2100, BoxLong}, ShortCallBids: leg("aevo"), LongCallAsks: leg("aevo"), ShortPutBids: leg("aevo"), LongPutAsks: leg("aevo"), NetProfit: 1, Apy: 0.05, MaxSize: 2},
+		{Key: BoxKey{"ETH", expiry, 2000, 2200, BoxLong}, ShortCallBids: leg("aevo"), LongCallAsks: leg("deribit"), ShortPutBids: leg("aevo"), LongPutAsks: leg("deribit"), NetProfit: 3, Apy: 0.2, MaxSize: 1},
+		{Key: BoxKey{"BTC", expiry, 60000, 61000, BoxShort}, ShortCallBids: leg("deribit"), LongCallAsks: leg("deribit"), ShortPutBids: leg("deribit"), LongPutAsks: leg("deribit"), NetProfit: -5, Apy: 0.1, MaxSize: 5},
+	}
+	for _, box := range boxes {
+		BoxContainer.Boxes[box.Key] = box
+	}
+
+	tests := []struct {
+		query string
+		want  []float64 //k2 of the boxes in order
+	}{
+		{"", []float64{2200, 61000, 2100}},
+		{"?sort=size&order=asc", []float64{2200, 2100, 61000}},
+		{"?asset=ETH", []float64{2200, 2100}},
+		{"?direction=short", []float64{61000}},
+		{"?min_apy=0.08", []float64{2200, 61000}},
+		{"?min_size=2&sort=k2", []float64{61000, 2100}},
+		{"?exchange=deribit&asset=ETH", []float64{2200}},
+		{"?exchanges=aevo", []float64{2100}},
+		{"?exchanges=aevo,deribit&sort=net_profit", []float64{2200, 2100, 61000}},
+		{"?min_profit=2", []float64{2200}},
+		{"?expiry=1", []float64{}},
+	}
+	for _, test := range tests {
+		var response apiBoxesResponse
+		recorder := serveApi(t, nil, "GET", "/api/boxes"+test.query, &response)
+		if recorder.Code != http.StatusOK {
+			t.Errorf("%q: status %v", test.query, recorder.Code)
+			continue
+		}
+		got := make([]float64, len(response.Boxes))
+		for i, box := range response.Boxes {
+			got[i] = box.K2
+		}
+		if response.Version != ApiVersion || len(got) != len(test.want) {
+			t.Errorf("%q: got version %v boxes %v, want %v", test.query, response.Version, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%q: got boxes %v, want %v", test.query, got, test.want)
+				break
+			}
+		}
+	}
+
+	for _, query := range []string{"?direction=up", "?expiry=soon", "?min_apy=x", "?min_profit=x", "?min_size=x", "?sort=vega", "?order=up"} {
+		var response apiError
+		recorder := serveApi(t, nil, "GET", "/api/boxes"+query, &response)
+		if recorder.Code != http.StatusBadRequest || response.Error == "" {
+			t.Errorf("%q: got status %v error %q, want 400 with an error", query, recorder.Code, response.Error)
+		}
+	}
+}
+
+func TestApiOrderbook(t *testing.T) {
+	resetState(t)
+
+	received := time.Unix(1700000000, 0).UTC()
+	for _, asset := range []string{"ETH", "BTC"} {
+		instrument := Instrument{Asset: asset, Expiry: 1798704000, Strike: 2000, Type: Call, Venue: "aevo"}
+		Orderbooks.Update(instrument, []Order{{Price: 10, Amount: 2, Exchange: "aevo", Iv: 0.5, Timestamp: received}}, nil)
+	}
+
+	var response apiOrderbooksResponse
+	recorder := serveApi(t, nil, "GET", "/api/orderbooks/1798704000/2000", &response)
+	if recorder.Code != http.StatusOK || len(response.Orderbooks) != 2 || response.Orderbooks[0].Asset != "BTC" {
+		t.Fatalf("got status %v %+v, want the books of BTC and ETH", recorder.Code, response)
+	}
+	want := apiLevel{"aevo", 10, 2, 0.5, received}
+	if levels := response.Orderbooks[1].CallBids["aevo"]; len(levels) != 1 || levels[0] != want {
+		t.Errorf("call bids: got %+v, want %+v", levels, want)
+	}
+
+	response = apiOrderbooksResponse{}
+	serveApi(t, nil, "GET", "/api/orderbooks/1798704000/2000?asset=ETH", &response)
+	if len(response.Orderbooks) != 1 || response.Orderbooks[0].Asset != "ETH" {
+		t.Errorf("asset=ETH: got %+v", response.Orderbooks)
+	}
+
+	tests := []struct {
+		target string
+		status int
+	}{
+		{"/api/orderbooks/1798704000/2100", http.StatusNotFound},
+		{"/api/orderbooks/1798704000/2000?asset=SOL", http.StatusNotFound},
+		{"/api/orderbooks/tomorrow/2000", http.StatusBadRequest},
+		{"/api/orderbooks/1798704000/NaN", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		var response apiError
+		if recorder := serveApi(t, nil, "GET", test.target, &response); recorder.Code != test.status || response.Error == "" {
+			t.Errorf("%v: got status %v error %q, want %v", test.target, recorder.Code, response.Error, test.status)
+		}
+	}
+}
+
+func TestApiInstruments(t *testing.T) {
+	supervisor := &ConnSupervisor{Ex: &Aevo{}, instruments: []string{"ETH-31DEC27-2000-C"}}
+	idle := &ConnSupervisor{Ex: &Deribit{}}
+
+	var response apiInstrumentsResponse
+	serveApi(t, []*ConnSupervisor{supervisor, idle}, "GET", "/api/instruments", &response)
+
+	if aevo := response.Exchanges["aevo"]; aevo.Connected || strings.Join(aevo.Instruments, ",") != "ETH-31DEC27-2000-C" {
+		t.Errorf("aevo: got %+v", aevo)
+	}
+	if deribit, ok := response.Exchanges["deribit"]; !ok || deribit.Instruments == nil {
+		t.Errorf("deribit: got %+v, want an empty list before the first subscription", deribit)
+	}
+}
+
+func TestWriteJsonEncodeError(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	writeJson(recorder, http.StatusOK, apiBox{Apy: math.Inf(1)})
+
+	var response apiError
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("body %q isn't JSON: %v", recorder.Body.Bytes(), err)
+	}
+	if recorder.Code != http.StatusInternalServerError || response.Error == "" {
+		t.Errorf("got status %v error %q, want 500 with an error", recorder.Code, response.Error)
+	}
+}
+
+func TestCrossedAndExpiredBoxes(t *testing.T) {
+	resetState(t)
+
+	//call asks below the bids of the other venue on both strikes, the long box pays to be entered
+	expiry := now().Add(30 * 24 * time.Hour).Unix()
+	received := now()
+	quote := func(expiry int64, strike float64, optionType string, bid float64, ask float64) {
+		instrument := Instrument{Asset: "ETH", Expiry: expiry, Strike: strike, Type: optionType, Venue: "aevo"}
+		order := func(price float64) []Order {
+			return []Order{{Asset: "ETH", Price: price, Amount: 1, Strike: strike, OptionType: optionType, Exchange: "aevo", Timestamp: received}}
+		}
+		Orderbooks.Update(instrument, order(bid), order(ask))
+	}
+	for _, chainExpiry := range []int64{expiry, now().Add(-time.Hour).Unix()} {
+		quote(chainExpiry, 2000, Call, 150, 100)
+		quote(chainExpiry, 2100, Call, 120, 60)
+		quote(chainExpiry, 2000, Put, 90, 40)
+		quote(chainExpiry, 2100, Put, 100, 80)
+	}
+	updateBoxes()
+
+	box, ok := BoxContainer.Boxes[BoxKey{"ETH", expiry, 2000, 2100, BoxLong}]
+	if !ok {
+		t.Fatalf("no crossed long box in %v", BoxContainer.Boxes)
+	}
+	if box.Cost+box.Fees > 0 {
+		t.Fatalf("cost %v fees %v, want a box paid for", box.Cost, box.Fees)
+	}
+	for name, value := range map[string]float64{"apy": box.Apy, "rel profit": box.RelProfit, "borrow rate": box.BorrowRate} {
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			t.Errorf("%v: got %v", name, value)
+		}
+	}
+	if recorder := serveApi(t, nil, "GET", "/api/boxes", nil); recorder.Code != http.StatusOK {
+		t.Errorf("/api/boxes: status %v %s", recorder.Code, recorder.Body.Bytes())
+	}
+
+	for key := range BoxContainer.Boxes {
+		if key.Expiry != expiry {
+			t.Errorf("box %+v of an expired chain", key)
+		}
+	}
+	for chain := range Orderbooks.Snapshot() {
+		if chain.Expiry != expiry {
+			t.Errorf("books of expired chain %+v weren't evicted", chain)
+		}
+	}
+}
+
+func TestRequireToken(t *testing.T) {
+	token := strings.Repeat("t", MinAuthTokenLength)
+	handler := requireToken(token, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		authorization string
+		want          int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer " + token, http.StatusNoContent},
+		{"Bearer " + token + "x", http.StatusUnauthorized},
+		{"Bearer " + token[1:], http.StatusUnauthorized},
+		{"bearer " + token, http.StatusUnauthorized},
+		{"Basic " + token, http.StatusUnauthorized},
+		{token, http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", "/api/live/trades", nil)
+		if test.authorization != "" {
+			req.Header.Set("Authorization", test.authorization)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		if recorder.Code != test.want {
+			t.Errorf("%q: got %v, want %v", test.authorization, recorder.Code, test.want)
+		}
+		if test.want == http.StatusUnauthorized && !strings.HasPrefix(recorder.Header().Get("WWW-Authenticate"), "Bearer") {
+			t.Errorf("%q: no bearer challenge", test.authorization)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"embed"
+	"html/template"
+	"io/fs"
+	"net/http"
+)
+
+// templates and static files are compiled into the binary, so it runs from any directory and without network access
+
+//go:embed templates/*.html
+var templateFiles embed.FS
+
+//go:embed static
+var staticFiles embed.FS
+
+// upstream htmx 2.0.4 and its license are vendored into static, go generate fetches them again
+//go:generate curl -fsSL -o static/htmx.min.js https://unpkg.com/htmx.org@2.0.4/dist/htmx.min.js
+//go:generate curl -fsSL -o static/htmx.LICENSE https://unpkg.com/htmx.org@2.0.4/LICENSE
+
+// parsed once at startup, pages are looked up by file name (index.html) and partials by their define name (box-rows)
+var Templates = template.Must(template.ParseFS(templateFiles, "templates/*.html"))
+
+func staticHandler() http.Handler {
+	static, err := fs.Sub(staticFiles, "static")
+	if err != nil {
+		panic(err) //only fails on an invalid path
+	}
+
+	return http.StripPrefix("/static/", http.FileServerFS(static))
+}
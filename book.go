@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// one message for the local book of an instrument, either a full snapshot or incremental changes per price level
+type bookDelta struct {
+	Snapshot bool
+	Seq      int64 //sequence number or timestamp of this message, must not go backwards
+	PrevSeq  int64 //sequence number of the message this one follows, 0 if the venue doesn't send it
+	Bids     []priceLevel
+	Asks     []priceLevel //changed levels, amount 0 deletes the level
+}
+
+type localBook struct {
+	bids map[float64]priceLevel //price: level
+	asks map[float64]priceLevel
+	seq  int64
+}
+
+// SequenceGapError is returned when a delta doesn't follow the local book, the book is dropped, its levels are cleared
+// from Orderbooks and the instrument has to be resubscribed to get a new snapshot
+type SequenceGapError struct {
+	Venue      string
+	Instrument string
+	Reason     string
+}
+
+func (e *SequenceGapError) Error() string {
+	return fmt.Sprintf("sequence gap on %v %v: %v", e.Venue, e.Instrument, e.Reason)
+}
+
+// LocalBooks keeps the local orderbooks of one venue's instruments, built from snapshots and deltas
+type LocalBooks struct {
+	mu        sync.Mutex
+	books     map[string]*localBook //instrument: book
+	resyncing map[string]bool       //instruments with a reported gap, deltas are dropped until their next snapshot
+}
+
+// Apply applies delta to the book of instrument and returns the resulting book, bids sorted by price descending and
+// asks ascending. A *SequenceGapError is returned once per gap, further deltas are dropped with nil levels until a
+// snapshot arrives
+func (b *LocalBooks) Apply(venue string, instrument string, delta bookDelta) ([]priceLevel, []priceLevel, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.books == nil {
+		b.books = make(map[string]*localBook)
+		b.resyncing = make(map[string]bool)
+	}
+
+	book, exists := b.books[instrument]
+	if delta.Snapshot {
+		book = &localBook{bids: make(map[float64]priceLevel), asks: make(map[float64]priceLevel)}
+		b.books[instrument] = book
+		delete(b.resyncing, instrument)
+	} else {
+		if b.resyncing[instrument] {
+			return nil, nil, nil
+		}
+
+		reason := ""
+		switch {
+		case !exists:
+			reason = "update before snapshot"
+		case delta.PrevSeq != 0 && delta.PrevSeq != book.seq:
+			reason = fmt.Sprintf("expected previous sequence %v, got %v", book.seq, delta.PrevSeq)
+		case delta.Seq < book.seq:
+			reason = fmt.Sprintf("sequence went backwards from %v to %v", book.seq, delta.Seq)
+		}
+		if reason != "" {
+			delete(b.books, instrument)
+			b.resyncing[instrument] = true
+			return nil, nil, &SequenceGapError{venue, instrument, reason}
+		}
+	}
+	book.seq = delta.Seq
+
+	applyLevels(book.bids, delta.Bids)
+	applyLevels(book.asks, delta.Asks)
+
+	return sortedLevels(book.bids, true), sortedLevels(book.asks, false), nil
+}
+
+func applyLevels(levels map[float64]priceLevel, changes []priceLevel) {
+	for _, change := range changes {
+		if change.Amount == 0 {
+			delete(levels, change.Price)
+		} else {
+			levels[change.Price] = change
+		}
+	}
+}
+
+func sortedLevels(levels map[float64]priceLevel, descending bool) []priceLevel {
+	sorted := make([]priceLevel, 0, len(levels))
+	for _, level := range levels {
+		sorted = append(sorted, level)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if descending {
+			return sorted[i].Price > sorted[j].Price
+		}
+		return sorted[i].Price < sorted[j].Price
+	})
+
+	return sorted
+}
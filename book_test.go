@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// formatLevels formats levels as price:amount pairs
+func formatLevels(levels []priceLevel) string {
+	pairs := make([]string, len(levels))
+	for i, level := range levels {
+		pairs[i] = fmt.Sprintf("%v:%v", level.Price, level.Amount)
+	}
+
+	return strings.Join(pairs, " ")
+}
+
+func TestLocalBooksReplay(t *testing.T) {
+	level := func(price float64, amount float64) priceLevel { return priceLevel{price, amount, -1} }
+	steps := []struct {
+		name       string
+		instrument string
+		delta      bookDelta
+		bids       string //expected book after the step, "-" for nil levels
+		asks       string
+		gap        string //part of the expected gap reason, empty for none
+	}{
+		{"update before snapshot", "A", bookDelta{Seq: 1, Bids: []priceLevel{level(10, 1)}}, "-", "-", "update before snapshot"},
+		{"dropped until snapshot", "A", bookDelta{Seq: 2, Bids: []priceLevel{level(10, 1)}}, "-", "-", ""},
+		{"snapshot", "A", bookDelta{Snapshot: true, Seq: 10, Bids: []priceLevel{level(10, 1), level(11, 2)}, Asks: []priceLevel{level(12, 3)}}, "11:2 10:1", "12:3", ""},
+		{"new level", "A", bookDelta{Seq: 11, PrevSeq: 10, Asks: []priceLevel{level(12.5, 1)}}, "11:2 10:1", "12:3 12.5:1", ""},
+		{"changed level", "A", bookDelta{Seq: 12, PrevSeq: 11, Bids: []priceLevel{level(10, 5)}}, "11:2 10:5", "12:3 12.5:1", ""},
+		{"zero amount deletes", "A", bookDelta{Seq: 13, PrevSeq: 12, Bids: []priceLevel{level(11, 0)}, Asks: []priceLevel{level(12, 0)}}, "10:5", "12.5:1", ""},
+		{"deleting a missing level", "A", bookDelta{Seq: 14, PrevSeq: 13, Bids: []priceLevel{level(9, 0)}}, "10:5", "12.5:1", ""},
+		{"other instrument", "B", bookDelta{Snapshot: true, Seq: 1, Bids: []priceLevel{level(1, 1)}}, "1:1", "", ""},
+		{"same sequence without previous", "A", bookDelta{Seq: 14, Asks: []priceLevel{level(13, 2)}}, "10:5", "12.5:1 13:2", ""},
+		{"missed delta", "A", bookDelta{Seq: 16, PrevSeq: 15, Bids: []priceLevel{level(10.5, 1)}}, "-", "-", "expected previous sequence 14, got 15"},
+		{"dropped while resyncing", "A", bookDelta{Seq: 17, PrevSeq: 16, Bids: []priceLevel{level(10.5, 1)}}, "-", "-", ""},
+		{"other instrument unaffected", "B", bookDelta{Seq: 2, PrevSeq: 1, Asks: []priceLevel{level(2, 1)}}, "1:1", "2:1", ""},
+		{"resync snapshot", "A", bookDelta{Snapshot: true, Seq: 20, Bids: []priceLevel{level(10, 2)}}, "10:2", "", ""},
+		{"sequence backwards", "A", bookDelta{Seq: 19, Asks: []priceLevel{level(12, 1)}}, "-", "-", "sequence went backwards from 20 to 19"},
+		{"snapshot after backwards gap", "A", bookDelta{Snapshot: true, Seq: 21, Asks: []priceLevel{level(12, 1)}}, "", "12:1", ""},
+		{"empty snapshot clears", "B", bookDelta{Snapshot: true, Seq: 3}, "", "", ""},
+	}
+
+	var books LocalBooks
+	for _, step := range steps {
+		bids, asks, err := books.Apply("aevo", step.instrument, step.delta)
+
+		var gap *SequenceGapError
+		if step.gap != "" {
+			if !errors.As(err, &gap) || !strings.Contains(gap.Reason, step.gap) || gap.Instrument != step.instrument || gap.Venue != "aevo" {
+				t.Errorf("%v: got error %v, want a gap on %v: %v", step.name, err, step.instrument, step.gap)
+			}
+		} else if err != nil {
+			t.Errorf("%v: %v", step.name, err)
+		}
+
+		gotBids, gotAsks := formatLevels(bids), formatLevels(asks)
+		if bids == nil && asks == nil {
+			gotBids, gotAsks = "-", "-"
+		}
+		if gotBids != step.bids || gotAsks != step.asks {
+			t.Errorf("%v: got bids %q asks %q, want %q %q", step.name, gotBids, gotAsks, step.bids, step.asks)
+		}
+	}
+}
+
+func TestDispatchFrameGap(t *testing.T) {
+	resetState(t)
+
+	a := &Aevo{}
+	updates := make(chan *BookUpdate, 4)
+	frames := []string{
+		`{"channel":"orderbook:ETH-31DEC27-2000-C","data":{"type":"snapshot","instrument_name":"ETH-31DEC27-2000-C","bids":[["250","4","0.5"]],"asks":[],"last_updated":"100"}}`,
+		`{"channel":"orderbook:ETH-31DEC27-2000-C","data":{"type":"update","instrument_name":"ETH-31DEC27-2000-C","bids":[["251","1","0.5"]],"asks":[],"last_updated":"90"}}`,
+		`{"channel":"orderbook:ETH-31DEC27-2000-C","data":{"type":"update","instrument_name":"ETH-31DEC27-2000-C","bids":[["252","1","0.5"]],"asks":[],"last_updated":"110"}}`,
+		`{"channel":"orderbook:ETH-31DEC27-2000-C","data":{"type":"snapshot","instrument_name":"ETH-31DEC27-2000-C","bids":[["253","2","0.5"]],"asks":[],"last_updated":"120"}}`,
+	}
+
+	var gaps []string
+	for _, frame := range frames {
+		if gap := dispatchFrame(a, []byte(frame), now(), updates); gap != nil {
+			gaps = append(gaps, gap.Instrument)
+		}
+	}
+
+	if strings.Join(gaps, ",") != "ETH-31DEC27-2000-C" {
+		t.Errorf("got gaps %v, want one for the backwards update", gaps)
+	}
+	if len(updates) != 3 {
+		t.Fatalf("got %v updates, want the two snapshots and the gap's clearing update", len(updates))
+	}
+	<-updates
+	if cleared := <-updates; cleared.Instrument.Strike != 2000 || cleared.Instrument.Type != Call || len(cleared.Bids) != 0 || len(cleared.Asks) != 0 {
+		t.Errorf("got %+v for the gap, want an empty update of the 2000 call", cleared)
+	}
+	if last := <-updates; len(last.Bids) != 1 || last.Bids[0].Price != 253 {
+		t.Errorf("got bids %+v after the resync snapshot", last.Bids)
+	}
+}
+
+func TestSequenceGapClearsBox(t *testing.T) {
+	resetState(t)
+
+	a := &Aevo{}
+	updates := make(chan *BookUpdate, 1)
+	dispatch := func(frame string) *SequenceGapError {
+		gap := dispatchFrame(a, []byte(frame), now(), updates)
+		for len(updates) > 0 { //as bookLoop does
+			update := <-updates
+			Orderbooks.Update(update.Instrument, update.Bids, update.Asks)
+			updateChangedBoxes(map[ChainKey]map[float64]bool{update.Instrument.Chain(): {update.Instrument.Strike: true}})
+		}
+		return gap
+	}
+	for _, frame := range []string{
+		`{"channel":"orderbook:ETH-31DEC27-2100-C","data":{"type":"snapshot","instrument_name":"ETH-31DEC27-2100-C","bids":[["250","4","0.5"]],"asks":[],"last_updated":"10"}}`,
+		`{"channel":"orderbook:ETH-31DEC27-2000-C","data":{"type":"snapshot","instrument_name":"ETH-31DEC27-2000-C","bids":[],"asks":[["330","4","0.5"]],"last_updated":"10"}}`,
+		`{"channel":"orderbook:ETH-31DEC27-2000-P","data":{"type":"snapshot","instrument_name":"ETH-31DEC27-2000-P","bids":[["150","4","0.5"]],"asks":[],"last_updated":"10"}}`,
+		`{"channel":"orderbook:ETH-31DEC27-2100-P","data":{"type":"snapshot","instrument_name":"ETH-31DEC27-2100-P","bids":[],"asks":[["160","4","0.5"]],"last_updated":"10"}}`,
+	} {
+		dispatch(frame)
+	}
+	chain := ChainKey{"ETH", time.Date(2027, 12, 31, SettlementHour, 0, 0, 0, time.UTC).Unix()}
+	key := BoxKey{chain.Asset, chain.Expiry, 2000, 2100, BoxLong}
+	if _, ok := BoxContainer.Boxes[key]; !ok {
+		t.Fatalf("long box %v not detected before the gap", key)
+	}
+
+	gap := dispatch(`{"channel":"orderbook:ETH-31DEC27-2000-C","data":{"type":"update","instrument_name":"ETH-31DEC27-2000-C","bids":[],"asks":[["331","1","0.5"]],"last_updated":"9"}}`)
+	if gap == nil {
+		t.Fatal("backwards update wasn't a gap")
+	}
+	strikes := Orderbooks.Chain(chain)
+	if len(strikes) != 2 || strikes[0].Strike != 2000 {
+		t.Fatalf("got %v strikes, want 2000 and 2100", len(strikes))
+	}
+	if asks, ok := strikes[0].CallAsks["aevo"]; ok {
+		t.Errorf("gapped 2000 call asks still in the store: %+v", asks)
+	}
+	if len(strikes[0].PutBids["aevo"]) != 1 {
+		t.Errorf("2000 put of the same strike was cleared too")
+	}
+	if _, ok := BoxContainer.Boxes[key]; ok {
+		t.Errorf("box on the gapped book still detected")
+	}
+}
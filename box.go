@@ -2,28 +2,45 @@ package main
 
 import (
 	"math"
+	"sort"
 	"sync"
 	"time"
 )
 
+// a long box buys the K1 call and K2 put and sells the K2 call and K1 put, paying the box price now and receiving the
+// payoff at expiry (lending). a short box is the opposite trade, receiving the price now and paying the payoff (borrowing)
+const BoxLong = "long"
+const BoxShort = "short"
+
+var MaxBorrowRate = 0.0 //short boxes are detected when their implied annual borrow rate is below this, 0 = only boxes that pay to borrow
+
 // add mutexes
 type Box struct {
-	ShortCallBids []Order //K2
-	LongCallAsks  []Order //K1
-	ShortPutBids  []Order //K1
-	LongPutAsks   []Order //K2
+	Key           BoxKey
+	ShortCallBids []Order //K2 for long boxes, K1 for short
+	LongCallAsks  []Order //K1 for long boxes, K2 for short
+	ShortPutBids  []Order //K1 for long boxes, K2 for short
+	LongPutAsks   []Order //K2 for long boxes, K1 for short
 	Payoff        float64
-	Cost          float64
+	Cost          float64 //box price, paid for long boxes and received for short
 	Amount        float64
-	Profit        float64
-	RelProfit     float64
-	Apy           float64
+	Profit        float64 //gross, payoff - cost for long boxes, cost - payoff for short
+	Fees          float64 //trading and settlement fees per box, see fees.go
+	NetProfit     float64 //profit - fees
+	RelProfit     float64 //net profit / (cost + fees) for long boxes, net profit / (cost - fees) for short
+	Apy           float64 //on net profit
+	BorrowRate    float64 //short boxes: implied annual rate of borrowing cost - fees and repaying the payoff, negative when paid to borrow
+	MaxSize       float64 //largest size at which the box is still detected net of fees walking all four legs' levels together
+	VwapCost      float64 //volume weighted box price up to MaxSize, without fees
+	TotalProfit   float64 //absolute net profit of MaxSize boxes
 }
 
 type BoxKey struct {
-	Expiry int64
-	K1     float64
-	K2     float64
+	Asset     string
+	Expiry    int64
+	K1        float64
+	K2        float64
+	Direction string //BoxLong or BoxShort
 }
 
 type BoxesContainer struct {
@@ -33,45 +50,198 @@ type BoxesContainer struct {
 
 var BoxContainer = BoxesContainer{Boxes: make(map[BoxKey]*Box)}
 
+// findApy compounds relProfit to a year over the days until expiry, NaN or ±Inf once the chain expired or when
+// relProfit is, see finiteOrZero
 func findApy(expiry int64, relProfit float64) float64 {
 	expiryTs := float64(expiry)
-	now := float64(time.Now().Unix())
+	nowTs := float64(now().Unix())
 
-	apy := math.Pow(1.0+(relProfit), 365/math.Ceil((1+expiryTs-now)/86400))
+	apy := math.Pow(1.0+(relProfit), 365/math.Ceil((1+expiryTs-nowTs)/86400))
 	// apy := 365/math.Ceil((1+timestamp-now)/86400) * relProfit
 
 	return apy
 }
 
-func updateBox(expiry int64, strikeOrders1 *Orders, strikeOrders2 *Orders) {
-	if len(strikeOrders2.CallBids) <= 0 || len(strikeOrders1.CallAsks) <= 0 || len(strikeOrders1.PutBids) <= 0 || len(strikeOrders2.PutAsks) <= 0 {
-		return
+// finiteOrZero replaces the NaN and ±Inf ratios of crossed books (a long box paid for, cost + fees <= 0) with 0, so
+// they can be sorted and encoded as JSON
+func finiteOrZero(value float64) float64 {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0
+	}
+
+	return value
+}
+
+func borrowRate(expiry int64, payoff float64, price float64, fees float64) float64 {
+	//annual rate at which receiving price - fees now and repaying payoff at expiry compounds
+	return findApy(expiry, payoff/(price-fees)-1) - 1
+}
+
+func directionSign(direction string) float64 {
+	if direction == BoxShort {
+		return -1
+	}
+
+	return 1
+}
+
+// strikeLegs orders the legs of a box by strike, long boxes buy the K1 call and K2 put, short boxes sell them
+func strikeLegs(direction string, callBid Order, callAsk Order, putBid Order, putAsk Order) (Order, Order, Order, Order) {
+	if direction == BoxShort {
+		return callBid, callAsk, putAsk, putBid
+	}
+
+	return callAsk, callBid, putBid, putAsk
+}
+
+// boxPrice returns the price, fees and net profit of one box taking the given levels, spot is the implied spot of the
+// top of the book so fees don't move with depth
+func boxPrice(direction string, payoff float64, spot float64, callBid Order, callAsk Order, putBid Order, putAsk Order) (float64, float64, float64) {
+	sign := directionSign(direction)
+	price := sign * (callAsk.Price - callBid.Price + putAsk.Price - putBid.Price)
+	k1Call, k2Call, k1Put, k2Put := strikeLegs(direction, callBid, callAsk, putBid, putAsk)
+	fees := boxFees(payoff, spot, k1Call, k2Call, k1Put, k2Put)
+
+	return price, fees, sign*(payoff-price) - fees
+}
+
+func boxDetected(direction string, expiry int64, payoff float64, price float64, fees float64, netProfit float64) bool {
+	if direction == BoxShort {
+		return price-fees > 0 && borrowRate(expiry, payoff, price, fees) < MaxBorrowRate
 	}
 
-	bestCallBids := []Order{{Price: -1}}
-	bestCallAsks := []Order{{Price: 100000000}}
-	bestPutBids := []Order{{Price: -1}}
-	bestPutAsks := []Order{{Price: 100000000}}
+	return netProfit > 0
+}
+
+var MaxQuoteAge = 30 * time.Second //levels received longer ago than this are excluded from box detection
+
+// isFresh reports whether a venue's levels can still be trusted. every message of an instrument restamps its whole
+// book, so a book ages from the last message of its instrument whether or not the connection is alive
+func isFresh(orders []Order) bool {
+	if len(orders) == 0 {
+		return false
+	}
 
-	for _, order := range strikeOrders2.CallBids {
-		if order[0].Price > bestCallBids[0].Price {
-			bestCallBids = order
+	return now().Sub(orders[0].Timestamp) <= MaxQuoteAge
+}
+
+func mergeBids(book map[string][]Order) ([]Order, bool) {
+	//merges the fresh levels of every exchange into one side sorted by price descending
+	var merged []Order
+	for _, orders := range book {
+		if isFresh(orders) {
+			merged = append(merged, orders...)
 		}
 	}
-	for _, order := range strikeOrders1.CallAsks {
-		if order[0].Price < bestCallAsks[0].Price {
-			bestCallAsks = order
+	sort.SliceStable(merged, func(i, j int) bool {
+		if merged[i].Price == merged[j].Price { //map order would flip the best venue between recomputations
+			return merged[i].Exchange < merged[j].Exchange
+		}
+		return merged[i].Price > merged[j].Price
+	})
+
+	return merged, len(merged) > 0
+}
+
+func mergeAsks(book map[string][]Order) ([]Order, bool) {
+	//merges the fresh levels of every exchange into one side sorted by price ascending
+	var merged []Order
+	for _, orders := range book {
+		if isFresh(orders) {
+			merged = append(merged, orders...)
 		}
 	}
-	for _, order := range strikeOrders1.PutBids {
-		if order[0].Price > bestPutBids[0].Price {
-			bestPutBids = order
+	sort.SliceStable(merged, func(i, j int) bool {
+		if merged[i].Price == merged[j].Price {
+			return merged[i].Exchange < merged[j].Exchange
 		}
+		return merged[i].Price < merged[j].Price
+	})
+
+	return merged, len(merged) > 0
+}
+
+func walkBox(direction string, expiry int64, payoff float64, spot float64, limit float64, callBids []Order, callAsks []Order, putBids []Order, putAsks []Order) (float64, float64, float64) {
+	//consumes the levels of all four legs together, one box per unit of size, for as long as the marginal box is still detected net of fees
+	//and at most limit boxes (math.Inf(1) for the whole depth). returns executable size, vwap price per box and total net profit
+
+	legs := [4][]Order{callBids, callAsks, putBids, putAsks}
+	var idx [4]int
+	var remaining [4]float64
+	for i, leg := range legs {
+		remaining[i] = leg[0].Amount
 	}
-	for _, order := range strikeOrders2.PutAsks {
-		if order[0].Price < bestPutAsks[0].Price {
-			bestPutAsks = order
+
+	size := 0.0
+	totalPrice := 0.0
+	totalProfit := 0.0
+	for {
+		callBid, callAsk, putBid, putAsk := callBids[idx[0]], callAsks[idx[1]], putBids[idx[2]], putAsks[idx[3]]
+		marginalPrice, marginalFees, marginalProfit := boxPrice(direction, payoff, spot, callBid, callAsk, putBid, putAsk)
+		if !boxDetected(direction, expiry, payoff, marginalPrice, marginalFees, marginalProfit) {
+			break
 		}
+
+		step := math.Min(math.Min(remaining[0], remaining[1]), math.Min(remaining[2], remaining[3]))
+		step = math.Min(step, limit-size)
+		size += step
+		totalPrice += step * marginalPrice
+		totalProfit += step * marginalProfit
+
+		if size >= limit {
+			break
+		}
+
+		exhausted := false
+		for i := range legs {
+			remaining[i] -= step
+			if remaining[i] > 0 {
+				continue
+			}
+			idx[i]++
+			if idx[i] >= len(legs[i]) {
+				exhausted = true
+				break
+			}
+			remaining[i] = legs[i][idx[i]].Amount
+		}
+		if exhausted {
+			break
+		}
+	}
+
+	if size <= 0 {
+		return 0, 0, 0
+	}
+
+	return size, totalPrice / size, totalProfit
+}
+
+// updateBox recomputes the long and short box of K1 = strikeOrders1.Strike, K2 = strikeOrders2.Strike and removes them
+// from BoxContainer when their quotes are gone or stale or they are no longer detected
+func updateBox(chain ChainKey, strikeOrders1 *Orders, strikeOrders2 *Orders) {
+	updateBoxDirection(chain, BoxLong, strikeOrders1, strikeOrders2)
+	updateBoxDirection(chain, BoxShort, strikeOrders1, strikeOrders2)
+}
+
+func updateBoxDirection(chain ChainKey, direction string, strikeOrders1 *Orders, strikeOrders2 *Orders) {
+	key := BoxKey{chain.Asset, chain.Expiry, strikeOrders1.Strike, strikeOrders2.Strike, direction}
+	if chain.Expiry <= now().Unix() { //settled, books of expired chains are evicted by updateBoxes
+		removeBox(key)
+		return
+	}
+
+	sold, bought := strikeOrders2, strikeOrders1 //strikes of the sold call and bought call
+	if direction == BoxShort {
+		sold, bought = strikeOrders1, strikeOrders2
+	}
+	bestCallBids, callBidsOk := mergeBids(sold.CallBids)
+	bestCallAsks, callAsksOk := mergeAsks(bought.CallAsks)
+	bestPutBids, putBidsOk := mergeBids(bought.PutBids)
+	bestPutAsks, putAsksOk := mergeAsks(sold.PutAsks)
+	if !callBidsOk || !callAsksOk || !putBidsOk || !putAsksOk {
+		removeBox(key)
+		return
 	}
 
 	amount := bestCallBids[0].Amount
@@ -82,41 +252,145 @@ func updateBox(expiry int64, strikeOrders1 *Orders, strikeOrders2 *Orders) {
 		}
 	}
 
-	cost := bestCallAsks[0].Price - bestCallBids[0].Price + bestPutAsks[0].Price - bestPutBids[0].Price
 	payoff := strikeOrders2.Strike - strikeOrders1.Strike
 
-	if payoff-cost > 0 {
-		key := BoxKey{expiry, strikeOrders1.Strike, strikeOrders2.Strike}
-		profit := payoff - cost
-		relProfit := profit / cost
-		apy := findApy(expiry, relProfit)
+	k1Call, _, k1Put, _ := strikeLegs(direction, bestCallBids[0], bestCallAsks[0], bestPutBids[0], bestPutAsks[0])
+	spot := impliedSpot(strikeOrders1.Strike, k1Call.Price, k1Put.Price)
+	cost, fees, netProfit := boxPrice(direction, payoff, spot, bestCallBids[0], bestCallAsks[0], bestPutBids[0], bestPutAsks[0])
+
+	if !boxDetected(direction, chain.Expiry, payoff, cost, fees, netProfit) {
+		removeBox(key)
+		return
+	}
+
+	profit := netProfit + fees
+	relProfit := netProfit / (cost + fees)
+	rate := 0.0
+	if direction == BoxShort {
+		relProfit = netProfit / (cost - fees)
+		rate = borrowRate(chain.Expiry, payoff, cost, fees)
+	}
+	relProfit = finiteOrZero(relProfit)
+	rate = finiteOrZero(rate)
+	apy := finiteOrZero(findApy(chain.Expiry, relProfit))
+	maxSize, vwapCost, totalProfit := walkBox(direction, chain.Expiry, payoff, spot, math.Inf(1), bestCallBids, bestCallAsks, bestPutBids, bestPutAsks)
+
+	setBox(&Box{
+		Key:           key,
+		ShortCallBids: bestCallBids,
+		LongCallAsks:  bestCallAsks,
+		ShortPutBids:  bestPutBids,
+		LongPutAsks:   bestPutAsks,
+		Payoff:        payoff,
+		Cost:          cost,
+		Amount:        amount,
+		Profit:        profit,
+		Fees:          fees,
+		NetProfit:     netProfit,
+		RelProfit:     relProfit,
+		Apy:           apy,
+		BorrowRate:    rate,
+		MaxSize:       maxSize,
+		VwapCost:      vwapCost,
+		TotalProfit:   totalProfit,
+	})
+}
+
+// setBox and removeBox are the only writers of BoxContainer.Boxes, callers hold BoxContainer.Mu
+// changes are published to stream clients through BoxStream and recorded in BoxHistory
+
+func setBox(box *Box) {
+	old, exists := BoxContainer.Boxes[box.Key]
+	BoxContainer.Boxes[box.Key] = box
+
+	if !exists {
+		BoxHistory.Record(box.Key, boxHistoryPoint(box))
+		BoxStream.Publish(BoxAdded, box)
+	} else if boxChanged(old, box) {
+		BoxHistory.Record(box.Key, boxHistoryPoint(box))
+		BoxStream.Publish(BoxUpdated, box)
+	}
+}
+
+func removeBox(key BoxKey) {
+	old, exists := BoxContainer.Boxes[key]
+	if !exists {
+		return
+	}
+	delete(BoxContainer.Boxes, key)
+
+	BoxHistory.Record(key, historyPoint{Time: now()})
+	BoxStream.Publish(BoxRemoved, old)
+}
 
-		BoxContainer.Boxes[key] = &Box{
-			ShortCallBids: bestCallBids,
-			LongCallAsks:  bestCallAsks,
-			ShortPutBids:  bestPutBids,
-			LongPutAsks:   bestPutAsks,
-			Payoff:        payoff,
-			Cost:          cost,
-			Amount:        amount,
-			Profit:        profit,
-			RelProfit:     relProfit,
-			Apy:           apy,
+func boxChanged(old *Box, box *Box) bool {
+	//ignores receive timestamps, so re-sent identical quotes don't produce updates
+	legsOld := [][]Order{old.ShortCallBids, old.LongCallAsks, old.ShortPutBids, old.LongPutAsks}
+	legsNew := [][]Order{box.ShortCallBids, box.LongCallAsks, box.ShortPutBids, box.LongPutAsks}
+	for i := range legsOld {
+		if len(legsOld[i]) != len(legsNew[i]) {
+			return true
+		}
+		for k := range legsOld[i] {
+			a, b := legsOld[i][k], legsNew[i][k]
+			if a.Price != b.Price || a.Amount != b.Amount || a.Exchange != b.Exchange {
+				return true
+			}
 		}
 	}
+
+	return old.Fees != box.Fees || old.Apy != box.Apy || old.MaxSize != box.MaxSize
 }
 
 func updateBoxes() {
 	BoxContainer.Mu.Lock()
 	defer BoxContainer.Mu.Unlock()
 
-	for expiry, item := range Orderbooks {
+	expired := Orderbooks.EvictExpired(now())
+	for key := range BoxContainer.Boxes {
+		if expired[ChainKey{key.Asset, key.Expiry}] || key.Expiry <= now().Unix() {
+			removeBox(key)
+		}
+	}
+
+	for chain, item := range Orderbooks.Snapshot() {
 		if len(item) < 2 {
 			continue
 		}
 		for i := 0; i < len(item)-1; i++ {
 			for k := i + 1; k < len(item); k++ {
-				updateBox(expiry, item[i], item[k])
+				updateBox(chain, item[i], item[k])
+			}
+		}
+	}
+
+	BoxHistory.Prune()
+}
+
+func updateChangedBoxes(changed map[ChainKey]map[float64]bool) {
+	//only recomputes the strike pairs that involve a strike whose orderbook changed
+
+	BoxContainer.Mu.Lock()
+	defer BoxContainer.Mu.Unlock()
+
+	for chain, strikes := range changed {
+		item := Orderbooks.Chain(chain)
+		if len(item) < 2 {
+			continue
+		}
+		for i := range item {
+			if !strikes[item[i].Strike] {
+				continue
+			}
+			for k := range item {
+				if k == i || (k < i && strikes[item[k].Strike]) { //pair already recomputed from item[k]
+					continue
+				}
+				if k < i {
+					updateBox(chain, item[k], item[i])
+				} else {
+					updateBox(chain, item[i], item[k])
+				}
 			}
 		}
 	}
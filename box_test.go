@@ -0,0 +1,258 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestIsFresh(t *testing.T) {
+	tests := []struct {
+		age  time.Duration
+		want bool
+	}{
+		{0, true},
+		{MaxQuoteAge / 2, true},
+		{MaxQuoteAge - time.Second, true},
+		{MaxQuoteAge + time.Millisecond, false},
+		{2 * MaxQuoteAge, false},
+	}
+	for _, test := range tests {
+		orders := []Order{{Price: 10, Amount: 1, Exchange: "aevo", Timestamp: now().Add(-test.age)}}
+		if got := isFresh(orders); got != test.want {
+			t.Errorf("received %v ago: got fresh %v, want %v", test.age, got, test.want)
+		}
+	}
+
+	if isFresh(nil) {
+		t.Errorf("an empty side is fresh")
+	}
+}
+
+func TestDispatchFrameRestampsBook(t *testing.T) {
+	resetState(t)
+
+	//a delta of one level restamps every level of the instrument, the book ages from its last message
+	a := &Aevo{}
+	updates := make(chan *BookUpdate, 2)
+	snapshot := time.Unix(1700000000, 0)
+	delta := snapshot.Add(time.Minute)
+	dispatchFrame(a, []byte(`{"channel":"orderbook:ETH-31DEC27-2000-C","data":{"type":"snapshot","instrument_name":"ETH-31DEC27-2000-C","bids":[["250","4","0.5"],["249","2","0.5"]],"asks":[],"last_updated":"1"}}`), snapshot, updates)
+	dispatchFrame(a, []byte(`{"channel":"orderbook:ETH-31DEC27-2000-C","data":{"type":"update","instrument_name":"ETH-31DEC27-2000-C","bids":[["249","3","0.5"]],"asks":[],"last_updated":"2"}}`), delta, updates)
+
+	<-updates
+	update := <-updates
+	if len(update.Bids) != 2 {
+		t.Fatalf("got bids %+v, want both levels", update.Bids)
+	}
+	for _, bid := range update.Bids {
+		if !bid.Timestamp.Equal(delta) {
+			t.Errorf("level %v: got receive time %v, want the delta's %v", bid.Price, bid.Timestamp, delta)
+		}
+	}
+
+	//a subscribe ack carries no book and refreshes nothing
+	dispatchFrame(a, []byte(`{"id":1,"data":["orderbook:ETH-31DEC27-2000-C"]}`), delta.Add(time.Minute), updates)
+	if len(updates) != 0 {
+		t.Errorf("subscribe ack produced an update")
+	}
+}
+
+func TestWalkBox(t *testing.T) {
+	//long 2000/2100 boxes, levels on "x" are fee free so only the walk decides the result
+	level := func(venue string, price float64, amount float64) Order {
+		return Order{Price: price, Amount: amount, Exchange: venue}
+	}
+	levels := func(venue string, priceAmounts ...float64) []Order {
+		var orders []Order
+		for i := 0; i < len(priceAmounts); i += 2 {
+			orders = append(orders, level(venue, priceAmounts[i], priceAmounts[i+1]))
+		}
+		return orders
+	}
+	tests := []struct {
+		name                                 string
+		limit                                float64
+		callBids, callAsks, putBids, putAsks []Order
+		size, price, profit                  float64
+	}{
+		{"size limit across levels", 4,
+			levels("x", 250, 2, 249, 2), levels("x", 330, 3, 331, 5), levels("x", 150, 5), levels("x", 160, 5),
+			4, 90.75, 37},
+		{"whole depth ends with the shallowest leg", math.Inf(1),
+			levels("x", 250, 1, 248, 4), levels("x", 330, 5), levels("x", 150, 2), levels("x", 160, 5),
+			2, 91, 18},
+		{"stops at the first unprofitable level", math.Inf(1),
+			levels("x", 250, 1, 230, 5), levels("x", 330, 5), levels("x", 150, 5), levels("x", 160, 5),
+			1, 90, 10},
+		{"limit inside the top level", 0.5,
+			levels("x", 250, 2), levels("x", 330, 3), levels("x", 150, 5), levels("x", 160, 5),
+			0.5, 90, 5},
+		{"top of book not profitable", math.Inf(1),
+			levels("x", 250, 1), levels("x", 341, 5), levels("x", 150, 5), levels("x", 160, 5),
+			0, 0, 0},
+		//aevo charges 4 * 1.5 taking and 2 * 0.45 settling per box at spot 3000, the second level is only profitable gross
+		{"fees stop the walk", math.Inf(1),
+			levels("aevo", 250, 1, 246, 5), levels("aevo", 330, 5), levels("aevo", 150, 5), levels("aevo", 160, 5),
+			1, 90, 3.1},
+	}
+	for _, test := range tests {
+		size, price, profit := walkBox(BoxLong, 0, 100, 3000, test.limit, test.callBids, test.callAsks, test.putBids, test.putAsks)
+		if !almostEqual(size, test.size) || !almostEqual(price, test.price) || !almostEqual(profit, test.profit) {
+			t.Errorf("%v: got size %v price %v profit %v, want %v %v %v", test.name, size, price, profit, test.size, test.price, test.profit)
+		}
+	}
+}
+
+func TestBorrowRate(t *testing.T) {
+	defer func(previous func() time.Time) { now = previous }(now)
+	start := time.Date(2026, 10, 1, SettlementHour, 0, 0, 0, time.UTC)
+	now = func() time.Time { return start }
+
+	year := start.AddDate(0, 0, 365).Unix() - 1 //365 days, the rate is the simple return
+	tests := []struct {
+		name   string
+		expiry int64
+		price  float64
+		fees   float64
+		want   float64
+	}{
+		{"paid to borrow", year, 105, 0, 100.0/105 - 1},
+		{"fees eat the discount", year, 104, 4, 0},
+		{"borrowing costs", year, 95, 0, 100.0/95 - 1},
+		{"compounded over 73 days", start.AddDate(0, 0, 73).Unix() - 1, 101, 0, -0.04853431239325123},
+		{"compounded with fees", start.AddDate(0, 0, 73).Unix() - 1, 99, 1, 0.10629161707544865},
+	}
+	for _, test := range tests {
+		if got := borrowRate(test.expiry, 100, test.price, test.fees); math.Abs(got-test.want) > 1e-12 {
+			t.Errorf("%v: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestBoxDetectedShort(t *testing.T) {
+	defer func(previous func() time.Time, rate float64) { now, MaxBorrowRate = previous, rate }(now, MaxBorrowRate)
+	start := time.Date(2026, 10, 1, SettlementHour, 0, 0, 0, time.UTC)
+	now = func() time.Time { return start }
+	year := start.AddDate(0, 0, 365).Unix() - 1
+
+	tests := []struct {
+		name          string
+		maxBorrowRate float64
+		price, fees   float64
+		want          bool
+	}{
+		{"sold above payoff net of fees", 0, 105, 1, true},
+		{"fees push the rate above zero", 0, 101, 2, false},
+		{"borrowing at a positive rate below the max", 0.05, 99, 1, true},
+		{"rate above the max", 0.01, 99, 1, false},
+		{"fees exceed the proceeds", 10, 1, 2, false},
+		{"nothing received", 10, 0, 0, false},
+	}
+	for _, test := range tests {
+		MaxBorrowRate = test.maxBorrowRate
+		netProfit := test.price - 100 - test.fees
+		if got := boxDetected(BoxShort, year, 100, test.price, test.fees, netProfit); got != test.want {
+			t.Errorf("%v: got detected %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestUpdateBoxShort(t *testing.T) {
+	defer func(previous func() time.Time) { now = previous }(now)
+	start := time.Date(2026, 10, 1, SettlementHour, 0, 0, 0, time.UTC)
+	now = func() time.Time { return start }
+	resetState(t)
+
+	//selling the 2000 call and 2100 put and buying the 2100 call and 2000 put receives 340 - 245 + 170 - 155 = 110 for a
+	//payoff of 100, on a fee free venue
+	chain := ChainKey{"ETH", start.AddDate(0, 0, 365).Unix() - 1}
+	quote := func(strike float64, optionType string, bid float64, ask float64) {
+		instrument := Instrument{Asset: chain.Asset, Expiry: chain.Expiry, Strike: strike, Type: optionType, Venue: "x"}
+		var bids, asks []Order
+		if bid > 0 {
+			bids = []Order{{Asset: "ETH", Price: bid, Amount: 2, Strike: strike, OptionType: optionType, Exchange: "x", Timestamp: start}}
+		}
+		if ask > 0 {
+			asks = []Order{{Asset: "ETH", Price: ask, Amount: 3, Strike: strike, OptionType: optionType, Exchange: "x", Timestamp: start}}
+		}
+		Orderbooks.Update(instrument, bids, asks)
+	}
+	quote(2000, Call, 340, 0)
+	quote(2100, Call, 0, 245)
+	quote(2100, Put, 170, 0)
+	quote(2000, Put, 0, 155)
+	updateBoxes()
+
+	if _, ok := BoxContainer.Boxes[BoxKey{chain.Asset, chain.Expiry, 2000, 2100, BoxLong}]; ok {
+		t.Errorf("long box detected without the asks it buys")
+	}
+	box, ok := BoxContainer.Boxes[BoxKey{chain.Asset, chain.Expiry, 2000, 2100, BoxShort}]
+	if !ok {
+		t.Fatal("short box not detected")
+	}
+	if box.ShortCallBids[0].Strike != 2000 || box.LongCallAsks[0].Strike != 2100 || box.ShortPutBids[0].Strike != 2100 || box.LongPutAsks[0].Strike != 2000 {
+		t.Errorf("got legs at %v %v %v %v, want the 2000 call and 2100 put sold", box.ShortCallBids[0].Strike, box.LongCallAsks[0].Strike,
+			box.ShortPutBids[0].Strike, box.LongPutAsks[0].Strike)
+	}
+	if !almostEqual(box.Cost, 110) || !almostEqual(box.NetProfit, 10) || !almostEqual(box.MaxSize, 2) || !almostEqual(box.TotalProfit, 20) {
+		t.Errorf("got cost %v net profit %v max size %v total profit %v, want 110 10 2 20", box.Cost, box.NetProfit, box.MaxSize, box.TotalProfit)
+	}
+	if !almostEqual(box.BorrowRate, 100.0/110-1) {
+		t.Errorf("got borrow rate %v, want %v", box.BorrowRate, 100.0/110-1)
+	}
+}
+
+// syntheticChain fills Orderbooks with a 200 strike chain quoted on two venues, returns the chain and its strikes
+func syntheticChain(b *testing.B) (ChainKey, []float64) {
+	b.Helper()
+
+	chain := ChainKey{"ETH", now().Add(90 * 24 * time.Hour).Unix()}
+	strikes := make([]float64, 200)
+	for i := range strikes {
+		strikes[i] = float64(1000 + 25*i)
+	}
+
+	received := now()
+	spot := 3000.0
+	for _, strike := range strikes {
+		for v, venue := range []string{"aevo", "deribit"} {
+			for _, optionType := range []string{Call, Put} {
+				value := math.Max(spot-strike, 0)
+				if optionType == Put {
+					value = math.Max(strike-spot, 0)
+				}
+				value += 50 + float64(v) //time value, venues slightly apart
+				instrument := Instrument{Asset: chain.Asset, Expiry: chain.Expiry, Strike: strike, Type: optionType, Venue: venue}
+				bids := []Order{{Asset: chain.Asset, Price: value - 1, Amount: 5, Strike: strike, OptionType: optionType, Exchange: venue, Timestamp: received}}
+				asks := []Order{{Asset: chain.Asset, Price: value + 1, Amount: 5, Strike: strike, OptionType: optionType, Exchange: venue, Timestamp: received}}
+				Orderbooks.Update(instrument, bids, asks)
+			}
+		}
+	}
+
+	return chain, strikes
+}
+
+// full recomputation of every strike pair, what updateBoxes did after every frame before updateChangedBoxes
+func BenchmarkUpdateBoxes200Strikes(b *testing.B) {
+	resetState(b)
+	syntheticChain(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		updateBoxes()
+	}
+}
+
+// recomputation of the pairs of one changed strike
+func BenchmarkUpdateChangedBoxes200Strikes(b *testing.B) {
+	resetState(b)
+	chain, strikes := syntheticChain(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		changed := map[ChainKey]map[float64]bool{chain: {strikes[i%len(strikes)]: true}}
+		updateChangedBoxes(changed)
+	}
+}
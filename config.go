@@ -0,0 +1,431 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Config is read from a JSON file (-config) and then overridden by any flags set on the command line
+type Config struct {
+	Exchanges       []string               `json:"exchanges"`
+	Assets          []string               `json:"assets"`
+	Endpoints       map[string]Endpoint    `json:"endpoints"` //exchange: endpoint overrides, e.g. local stand-ins
+	Listen          string                 `json:"listen"`
+	RefreshInterval Duration               `json:"refresh_interval"` //instrument list refresh and resubscription
+	BatchSize       int                    `json:"batch_size"`       //instruments per subscribe message
+	BoxInterval     Duration               `json:"box_interval"`
+	SweepInterval   Duration               `json:"sweep_interval"`
+	MaxQuoteAge     Duration               `json:"max_quote_age"`
+	MaxBorrowRate   float64                `json:"max_borrow_rate"`     //annual, short boxes below this rate are detected
+	Fees            map[string]FeeSchedule `json:"fees"`                //exchange: schedule, replaces the default schedule of that exchange
+	Record          string                 `json:"record"`              //gzip JSONL file every raw frame is appended to
+	Replay          string                 `json:"replay"`              //recording to replay instead of connecting to the exchanges
+	ReplaySpeed     float64                `json:"replay_speed"`        //1 is real time, 0 replays without waiting
+	PaperLatency    Duration               `json:"paper_latency"`       //delay before paper trade legs hit the books
+	PaperFillRatio  float64                `json:"paper_fill_ratio"`    //fraction of each level a paper order fills
+	LegRetries      int                    `json:"leg_retries"`         //retries of a partially filled leg before unwinding
+	LegTolerance    float64                `json:"leg_price_tolerance"` //fraction a retry or unwind may move the limit
+	AevoExecution   AevoExecution          `json:"aevo_execution"`
+}
+
+// live order execution on aevo, the secrets can also be set with the environment variables AEVO_API_KEY,
+// AEVO_API_SECRET, AEVO_SIGNING_KEY and AEVO_EXECUTION_TOKEN instead of in the config file. the live endpoints are
+// never served unauthenticated on the public listener: they are served on Listen, which must be a loopback address,
+// and/or require AuthToken as a bearer token
+type AevoExecution struct {
+	Enabled     bool     `json:"enabled"`
+	ApiKey      string   `json:"api_key"`
+	ApiSecret   string   `json:"api_secret"`
+	SigningKey  string   `json:"signing_key"`  //hex private key of the signing key registered for the account
+	Account     string   `json:"account"`      //address of the aevo account, the maker of every order
+	ChainId     int64    `json:"chain_id"`     //1 for mainnet, 11155111 for testnet
+	FillTimeout Duration `json:"fill_timeout"` //how long acknowledged fills are waited for on the private websocket
+	Listen      string   `json:"listen"`       //loopback address of a separate listener for /api/live/, e.g. 127.0.0.1:8082
+	AuthToken   string   `json:"auth_token"`   //bearer token required by /api/live/, at least MinAuthTokenLength characters
+}
+
+const MinAuthTokenLength = 32
+
+type Endpoint struct {
+	Http string `json:"http"`
+	Wss  string `json:"wss"`
+}
+
+// time.Duration that unmarshals from strings like "10m" or "250ms"
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var str string
+	err := json.Unmarshal(data, &str)
+	if err != nil {
+		return fmt.Errorf("duration must be a string like \"10m\": %s", data)
+	}
+
+	d.Duration, err = time.ParseDuration(str)
+	return err
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+var assetRegexp = regexp.MustCompile(`^[A-Z0-9]+$`)
+
+func defaultConfig() Config {
+	return Config{
+		Exchanges:       []string{"aevo", "deribit"},
+		Assets:          []string{"ETH"},
+		Endpoints:       make(map[string]Endpoint),
+		Listen:          ":8081",
+		RefreshInterval: Duration{10 * time.Minute},
+		BatchSize:       20,
+		BoxInterval:     Duration{250 * time.Millisecond},
+		SweepInterval:   Duration{5 * time.Second},
+		MaxQuoteAge:     Duration{30 * time.Second},
+		Fees:            make(map[string]FeeSchedule),
+		ReplaySpeed:     1,
+		PaperLatency:    Duration{200 * time.Millisecond},
+		PaperFillRatio:  1,
+		LegRetries:      2,
+		LegTolerance:    0.01,
+		AevoExecution:   AevoExecution{ChainId: 1, FillTimeout: Duration{5 * time.Second}},
+	}
+}
+
+func loadConfigFile(path string, cfg *Config) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("loadConfigFile: %v", err)
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(cfg)
+	if err != nil {
+		return fmt.Errorf("loadConfigFile: %v: %v", path, err)
+	}
+
+	return nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// parseConfig builds the config from defaults, the -config file and then flags, and validates it
+func parseConfig(args []string) (Config, error) {
+	cfg := defaultConfig()
+
+	fs := flag.NewFlagSet("box-spread-ws", flag.ContinueOnError)
+	configPath := fs.String("config", "", "path to JSON config file")
+	exchanges := fs.String("exchanges", "", "comma separated exchanges to enable (registered: "+strings.Join(exchangeNames(), ", ")+")")
+	assets := fs.String("assets", "", "comma separated underlying assets, e.g. ETH,BTC")
+	listen := fs.String("listen", "", "HTTP listen address")
+	refresh := fs.Duration("refresh", 0, "instrument refresh interval")
+	batch := fs.Int("batch", 0, "instruments per subscribe message")
+	boxInterval := fs.Duration("box-interval", 0, "minimum time between box recomputations")
+	sweepInterval := fs.Duration("sweep-interval", 0, "time between full box recomputations")
+	maxQuoteAge := fs.Duration("max-quote-age", 0, "levels received longer ago than this are excluded from box detection")
+	maxBorrowRate := fs.Float64("max-borrow-rate", 0, "short boxes with an implied annual borrow rate below this are detected, e.g. 0.03")
+	record := fs.String("record", "", "append every raw websocket frame to this gzip JSONL file")
+	replay := fs.String("replay", "", "replay a recording made with -record instead of connecting to the exchanges")
+	replaySpeed := fs.Float64("replay-speed", 1, "replay speed, 1 is real time, 0 replays without waiting")
+	paperLatency := fs.Duration("paper-latency", 0, "simulated latency between submitting a paper trade and its legs filling")
+	paperFillRatio := fs.Float64("paper-fill-ratio", 1, "fraction of each level's amount a paper order fills, in (0, 1]")
+	legRetries := fs.Int("leg-retries", 2, "retries of a partially filled box leg before the filled legs are unwound")
+	legTolerance := fs.Float64("leg-price-tolerance", 0.01, "fraction of its limit a leg retry or unwind may pay above or receive below it, in [0, 1)")
+	aevoExecution := fs.Bool("aevo-execution", false, "enable live order execution on aevo, see aevo_execution in the config file")
+	endpoints := make(map[string]Endpoint)
+	fs.Func("endpoint", "exchange endpoint override as name=http_url,wss_url, may be repeated", func(value string) error {
+		name, urls, ok := strings.Cut(value, "=")
+		httpUrl, wssUrl, ok2 := strings.Cut(urls, ",")
+		if !ok || !ok2 {
+			return errors.New("expected name=http_url,wss_url")
+		}
+		endpoints[name] = Endpoint{Http: httpUrl, Wss: wssUrl}
+		return nil
+	})
+
+	err := fs.Parse(args)
+	if err != nil {
+		return cfg, err
+	}
+
+	if *configPath != "" {
+		err = loadConfigFile(*configPath, &cfg)
+		if err != nil {
+			return cfg, err
+		}
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "exchanges":
+			cfg.Exchanges = splitList(*exchanges)
+		case "assets":
+			cfg.Assets = splitList(*assets)
+		case "listen":
+			cfg.Listen = *listen
+		case "refresh":
+			cfg.RefreshInterval = Duration{*refresh}
+		case "batch":
+			cfg.BatchSize = *batch
+		case "box-interval":
+			cfg.BoxInterval = Duration{*boxInterval}
+		case "sweep-interval":
+			cfg.SweepInterval = Duration{*sweepInterval}
+		case "max-quote-age":
+			cfg.MaxQuoteAge = Duration{*maxQuoteAge}
+		case "max-borrow-rate":
+			cfg.MaxBorrowRate = *maxBorrowRate
+		case "record":
+			cfg.Record = *record
+		case "replay":
+			cfg.Replay = *replay
+		case "replay-speed":
+			cfg.ReplaySpeed = *replaySpeed
+		case "paper-latency":
+			cfg.PaperLatency = Duration{*paperLatency}
+		case "paper-fill-ratio":
+			cfg.PaperFillRatio = *paperFillRatio
+		case "leg-retries":
+			cfg.LegRetries = *legRetries
+		case "leg-price-tolerance":
+			cfg.LegTolerance = *legTolerance
+		case "aevo-execution":
+			cfg.AevoExecution.Enabled = *aevoExecution
+		}
+	})
+	if cfg.Endpoints == nil {
+		cfg.Endpoints = make(map[string]Endpoint)
+	}
+	for name, endpoint := range endpoints {
+		cfg.Endpoints[name] = endpoint
+	}
+	secrets := []struct {
+		env   string
+		value *string
+	}{
+		{"AEVO_API_KEY", &cfg.AevoExecution.ApiKey},
+		{"AEVO_API_SECRET", &cfg.AevoExecution.ApiSecret},
+		{"AEVO_SIGNING_KEY", &cfg.AevoExecution.SigningKey},
+		{"AEVO_EXECUTION_TOKEN", &cfg.AevoExecution.AuthToken},
+	}
+	for _, secret := range secrets {
+		if value := os.Getenv(secret.env); value != "" {
+			*secret.value = value
+		}
+	}
+
+	return cfg, cfg.validate()
+}
+
+func validUrl(rawUrl string, schemes ...string) bool {
+	parsed, err := url.Parse(rawUrl)
+	if err != nil || parsed.Host == "" {
+		return false
+	}
+	for _, scheme := range schemes {
+		if parsed.Scheme == scheme {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (cfg *Config) validate() error {
+	var errs []error
+
+	if len(cfg.Exchanges) == 0 {
+		errs = append(errs, errors.New("exchanges: at least one exchange must be enabled"))
+	}
+	seenExchanges := make(map[string]bool)
+	for _, name := range cfg.Exchanges {
+		if _, err := getExchange(name); err != nil {
+			errs = append(errs, fmt.Errorf("exchanges: %v", err))
+		}
+		if seenExchanges[name] {
+			errs = append(errs, fmt.Errorf("exchanges: %v is listed more than once", name))
+		}
+		seenExchanges[name] = true
+	}
+
+	if len(cfg.Assets) == 0 {
+		errs = append(errs, errors.New("assets: at least one asset must be set"))
+	}
+	seenAssets := make(map[string]bool)
+	for _, asset := range cfg.Assets {
+		if !assetRegexp.MatchString(asset) {
+			errs = append(errs, fmt.Errorf("assets: %q must be uppercase letters and digits, e.g. ETH", asset))
+		}
+		if seenAssets[asset] {
+			errs = append(errs, fmt.Errorf("assets: %v is listed more than once", asset))
+		}
+		seenAssets[asset] = true
+	}
+
+	for name, endpoint := range cfg.Endpoints {
+		if _, err := getExchange(name); err != nil {
+			errs = append(errs, fmt.Errorf("endpoints: %v", err))
+		}
+		if endpoint.Http != "" && !validUrl(endpoint.Http, "http", "https") {
+			errs = append(errs, fmt.Errorf("endpoints: %v: invalid http url %q", name, endpoint.Http))
+		}
+		if endpoint.Wss != "" && !validUrl(endpoint.Wss, "ws", "wss") {
+			errs = append(errs, fmt.Errorf("endpoints: %v: invalid websocket url %q", name, endpoint.Wss))
+		}
+	}
+
+	if cfg.Listen == "" {
+		errs = append(errs, errors.New("listen: must not be empty"))
+	}
+	if cfg.BatchSize <= 0 {
+		errs = append(errs, fmt.Errorf("batch_size: must be positive, got %v", cfg.BatchSize))
+	}
+
+	durations := []struct {
+		name  string
+		value Duration
+	}{
+		{"refresh_interval", cfg.RefreshInterval},
+		{"box_interval", cfg.BoxInterval},
+		{"sweep_interval", cfg.SweepInterval},
+		{"max_quote_age", cfg.MaxQuoteAge},
+	}
+	for _, duration := range durations {
+		if duration.value.Duration <= 0 {
+			errs = append(errs, fmt.Errorf("%v: must be positive, got %v", duration.name, duration.value))
+		}
+	}
+
+	for name, schedule := range cfg.Fees {
+		if _, err := getExchange(name); err != nil {
+			errs = append(errs, fmt.Errorf("fees: %v", err))
+		}
+		if schedule.MakerRate < 0 || schedule.TakerRate < 0 || schedule.PerContract < 0 || schedule.PremiumCap < 0 || schedule.SettlementFee < 0 {
+			errs = append(errs, fmt.Errorf("fees: %v: fees must not be negative", name))
+		}
+	}
+
+	if !(cfg.MaxBorrowRate > -1) {
+		errs = append(errs, fmt.Errorf("max_borrow_rate: must be above -1, got %v", cfg.MaxBorrowRate))
+	}
+	if cfg.Record != "" && cfg.Replay != "" {
+		errs = append(errs, errors.New("record: can't record while replaying"))
+	}
+	if cfg.ReplaySpeed < 0 || math.IsNaN(cfg.ReplaySpeed) {
+		errs = append(errs, fmt.Errorf("replay_speed: must not be negative, got %v", cfg.ReplaySpeed))
+	}
+	if cfg.PaperLatency.Duration < 0 {
+		errs = append(errs, fmt.Errorf("paper_latency: must not be negative, got %v", cfg.PaperLatency))
+	}
+	if !(cfg.PaperFillRatio > 0 && cfg.PaperFillRatio <= 1) {
+		errs = append(errs, fmt.Errorf("paper_fill_ratio: must be in (0, 1], got %v", cfg.PaperFillRatio))
+	}
+	if cfg.LegRetries < 0 {
+		errs = append(errs, fmt.Errorf("leg_retries: must not be negative, got %v", cfg.LegRetries))
+	}
+	if !(cfg.LegTolerance >= 0 && cfg.LegTolerance < 1) {
+		errs = append(errs, fmt.Errorf("leg_price_tolerance: must be in [0, 1), got %v", cfg.LegTolerance))
+	}
+	if cfg.AevoExecution.Enabled {
+		errs = append(errs, cfg.AevoExecution.validate(cfg)...)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config:\n%w", errors.Join(errs...))
+	}
+
+	return nil
+}
+
+// apply sets the package level settings and exchange endpoints from the config
+func (cfg *Config) apply() {
+	BoxInterval = cfg.BoxInterval.Duration
+	SweepInterval = cfg.SweepInterval.Duration
+	MaxQuoteAge = cfg.MaxQuoteAge.Duration
+	MaxBorrowRate = cfg.MaxBorrowRate
+	PaperLatency = cfg.PaperLatency.Duration
+	PaperFillRatio = cfg.PaperFillRatio
+	LegRetries = cfg.LegRetries
+	LegPriceTolerance = cfg.LegTolerance
+
+	for name, schedule := range cfg.Fees {
+		FeeSchedules[name] = schedule
+	}
+
+	for name, endpoint := range cfg.Endpoints {
+		ex := ExchangeRegistry[name]
+		ex.SetEndpoints(endpoint.Http, endpoint.Wss)
+	}
+}
+
+func (exec *AevoExecution) validate(cfg *Config) []error {
+	var errs []error
+
+	aevoEnabled := false
+	for _, name := range cfg.Exchanges {
+		aevoEnabled = aevoEnabled || name == "aevo"
+	}
+	if !aevoEnabled {
+		errs = append(errs, errors.New("aevo_execution: aevo must be in exchanges, orders are priced from its books"))
+	}
+	if cfg.Replay != "" {
+		errs = append(errs, errors.New("aevo_execution: can't execute while replaying"))
+	}
+	if exec.ApiKey == "" || exec.ApiSecret == "" {
+		errs = append(errs, errors.New("aevo_execution: api_key and api_secret must be set"))
+	}
+	if _, err := newAevoSigner(exec.SigningKey); err != nil {
+		errs = append(errs, fmt.Errorf("aevo_execution: signing_key: %v", err))
+	}
+	if account, err := hex.DecodeString(strings.TrimPrefix(exec.Account, "0x")); err != nil || len(account) != 20 || !strings.HasPrefix(exec.Account, "0x") {
+		errs = append(errs, fmt.Errorf("aevo_execution: account must be a 0x prefixed address, got %q", exec.Account))
+	}
+	if exec.ChainId <= 0 {
+		errs = append(errs, fmt.Errorf("aevo_execution: chain_id must be positive, got %v", exec.ChainId))
+	}
+	if exec.FillTimeout.Duration <= 0 {
+		errs = append(errs, fmt.Errorf("aevo_execution: fill_timeout must be positive, got %v", exec.FillTimeout))
+	}
+	if exec.Listen == "" && exec.AuthToken == "" {
+		errs = append(errs, errors.New("aevo_execution: listen or auth_token must be set, live orders can't be accepted unauthenticated on the public listener"))
+	}
+	if exec.Listen != "" {
+		host, _, err := net.SplitHostPort(exec.Listen)
+		ip := net.ParseIP(host)
+		if err != nil || !(host == "localhost" || ip != nil && ip.IsLoopback()) {
+			errs = append(errs, fmt.Errorf("aevo_execution: listen must be a loopback address like 127.0.0.1:8082, got %q", exec.Listen))
+		}
+		if exec.Listen == cfg.Listen {
+			errs = append(errs, errors.New("aevo_execution: listen must differ from the public listen address"))
+		}
+	}
+	if exec.AuthToken != "" && len(exec.AuthToken) < MinAuthTokenLength {
+		errs = append(errs, fmt.Errorf("aevo_execution: auth_token must be at least %v characters", MinAuthTokenLength))
+	}
+
+	return errs
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConfigDuplicates(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string //substring of the error, empty for a valid config
+	}{
+		{[]string{"-exchanges", "aevo,deribit"}, ""},
+		{[]string{"-exchanges", "aevo,aevo"}, "exchanges: aevo is listed more than once"},
+		{[]string{"-exchanges", "aevo, deribit ,aevo"}, "exchanges: aevo is listed more than once"},
+		{[]string{"-assets", "ETH,BTC,ETH"}, "assets: ETH is listed more than once"},
+	}
+
+	for _, test := range tests {
+		_, err := parseConfig(test.args)
+		switch {
+		case test.want == "" && err != nil:
+			t.Errorf("%v: unexpected error %v", test.args, err)
+		case test.want != "" && (err == nil || !strings.Contains(err.Error(), test.want)):
+			t.Errorf("%v: got error %v, want %q", test.args, err, test.want)
+		}
+	}
+}
+
+func TestAevoExecutionListener(t *testing.T) {
+	token := strings.Repeat("t", MinAuthTokenLength)
+	tests := []struct {
+		listen    string
+		authToken string
+		want      string //substring of the error, empty for a valid config
+	}{
+		{"", "", "listen or auth_token must be set"},
+		{"", token, ""},
+		{"127.0.0.1:8082", "", ""},
+		{"localhost:8082", "", ""},
+		{"[::1]:8082", token, ""},
+		{"0.0.0.0:8082", "", "listen must be a loopback address"},
+		{":8082", "", "listen must be a loopback address"},
+		{"192.168.1.2:8082", token, "listen must be a loopback address"},
+		{"127.0.0.1", "", "listen must be a loopback address"},
+		{"127.0.0.1:8081", "", "listen must differ from the public listen address"},
+		{"", token[1:], "auth_token must be at least"},
+	}
+
+	for _, test := range tests {
+		cfg := defaultConfig()
+		cfg.Listen = "127.0.0.1:8081"
+		cfg.AevoExecution = AevoExecution{
+			Enabled:     true,
+			ApiKey:      "key",
+			ApiSecret:   "secret",
+			SigningKey:  testSigningKey,
+			Account:     testAccount,
+			ChainId:     1,
+			FillTimeout: Duration{time.Second},
+			Listen:      test.listen,
+			AuthToken:   test.authToken,
+		}
+		err := cfg.validate()
+		switch {
+		case test.want == "" && err != nil:
+			t.Errorf("%q %q: unexpected error %v", test.listen, test.authToken, err)
+		case test.want != "" && (err == nil || !strings.Contains(err.Error(), test.want)):
+			t.Errorf("%q %q: got error %v, want %q", test.listen, test.authToken, err, test.want)
+		}
+	}
+}
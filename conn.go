@@ -2,12 +2,20 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"math/rand"
+	"sync"
+	"time"
 
 	"nhooyr.io/websocket"
 )
 
+const MinBackoff = time.Second
+const MaxBackoff = time.Minute
+const PingInterval = 10 * time.Second
+
 type ConnData struct {
 	Ctx    context.Context
 	Conn   *websocket.Conn
@@ -19,16 +27,34 @@ type WssData struct {
 	Data []string `json:"data"`
 }
 
-func dialWss(url string) (context.Context, *websocket.Conn, context.CancelFunc) {
-	ctx, cancel := context.WithCancel(context.Background())
+// keeps one exchange connected: detects failed connections, redials with exponential backoff and jitter,
+// replays the last subscription set and marks the exchange's books stale while disconnected, they are cleared so
+// only levels from the new snapshots are shown after a reconnect
+type ConnSupervisor struct {
+	Ex              Exchange
+	Updates         chan<- *BookUpdate
+	Recorder        *Recorder //nil unless recording
+	Assets          []string
+	RefreshInterval time.Duration
+	BatchSize       int
+
+	mu          sync.Mutex
+	conn        *ConnData //nil while disconnected
+	instruments []string  //last subscription set
+}
+
+// dialWss connects to url, the connection's context is cancelled with parent
+func dialWss(parent context.Context, url string) (ConnData, error) {
+	ctx, cancel := context.WithCancel(parent)
 
 	c, res, err := websocket.Dial(ctx, url, nil)
 	if err != nil {
-		log.Fatalf("Dial error: %v", err)
+		cancel()
+		return ConnData{}, fmt.Errorf("Dial error: %v", err)
 	}
 	fmt.Printf("%v\n\n", res)
 
-	return ctx, c, cancel
+	return ConnData{ctx, c, cancel}, nil
 }
 
 func wssRead(ctx context.Context, c *websocket.Conn) ([]byte, error) {
@@ -37,23 +63,283 @@ func wssRead(ctx context.Context, c *websocket.Conn) ([]byte, error) {
 	return raw, err
 }
 
-func connInit(exchanges Exchanges) map[string]ConnData {
-	//initialises ws connections and starts reqLoops for selected exchanges
+func wssReqOrderbook(ex Exchange, instruments []string, batchSize int, ctx context.Context, c *websocket.Conn) error {
+	for i := 0; i < len(instruments); i += batchSize {
+		end := min(i+batchSize, len(instruments))
+		data := ex.OrderbookJson(instruments[i:end])
+
+		// fmt.Printf("subscribe: %v\n\n", string(data))
+		err := c.Write(ctx, 1, data)
+		if err != nil {
+			return fmt.Errorf("Write error: %v", err)
+		}
+
+		if end < len(instruments) && !sleepCtx(ctx, 100*time.Millisecond) {
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+func wssResubscribe(ex Exchange, instrument string, ctx context.Context, c *websocket.Conn) error {
+	//unsubscribes and subscribes again so the exchange sends a new snapshot of instrument
+
+	err := c.Write(ctx, 1, ex.UnsubscribeJson([]string{instrument}))
+	if err != nil {
+		return fmt.Errorf("Write error: %v", err)
+	}
+	err = c.Write(ctx, 1, ex.OrderbookJson([]string{instrument}))
+	if err != nil {
+		return fmt.Errorf("Write error: %v", err)
+	}
+
+	return nil
+}
+
+// dispatchFrame parses raw and pushes its orderbook update onto updates, a returned gap means the instrument has to be
+// resubscribed. the gapped instrument's levels are cleared with an empty update until its new snapshot arrives
+func dispatchFrame(ex Exchange, raw []byte, received time.Time, updates chan<- *BookUpdate) *SequenceGapError {
+	update, err := ex.ParseFrame(raw)
+	var gap *SequenceGapError
+	if errors.As(err, &gap) {
+		if instrument, err := parseInstrument(gap.Venue, gap.Instrument); err == nil { //parsed before the delta was applied
+			updates <- &BookUpdate{Instrument: instrument}
+		}
+		return gap
+	}
+	if err != nil {
+		log.Printf("wssReadLoop: %v: %v\n\n", ex.Name(), err)
+		return nil
+	}
+	if update == nil {
+		return nil
+	}
+
+	update.stamp(received)
+	updates <- update
+
+	return nil
+}
+
+func wssReadLoop(ex Exchange, ctx context.Context, c *websocket.Conn, updates chan<- *BookUpdate, recorder *Recorder) {
+	//reads ws responses and pushes the parsed orderbook updates onto updates until the connection fails
+
+	for {
+		raw, err := wssRead(ctx, c)
+		received := time.Now()
+		if err != nil {
+			log.Printf("wssReadLoop: %v: %v\n(response): %v\n\n", ex.Name(), err, string(raw))
+			return
+		}
+		if recorder != nil {
+			recorder.Record(ex.Name(), received, raw)
+		}
+
+		gap := dispatchFrame(ex, raw, received, updates)
+		if gap != nil {
+			log.Printf("wssReadLoop: %v, resubscribing\n\n", gap)
+			err = wssResubscribe(ex, gap.Instrument, ctx, c)
+			if err != nil {
+				log.Printf("wssReadLoop: %v: %v\n\n", ex.Name(), err)
+				return
+			}
+		}
+	}
+}
+
+// sleepCtx waits for d, it returns false without waiting it out when ctx is cancelled
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func jitter(d time.Duration) time.Duration {
+	//random duration in [d/2, d)
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func keepAlive(ctx context.Context, conn ConnData) {
+	//pings the connection and cancels it if the exchange stops answering, so a silently dropped connection is redialed
+
+	ticker := time.NewTicker(PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-conn.Ctx.Done():
+			return
+		case <-ticker.C:
+			pingCtx, cancel := context.WithTimeout(conn.Ctx, PingInterval/2)
+			err := conn.Conn.Ping(pingCtx)
+			cancel()
+			if err != nil {
+				log.Printf("keepAlive: ping error: %v\n\n", err)
+				conn.Cancel()
+				return
+			}
+		}
+	}
+}
+
+func (s *ConnSupervisor) Run(ctx context.Context) {
+	name := s.Ex.Name()
+	backoff := MinBackoff
+
+	for ctx.Err() == nil {
+		conn, err := dialWss(ctx, s.Ex.WssUrl())
+		if err != nil {
+			log.Printf("ConnSupervisor: %v: %v, retrying in ~%v\n\n", name, err, backoff)
+			if !sleepCtx(ctx, jitter(backoff)) {
+				return
+			}
+			backoff = min(backoff*2, MaxBackoff)
+			continue
+		}
+		connectedAt := time.Now()
+		log.Printf("ConnSupervisor: %v connected", name)
+
+		s.mu.Lock()
+		s.conn = &conn
+		instruments := s.instruments
+		s.mu.Unlock()
+
+		if len(instruments) > 0 {
+			err = wssReqOrderbook(s.Ex, instruments, s.BatchSize, conn.Ctx, conn.Conn)
+			if err != nil {
+				log.Printf("ConnSupervisor: %v resubscribe: %v\n\n", name, err)
+			} else {
+				log.Printf("Resubscribed %v Orderbooks", name)
+			}
+		}
+		// the books from before the disconnect were cleared, each instrument's levels come back with its snapshot
+		Orderbooks.SetStale(name, false)
+
+		go keepAlive(ctx, conn)
+		wssReadLoop(s.Ex, conn.Ctx, conn.Conn, s.Updates, s.Recorder)
+
+		Orderbooks.SetStale(name, true)
+		Orderbooks.ClearVenue(name, time.Now())
+		s.mu.Lock()
+		s.conn = nil
+		s.mu.Unlock()
+		conn.Cancel()
+		conn.Conn.CloseNow()
+
+		if time.Since(connectedAt) > MaxBackoff {
+			backoff = MinBackoff
+		}
+		log.Printf("ConnSupervisor: %v disconnected, redialing in ~%v\n\n", name, backoff)
+		if !sleepCtx(ctx, jitter(backoff)) {
+			return
+		}
+		backoff = min(backoff*2, MaxBackoff)
+	}
+}
+
+func (s *ConnSupervisor) ReqLoop(ctx context.Context) {
+	//refreshes the instrument list, subscribes on the current connection and stores it for resubscription after reconnects
 
-	connections := make(map[string]ConnData)
-	if exchanges.Aevo {
-		aevoCtx, aevoConn, aevoCancel := dialWss(AevoWss)
-		connections["aevo"] = ConnData{aevoCtx, aevoConn, aevoCancel}
+	name := s.Ex.Name()
+	for ctx.Err() == nil {
+		instruments, err := s.fetchInstruments()
+		if err != nil {
+			log.Printf("ReqLoop: %v instruments error: %v\n\n", name, err)
+			sleepCtx(ctx, time.Minute)
+			continue
+		}
+		fmt.Printf("%v number of instruments: %v\n\n", name, len(instruments))
 
-		go aevoWssReqLoop(aevoCtx, aevoConn)
+		s.mu.Lock()
+		s.instruments = instruments
+		conn := s.conn
+		s.mu.Unlock()
+
+		if conn != nil {
+			err = wssReqOrderbook(s.Ex, instruments, s.BatchSize, conn.Ctx, conn.Conn)
+			if err != nil {
+				log.Printf("ReqLoop: %v: %v\n\n", name, err)
+			} else {
+				log.Printf("Requested %v Orderbooks", name)
+			}
+		}
+
+		sleepCtx(ctx, s.RefreshInterval)
+	}
+}
+
+// fetchInstruments fetches the instruments of every asset concurrently, in the order of Assets
+func (s *ConnSupervisor) fetchInstruments() ([]string, error) {
+	results := make([][]string, len(s.Assets))
+	errs := make([]error, len(s.Assets))
+	var wg sync.WaitGroup
+	for i, asset := range s.Assets {
+		wg.Add(1)
+		go func(i int, asset string) {
+			defer wg.Done()
+			results[i], errs[i] = s.Ex.Instruments(asset)
+		}(i, asset)
 	}
+	wg.Wait()
+
+	var instruments []string
+	for i, assetInstruments := range results {
+		if errs[i] != nil {
+			return nil, fmt.Errorf("%v: %v", s.Assets[i], errs[i])
+		}
+		instruments = append(instruments, assetInstruments...)
+	}
+
+	return instruments, nil
+}
+
+// Status returns whether the exchange is connected and its current subscription set
+func (s *ConnSupervisor) Status() (bool, []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.conn != nil, append([]string(nil), s.instruments...)
+}
+
+func (s *ConnSupervisor) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn != nil {
+		s.conn.Conn.Close(websocket.StatusNormalClosure, "")
+		s.conn.Cancel()
+	}
+}
+
+func connInit(ctx context.Context, cfg Config, recorder *Recorder, updates chan<- *BookUpdate) []*ConnSupervisor {
+	//starts a supervised connection and reqLoop for each enabled exchange
 
-	if exchanges.Lyra {
-		lyraCtx, lyraConn, lyraCancel := dialWss(LyraWss)
-		connections["lyra"] = ConnData{lyraCtx, lyraConn, lyraCancel}
+	supervisors := make([]*ConnSupervisor, 0, len(cfg.Exchanges))
+	for _, name := range cfg.Exchanges {
+		ex := ExchangeRegistry[name]
+		supervisor := &ConnSupervisor{
+			Ex:              ex,
+			Updates:         updates,
+			Recorder:        recorder,
+			Assets:          cfg.Assets,
+			RefreshInterval: cfg.RefreshInterval.Duration,
+			BatchSize:       cfg.BatchSize,
+		}
+		supervisors = append(supervisors, supervisor)
+		Orderbooks.SetStale(ex.Name(), true)
 
-		go lyraWssReqLoop(lyraCtx, lyraConn)
+		go supervisor.Run(ctx)
+		go supervisor.ReqLoop(ctx)
 	}
 
-	return connections
+	return supervisors
 }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnSupervisorStopsOnCancel(t *testing.T) {
+	supervisor := &ConnSupervisor{
+		Ex:              &Aevo{Http: "http://127.0.0.1:1", Wss: "ws://127.0.0.1:1"}, //nothing listens, every dial fails
+		Updates:         make(chan *BookUpdate),
+		Assets:          []string{"ETH"},
+		RefreshInterval: time.Hour,
+		BatchSize:       20,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{}, 2)
+	go func() { supervisor.Run(ctx); stopped <- struct{}{} }()
+	go func() { supervisor.ReqLoop(ctx); stopped <- struct{}{} }()
+
+	time.Sleep(100 * time.Millisecond) //both are waiting out a backoff or retry by now
+	cancel()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-stopped:
+		case <-time.After(time.Second):
+			t.Fatal("Run and ReqLoop didn't return after ctx was cancelled")
+		}
+	}
+}
+
+// slowInstruments is an Exchange whose Instruments takes delay per call
+type slowInstruments struct {
+	Aevo
+	delay time.Duration
+}
+
+func (s *slowInstruments) Instruments(asset string) ([]string, error) {
+	time.Sleep(s.delay)
+	if asset == "BAD" {
+		return nil, errors.New("no such currency")
+	}
+
+	return []string{asset + "-31DEC27-2000-C", asset + "-31DEC27-2000-P"}, nil
+}
+
+func TestFetchInstrumentsConcurrent(t *testing.T) {
+	supervisor := &ConnSupervisor{Ex: &slowInstruments{delay: 200 * time.Millisecond}, Assets: []string{"ETH", "BTC", "SOL"}}
+
+	start := time.Now()
+	instruments, err := supervisor.fetchInstruments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed >= 400*time.Millisecond {
+		t.Errorf("took %v for 3 assets of 200ms each, assets weren't fetched concurrently", elapsed)
+	}
+	want := "ETH-31DEC27-2000-C,ETH-31DEC27-2000-P,BTC-31DEC27-2000-C,BTC-31DEC27-2000-P,SOL-31DEC27-2000-C,SOL-31DEC27-2000-P"
+	if strings.Join(instruments, ",") != want {
+		t.Errorf("got %v, want the instruments in the order of Assets", instruments)
+	}
+
+	supervisor.Assets = []string{"ETH", "BAD"}
+	if _, err := supervisor.fetchInstruments(); err == nil || !strings.Contains(err.Error(), "BAD") {
+		t.Errorf("got error %v, want the failed asset's error", err)
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const DeribitHttp string = "https://www.deribit.com/api/v2"
+const DeribitWss string = "wss://www.deribit.com/ws/api/v2"
+
+// deribit sends an initial snapshot and then incremental changes on book.{instrument}.100ms, so a local book is kept
+// per instrument and the full book is emitted after every change.
+// inverse option prices are quoted in the underlying, they are converted to USD using deribit_price_index.{asset}_usd.
+// linear options (SOL_USDC-...) are quoted in USDC and, like aevo's and lyra's, taken as USD without conversion
+type Deribit struct {
+	Http string
+	Wss  string
+
+	books       LocalBooks //in the underlying, converted on output
+	mu          sync.Mutex
+	indexPrices map[string]float64 //index name (eth_usd): price
+	reqId       int
+}
+
+type deribitMessage struct {
+	Id     int             `json:"id"`
+	Method string          `json:"method"`
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+	Params struct {
+		Channel string          `json:"channel"`
+		Data    json.RawMessage `json:"data"`
+	} `json:"params"`
+}
+
+type deribitBookData struct {
+	Type           string         `json:"type"`
+	InstrumentName string         `json:"instrument_name"`
+	ChangeId       int64          `json:"change_id"`
+	PrevChangeId   int64          `json:"prev_change_id"`
+	Bids           []deribitLevel `json:"bids"` //[[action, price, amount]...]
+	Asks           []deribitLevel `json:"asks"`
+}
+
+type deribitLevel struct {
+	Action string //new, change or delete
+	Price  float64
+	Amount float64
+}
+
+func (l *deribitLevel) UnmarshalJSON(data []byte) error {
+	var fields []json.RawMessage
+	err := json.Unmarshal(data, &fields)
+	if err != nil || len(fields) != 3 {
+		return fmt.Errorf("deribitLevel: expected [action, price, amount]: %s", data)
+	}
+
+	err1 := json.Unmarshal(fields[0], &l.Action)
+	err2 := json.Unmarshal(fields[1], &l.Price)
+	err3 := json.Unmarshal(fields[2], &l.Amount)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return fmt.Errorf("deribitLevel: expected [string, number, number]: %s", data)
+	}
+	if l.Action != "new" && l.Action != "change" && l.Action != "delete" {
+		return fmt.Errorf("deribitLevel: unknown action %q", l.Action)
+	}
+
+	return nil
+}
+
+type deribitIndexData struct {
+	IndexName string  `json:"index_name"`
+	Price     float64 `json:"price"`
+}
+
+func init() {
+	registerExchange(&Deribit{Http: DeribitHttp, Wss: DeribitWss})
+}
+
+func (d *Deribit) Name() string {
+	return "deribit"
+}
+
+func (d *Deribit) WssUrl() string {
+	return d.Wss
+}
+
+func (d *Deribit) SetEndpoints(httpUrl string, wssUrl string) {
+	if httpUrl != "" {
+		d.Http = httpUrl
+	}
+	if wssUrl != "" {
+		d.Wss = wssUrl
+	}
+}
+
+// Instruments returns the inverse options of asset or, for assets that only have linear options such as SOL and XRP,
+// its USDC settled ones
+func (d *Deribit) Instruments(asset string) ([]string, error) {
+	instruments, err := d.activeOptions(asset)
+	if err != nil || len(instruments) > 0 {
+		return instruments, err
+	}
+
+	usdcInstruments, err := d.activeOptions("USDC")
+	if err != nil {
+		return nil, err
+	}
+	for _, instrument := range usdcInstruments {
+		if strings.HasPrefix(instrument, asset+"_USDC-") {
+			instruments = append(instruments, instrument)
+		}
+	}
+
+	return instruments, nil
+}
+
+// activeOptions lists the active options settled in currency, deribit answers unknown currencies with an error and
+// no result
+func (d *Deribit) activeOptions(currency string) ([]string, error) {
+	url := d.Http + "/public/get_instruments?currency=" + currency + "&kind=option&expired=false"
+
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Add("accept", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("deribitInstruments: request error: %v", err)
+	}
+
+	defer res.Body.Close()
+
+	var markets struct {
+		Result []struct {
+			InstrumentName string `json:"instrument_name"`
+			IsActive       bool   `json:"is_active"`
+		} `json:"result"`
+	}
+
+	err = json.NewDecoder(res.Body).Decode(&markets)
+	if err != nil {
+		return nil, fmt.Errorf("deribitInstruments: json decode error: %v", err)
+	}
+
+	var instruments []string
+	for _, market := range markets.Result {
+		if market.IsActive {
+			instruments = append(instruments, market.InstrumentName)
+		}
+	}
+
+	return optionInstruments("deribit", instruments), nil
+}
+
+func (d *Deribit) OrderbookJson(instruments []string) []byte {
+	channels := []string{}
+	indexes := make(map[string]bool)
+	for _, instrument := range instruments {
+		channels = append(channels, "book."+instrument+".100ms")
+
+		indexName := deribitIndexName(instrument)
+		if indexName != "" && !indexes[indexName] {
+			indexes[indexName] = true
+			channels = append(channels, "deribit_price_index."+indexName)
+		}
+	}
+
+	return d.channelsJson("public/subscribe", channels)
+}
+
+func (d *Deribit) UnsubscribeJson(instruments []string) []byte {
+	//index channels stay subscribed, other instruments may use them
+	channels := []string{}
+	for _, instrument := range instruments {
+		channels = append(channels, "book."+instrument+".100ms")
+	}
+
+	return d.channelsJson("public/unsubscribe", channels)
+}
+
+func (d *Deribit) channelsJson(method string, channels []string) []byte {
+	d.mu.Lock()
+	d.reqId++
+	id := d.reqId
+	d.mu.Unlock()
+
+	data := struct {
+		Jsonrpc string              `json:"jsonrpc"`
+		Id      int                 `json:"id"`
+		Method  string              `json:"method"`
+		Params  map[string][]string `json:"params"`
+	}{
+		"2.0",
+		id,
+		method,
+		map[string][]string{"channels": channels},
+	}
+
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		log.Fatalf("orderbook json marshal error: %v", err)
+	}
+
+	return jsonData
+}
+
+func (d *Deribit) ParseFrame(raw []byte) (*BookUpdate, error) {
+	var res deribitMessage
+	err := json.Unmarshal(raw, &res)
+	if err != nil {
+		return nil, fmt.Errorf("deribitParseFrame: error unmarshaling response: %v\n(response): %v", err, string(raw))
+	}
+
+	if res.Error != nil {
+		return nil, fmt.Errorf("deribitParseFrame: error response: %v: %v", res.Error.Code, res.Error.Message)
+	}
+	if res.Method != "subscription" { //subscribe acks
+		return nil, nil
+	}
+
+	channel := res.Params.Channel
+	if strings.HasPrefix(channel, "deribit_price_index.") {
+		var index deribitIndexData
+		err = json.Unmarshal(res.Params.Data, &index)
+		if err != nil {
+			return nil, fmt.Errorf("deribitParseFrame: error unmarshaling index: %v", err)
+		}
+
+		d.mu.Lock()
+		if d.indexPrices == nil {
+			d.indexPrices = make(map[string]float64)
+		}
+		d.indexPrices[index.IndexName] = index.Price
+		d.mu.Unlock()
+
+		return nil, nil
+	}
+
+	if !strings.HasPrefix(channel, "book.") {
+		return nil, nil
+	}
+
+	var book deribitBookData
+	err = json.Unmarshal(res.Params.Data, &book)
+	if err != nil {
+		return nil, fmt.Errorf("deribitParseFrame: error unmarshaling book: %v", err)
+	}
+
+	return d.updateBook(book)
+}
+
+func (d *Deribit) updateBook(data deribitBookData) (*BookUpdate, error) {
+	instrument, err := parseInstrument("deribit", data.InstrumentName)
+	if err != nil {
+		return nil, err
+	}
+
+	if data.Type != "snapshot" && data.Type != "change" {
+		return nil, fmt.Errorf("deribitUpdateBook: unknown book type %q", data.Type)
+	}
+	delta := bookDelta{
+		Snapshot: data.Type == "snapshot",
+		Seq:      data.ChangeId,
+		PrevSeq:  data.PrevChangeId,
+		Bids:     deribitPriceLevels(data.Bids),
+		Asks:     deribitPriceLevels(data.Asks),
+	}
+	bids, asks, err := d.books.Apply("deribit", data.InstrumentName, delta)
+	if err != nil || (bids == nil && asks == nil) {
+		return nil, err
+	}
+
+	indexName := deribitIndexName(data.InstrumentName)
+	if indexName == "" {
+		return bookUpdate(instrument, bids, asks), nil
+	}
+	d.mu.Lock()
+	index, ok := d.indexPrices[indexName]
+	d.mu.Unlock()
+	if !ok {
+		return nil, errors.New("deribitUpdateBook: no index price received yet for " + data.InstrumentName)
+	}
+
+	return bookUpdate(instrument, deribitUsdLevels(bids, index), deribitUsdLevels(asks, index)), nil
+}
+
+func deribitPriceLevels(changes []deribitLevel) []priceLevel {
+	levels := make([]priceLevel, len(changes))
+	for i, change := range changes {
+		levels[i] = priceLevel{Price: change.Price, Amount: change.Amount, Iv: -1}
+		if change.Action == "delete" {
+			levels[i].Amount = 0
+		}
+	}
+
+	return levels
+}
+
+func deribitUsdLevels(levels []priceLevel, index float64) []priceLevel {
+	for i := range levels {
+		levels[i].Price *= index
+	}
+
+	return levels
+}
+
+// deribitIndexName returns the index converting the premiums of instrument to USD, empty for linear options
+func deribitIndexName(instrument string) string {
+	//ETH-27SEP24-3000-C -> eth_usd, SOL_USDC-27SEP24-150-C -> ""
+	asset, _, _ := strings.Cut(instrument, "-")
+	if strings.HasSuffix(asset, instrumentFormats["deribit"].linearSuffix) {
+		return ""
+	}
+
+	return strings.ToLower(asset) + "_usd"
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// deribitStandIn serves public/get_instruments and a websocket that answers the first subscribe with the recorded
+// frames, the channels of that subscribe are sent on subscribed
+func deribitStandIn(t *testing.T, frames [][]byte, subscribed chan<- []string) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/public/get_instruments", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("currency") != "ETH" || r.URL.Query().Get("kind") != "option" {
+			t.Errorf("get_instruments: unexpected query %v", r.URL.RawQuery)
+		}
+		w.Write([]byte(`{"jsonrpc":"2.0","result":[
+			{"instrument_name":"ETH-31DEC27-2000-C","is_active":true},
+			{"instrument_name":"ETH-31DEC27-2100-P","is_active":true},
+			{"instrument_name":"ETH-31DEC27-2200-C","is_active":false},
+			{"instrument_name":"ETH-PERPETUAL","is_active":true}
+		]}`))
+	})
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		c, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Errorf("accept: %v", err)
+			return
+		}
+		defer c.CloseNow()
+
+		_, raw, err := c.Read(r.Context())
+		if err != nil {
+			t.Errorf("read subscribe: %v", err)
+			return
+		}
+		var req struct {
+			Method string              `json:"method"`
+			Params map[string][]string `json:"params"`
+		}
+		if err := json.Unmarshal(raw, &req); err != nil || req.Method != "public/subscribe" {
+			t.Errorf("unexpected subscribe %s", raw)
+			return
+		}
+		subscribed <- req.Params["channels"]
+
+		for _, frame := range frames {
+			if err := c.Write(r.Context(), websocket.MessageText, frame); err != nil {
+				return
+			}
+		}
+		c.Read(r.Context()) //until the client closes
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestDeribitRecordedFrames(t *testing.T) {
+	resetState(t)
+
+	subscribed := make(chan []string, 1)
+	server := deribitStandIn(t, readFrames(t, "testdata/deribit_frames.jsonl"), subscribed)
+	d := &Deribit{Http: server.URL, Wss: "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"}
+
+	instruments, err := d.Instruments("ETH")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(instruments, ",") != "ETH-31DEC27-2000-C,ETH-31DEC27-2100-P" {
+		t.Fatalf("instruments: got %v, want the active options only", instruments)
+	}
+
+	conn, err := dialWss(context.Background(), d.WssUrl())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Conn.CloseNow()
+	defer conn.Cancel()
+
+	err = wssReqOrderbook(d, instruments, 20, conn.Ctx, conn.Conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	channels := <-subscribed
+	want := "book.ETH-31DEC27-2000-C.100ms,deribit_price_index.eth_usd,book.ETH-31DEC27-2100-P.100ms"
+	if strings.Join(channels, ",") != want {
+		t.Errorf("channels: got %v, want %v", channels, want)
+	}
+
+	updates := make(chan *BookUpdate, 16)
+	go wssReadLoop(d, conn.Ctx, conn.Conn, updates, nil)
+
+	var received []*BookUpdate
+	timeout := time.After(5 * time.Second)
+	for len(received) < 3 {
+		select {
+		case update := <-updates:
+			received = append(received, update)
+		case <-timeout:
+			t.Fatalf("got %v updates, want 3", len(received))
+		}
+	}
+
+	//the change replaces the 0.145 ask of the snapshot with 0.14, prices are converted at the 2000 index
+	last := received[2]
+	if last.Instrument.Strike != 2000 || last.Instrument.Type != Call || last.Instrument.Venue != "deribit" {
+		t.Fatalf("last update: unexpected instrument %+v", last.Instrument)
+	}
+	wantAsks := []Order{{Price: 280, Amount: 2}, {Price: 300, Amount: 10}}
+	if len(last.Asks) != len(wantAsks) {
+		t.Fatalf("asks: got %+v, want %+v", last.Asks, wantAsks)
+	}
+	for i, ask := range last.Asks {
+		if !almostEqual(ask.Price, wantAsks[i].Price) || ask.Amount != wantAsks[i].Amount || ask.Exchange != "deribit" {
+			t.Errorf("ask %v: got %+v, want %+v on deribit", i, ask, wantAsks[i])
+		}
+	}
+	if len(last.Bids) != 1 || !almostEqual(last.Bids[0].Price, 260) {
+		t.Errorf("bids: got %+v, want the snapshot's 0.13 bid at 260", last.Bids)
+	}
+
+	//deribit asks and aevo bids form a cross-venue long box
+	aevo := &Aevo{}
+	aevoFrames := []string{
+		`{"channel":"orderbook:ETH-31DEC27-2100-C","data":{"type":"snapshot","instrument_name":"ETH-31DEC27-2100-C","bids":[["250","4","0.5"]],"asks":[],"last_updated":"1"}}`,
+		`{"channel":"orderbook:ETH-31DEC27-2000-P","data":{"type":"snapshot","instrument_name":"ETH-31DEC27-2000-P","bids":[["150","6","0.5"]],"asks":[],"last_updated":"1"}}`,
+	}
+	for _, frame := range aevoFrames {
+		update, err := aevo.ParseFrame([]byte(frame))
+		if err != nil {
+			t.Fatal(err)
+		}
+		received = append(received, update)
+	}
+	for _, update := range received {
+		update.stamp(now())
+		Orderbooks.Update(update.Instrument, update.Bids, update.Asks)
+	}
+	updateBoxes()
+
+	key := BoxKey{"ETH", last.Instrument.Expiry, 2000, 2100, BoxLong}
+	box, ok := BoxContainer.Boxes[key]
+	if !ok {
+		t.Fatalf("no cross-venue box %+v in %v", key, BoxContainer.Boxes)
+	}
+	venues := []string{box.ShortCallBids[0].Exchange, box.LongCallAsks[0].Exchange, box.ShortPutBids[0].Exchange, box.LongPutAsks[0].Exchange}
+	if strings.Join(venues, ",") != "aevo,deribit,aevo,deribit" {
+		t.Errorf("legs: got venues %v", venues)
+	}
+	if !almostEqual(box.Cost, 280-250+180-150) {
+		t.Errorf("cost: got %v, want 60", box.Cost)
+	}
+}
+
+func TestDeribitUpdateBeforeIndex(t *testing.T) {
+	d := &Deribit{}
+	frames := readFrames(t, "testdata/deribit_frames.jsonl")
+
+	update, err := d.ParseFrame(frames[2]) //book snapshot without a preceding index price
+	if err == nil || update != nil {
+		t.Errorf("got %+v, %v, want an error until the index price is known", update, err)
+	}
+}
+
+func TestDeribitLinearOptions(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("currency") {
+		case "USDC":
+			w.Write([]byte(`{"jsonrpc":"2.0","result":[
+				{"instrument_name":"SOL_USDC-31DEC27-150-C","is_active":true},
+				{"instrument_name":"XRP_USDC-31DEC27-0d625-P","is_active":true},
+				{"instrument_name":"SOL_USDC-PERPETUAL","is_active":true}
+			]}`))
+		default: //deribit has no SOL currency
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"jsonrpc":"2.0","error":{"message":"Invalid params","code":-32602}}`))
+		}
+	}))
+	defer server.Close()
+	d := &Deribit{Http: server.URL}
+
+	instruments, err := d.Instruments("SOL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(instruments, ",") != "SOL_USDC-31DEC27-150-C" {
+		t.Fatalf("instruments: got %v, want SOL's linear options", instruments)
+	}
+
+	var subscribe struct {
+		Params map[string][]string `json:"params"`
+	}
+	json.Unmarshal(d.OrderbookJson(instruments), &subscribe)
+	if channels := strings.Join(subscribe.Params["channels"], ","); channels != "book.SOL_USDC-31DEC27-150-C.100ms" {
+		t.Errorf("channels: got %v, want no index for USDC premiums", channels)
+	}
+
+	//quoted in USDC, emitted without waiting for or converting by an index
+	frame := `{"jsonrpc":"2.0","method":"subscription","params":{"channel":"book.SOL_USDC-31DEC27-150-C.100ms","data":{"type":"snapshot","instrument_name":"SOL_USDC-31DEC27-150-C","change_id":1,"bids":[["new",12.5,30]],"asks":[["new",13.1,20]]}}}`
+	update, err := d.ParseFrame([]byte(frame))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if update.Instrument.Asset != "SOL" || update.Instrument.Strike != 150 {
+		t.Errorf("instrument: got %+v", update.Instrument)
+	}
+	if len(update.Bids) != 1 || update.Bids[0].Price != 12.5 || len(update.Asks) != 1 || update.Asks[0].Price != 13.1 {
+		t.Errorf("got bids %+v asks %+v, want the USDC prices", update.Bids, update.Asks)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Exchange is implemented by every venue adapter (aevo.go, lyra.go, ...), adding a venue only requires a new file
+// that implements Exchange and calls registerExchange from init()
+type Exchange interface {
+	Name() string
+	WssUrl() string
+	// SetEndpoints overrides the exchange's http and websocket urls, empty values keep the current url
+	SetEndpoints(httpUrl string, wssUrl string)
+	// Instruments returns the names of the active option instruments for asset
+	Instruments(asset string) ([]string, error)
+	// OrderbookJson builds the subscribe message for the orderbooks of instruments
+	OrderbookJson(instruments []string) []byte
+	// UnsubscribeJson builds the unsubscribe message for the orderbooks of instruments
+	UnsubscribeJson(instruments []string) []byte
+	// ParseFrame parses a raw ws frame, returns nil *BookUpdate (and nil error) for frames that aren't orderbooks and
+	// a *SequenceGapError when an instrument has to be resubscribed
+	ParseFrame(raw []byte) (*BookUpdate, error)
+}
+
+// normalized orderbook update for one instrument, produced by Exchange.ParseFrame
+type BookUpdate struct {
+	Instrument Instrument
+	Bids       []Order
+	Asks       []Order
+}
+
+// stamp sets the receive time of every order in the update
+func (u *BookUpdate) stamp(received time.Time) {
+	for i := range u.Bids {
+		u.Bids[i].Timestamp = received
+	}
+	for i := range u.Asks {
+		u.Asks[i].Timestamp = received
+	}
+}
+
+// one [price, amount] or [price, amount, iv] level as sent by aevo and lyra, numbers are encoded as strings
+type priceLevel struct {
+	Price  float64
+	Amount float64
+	Iv     float64 //-1 when the exchange doesn't send IV
+}
+
+func (l *priceLevel) UnmarshalJSON(data []byte) error {
+	var fields []string
+	err := json.Unmarshal(data, &fields)
+	if err != nil {
+		return fmt.Errorf("priceLevel: expected array of strings: %s", data)
+	}
+	if len(fields) != 2 && len(fields) != 3 {
+		return fmt.Errorf("priceLevel: expected 2 or 3 fields, got %v: %s", len(fields), data)
+	}
+
+	values := [3]float64{0, 0, -1}
+	for i, field := range fields {
+		values[i], err = strconv.ParseFloat(field, 64)
+		if err != nil || math.IsNaN(values[i]) || math.IsInf(values[i], 0) {
+			return fmt.Errorf("priceLevel: invalid number %q: %s", field, data)
+		}
+	}
+	if values[0] < 0 || values[1] < 0 {
+		return fmt.Errorf("priceLevel: negative price or amount: %s", data)
+	}
+	l.Price, l.Amount, l.Iv = values[0], values[1], values[2]
+
+	return nil
+}
+
+// bookUpdate builds the update of instrument from its full book, an empty book clears the venue's quotes
+func bookUpdate(instrument Instrument, bids []priceLevel, asks []priceLevel) *BookUpdate {
+	return &BookUpdate{Instrument: instrument, Bids: toOrders(bids, instrument), Asks: toOrders(asks, instrument)}
+}
+
+func toOrders(levels []priceLevel, instrument Instrument) []Order {
+	orders := make([]Order, len(levels))
+	for i, level := range levels {
+		orders[i] = Order{
+			Asset:      instrument.Asset,
+			Price:      level.Price,
+			Amount:     level.Amount,
+			Iv:         level.Iv,
+			Strike:     instrument.Strike,
+			OptionType: instrument.Type,
+			Exchange:   instrument.Venue,
+		}
+	}
+
+	return orders
+}
+
+var ExchangeRegistry = make(map[string]Exchange) //exchange name: Exchange
+
+func registerExchange(ex Exchange) {
+	if _, exists := ExchangeRegistry[ex.Name()]; exists {
+		panic("registerExchange: exchange registered twice: " + ex.Name())
+	}
+	ExchangeRegistry[ex.Name()] = ex
+}
+
+func getExchange(name string) (Exchange, error) {
+	ex, ok := ExchangeRegistry[name]
+	if !ok {
+		return nil, fmt.Errorf("getExchange: unknown exchange %q, registered: %v", name, exchangeNames())
+	}
+
+	return ex, nil
+}
+
+func exchangeNames() []string {
+	names := make([]string, 0, len(ExchangeRegistry))
+	for name := range ExchangeRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
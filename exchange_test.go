@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// frameResult is the expected outcome of parsing one captured frame
+type frameResult struct {
+	err  string      //part of the expected error, empty for none
+	bids [][]float64 //[price, amount] of the update's bids, nil for no update
+	asks [][]float64
+}
+
+// checkFrames parses the captured frames in order with ex and compares every outcome with want
+func checkFrames(t *testing.T, ex Exchange, frames [][]byte, want []frameResult) {
+	t.Helper()
+
+	if len(frames) != len(want) {
+		t.Fatalf("%v frames, %v expected results", len(frames), len(want))
+	}
+	for i, frame := range frames {
+		update, err := ex.ParseFrame(frame)
+		if want[i].err != "" {
+			if err == nil || !strings.Contains(err.Error(), want[i].err) {
+				t.Errorf("frame %v: got error %v, want %q", i, err, want[i].err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("frame %v: %v", i, err)
+			continue
+		}
+		if want[i].bids == nil && want[i].asks == nil {
+			if update != nil {
+				t.Errorf("frame %v: got update %+v, want none", i, update)
+			}
+			continue
+		}
+		if update == nil {
+			t.Errorf("frame %v: no update", i)
+			continue
+		}
+		for _, side := range []struct {
+			name   string
+			orders []Order
+			want   [][]float64
+		}{{"bids", update.Bids, want[i].bids}, {"asks", update.Asks, want[i].asks}} {
+			if len(side.orders) != len(side.want) {
+				t.Errorf("frame %v %v: got %+v, want %v", i, side.name, side.orders, side.want)
+				continue
+			}
+			for k, order := range side.orders {
+				if order.Price != side.want[k][0] || order.Amount != side.want[k][1] || order.Exchange != ex.Name() {
+					t.Errorf("frame %v %v: got %+v, want %v", i, side.name, side.orders, side.want)
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestAevoCapturedPayloads(t *testing.T) {
+	markets, err := os.ReadFile("testdata/aevo_markets.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/markets" || r.URL.Query().Get("instrument_type") != "OPTION" {
+			t.Errorf("unexpected request %v", r.URL)
+		}
+		if r.URL.Query().Get("asset") != "ETH" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"INVALID_ASSET"}`))
+			return
+		}
+		w.Write(markets)
+	}))
+	defer server.Close()
+	a := &Aevo{Http: server.URL}
+
+	instruments, err := a.Instruments("ETH")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(instruments, ",") != "ETH-31DEC27-2000-C,ETH-31DEC27-2000-P" {
+		t.Errorf("instruments: got %v, want the active options", instruments)
+	}
+	if _, err := a.Instruments("DOGE"); err == nil || !strings.Contains(err.Error(), "INVALID_ASSET") {
+		t.Errorf("got error %v, want the error response", err)
+	}
+
+	checkFrames(t, &Aevo{}, readFrames(t, "testdata/aevo_frames.jsonl"), []frameResult{
+		{}, //subscribe ack
+		{bids: [][]float64{{270.5, 4.2}, {269, 10}}, asks: [][]float64{{272.1, 3}}},
+		{bids: [][]float64{{269, 10}}, asks: [][]float64{{271.8, 1.5}, {272.1, 3}}}, //zero amount deletes
+		{err: "INVALID_CHANNEL"},
+		{err: "invalid number"},
+		{err: "expected array of strings"},
+		{err: "unknown orderbook type"},
+		{}, //other channels
+	})
+}
+
+func TestLyraCapturedPayloads(t *testing.T) {
+	instrumentsResponse, err := os.ReadFile("testdata/lyra_instruments.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var req struct {
+			Currency       string `json:"currency"`
+			InstrumentType string `json:"instrument_type"`
+		}
+		if r.Method != "POST" || r.URL.Path != "/public/get_instruments" || json.Unmarshal(body, &req) != nil || req.InstrumentType != "option" {
+			t.Errorf("unexpected request %v %v %s", r.Method, r.URL, body)
+		}
+		if req.Currency != "ETH" {
+			w.Write([]byte(`{"error":{"code":-32602,"message":"Invalid params"},"id":"1"}`))
+			return
+		}
+		w.Write(instrumentsResponse)
+	}))
+	defer server.Close()
+	l := &Lyra{Http: server.URL}
+
+	instruments, err := l.Instruments("ETH")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(instruments, ",") != "ETH-20271231-2000-C,ETH-20271231-2100-P" {
+		t.Errorf("instruments: got %v, want the active options", instruments)
+	}
+	if _, err := l.Instruments("DOGE"); err == nil || !strings.Contains(err.Error(), "Invalid params") {
+		t.Errorf("got error %v, want the error response", err)
+	}
+
+	checkFrames(t, &Lyra{}, readFrames(t, "testdata/lyra_frames.jsonl"), []frameResult{
+		{}, //subscribe ack
+		{bids: [][]float64{{251, 3}, {250.5, 8}}, asks: [][]float64{{262, 1.5}}},
+		{bids: [][]float64{{250.5, 8}}, asks: [][]float64{{261, 2}, {262, 1.5}}}, //every message is the full top of book
+		{err: "Invalid params"},
+		{err: "negative price or amount"},
+		{}, //other channels
+	})
+}
+
+func TestPriceLevelDecoding(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want priceLevel
+		err  string
+	}{
+		{`["270.5","4.2","0.63"]`, priceLevel{270.5, 4.2, 0.63}, ""},
+		{`["270.5","4.2"]`, priceLevel{270.5, 4.2, -1}, ""},
+		{`["270.5","0"]`, priceLevel{270.5, 0, -1}, ""},
+		{`[270.5,4.2]`, priceLevel{}, "expected array of strings"},
+		{`{"price":"270.5"}`, priceLevel{}, "expected array of strings"},
+		{`["270.5"]`, priceLevel{}, "expected 2 or 3 fields"},
+		{`["1","2","3","4"]`, priceLevel{}, "expected 2 or 3 fields"},
+		{`["NaN","1"]`, priceLevel{}, "invalid number"},
+		{`["1","Inf"]`, priceLevel{}, "invalid number"},
+		{`["","1"]`, priceLevel{}, "invalid number"},
+		{`["-1","1"]`, priceLevel{}, "negative price or amount"},
+	}
+	for _, test := range tests {
+		var level priceLevel
+		err := json.Unmarshal([]byte(test.raw), &level)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%v: got %+v, %v, want error %q", test.raw, level, err, test.err)
+			}
+			continue
+		}
+		if err != nil || level != test.want {
+			t.Errorf("%v: got %+v, %v, want %+v", test.raw, level, err, test.want)
+		}
+	}
+}
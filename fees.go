@@ -0,0 +1,64 @@
+package main
+
+import "math"
+
+// fees charged by an exchange per option contract, rates are fractions (0.0003 = 0.03%) of the underlying's price
+type FeeSchedule struct {
+	MakerRate     float64 `json:"maker_rate"`
+	TakerRate     float64 `json:"taker_rate"`
+	PerContract   float64 `json:"per_contract"`   //flat USD fee per contract traded
+	PremiumCap    float64 `json:"premium_cap"`    //trading and settlement fees are capped at this fraction of the option price, 0 = uncapped
+	SettlementFee float64 `json:"settlement_fee"` //rate charged on every contract settled in the money at expiry
+}
+
+// exchange: fee schedule, exchanges without a schedule are treated as fee free
+var FeeSchedules = map[string]FeeSchedule{
+	"aevo":    {MakerRate: 0.0003, TakerRate: 0.0005, PremiumCap: 0.125, SettlementFee: 0.00015},
+	"deribit": {MakerRate: 0.0003, TakerRate: 0.0003, PremiumCap: 0.125, SettlementFee: 0.00015},
+	"lyra":    {MakerRate: 0.0001, TakerRate: 0.0003, PerContract: 0.5, PremiumCap: 0.125},
+}
+
+func takerFee(order Order, spot float64) float64 {
+	//fee per contract for taking order, boxes are always taken
+	schedule := FeeSchedules[order.Exchange]
+
+	fee := schedule.TakerRate * spot
+	if schedule.PremiumCap > 0 {
+		fee = math.Min(fee, schedule.PremiumCap*order.Price)
+	}
+
+	return fee + schedule.PerContract
+}
+
+func settlementFee(exchange string, spot float64, intrinsic float64) float64 {
+	schedule := FeeSchedules[exchange]
+
+	fee := schedule.SettlementFee * spot
+	if schedule.PremiumCap > 0 {
+		fee = math.Min(fee, schedule.PremiumCap*intrinsic)
+	}
+
+	return fee
+}
+
+func impliedSpot(k1 float64, call float64, put float64) float64 {
+	//put-call parity at K1 (ignoring rates), exchanges' orderbook messages don't carry the underlying's price
+	return k1 + call - put
+}
+
+func boxSettlementFee(payoff float64, spot float64, k1Call Order, k2Call Order, k1Put Order, k2Put Order) float64 {
+	//exactly two legs settle in the money: both calls above K2, both puts below K1, the K1 call and K2 put in between
+	//worst case of the three is charged, with the payoff as the intrinsic value of each pair
+	calls := settlementFee(k1Call.Exchange, spot, payoff) + settlementFee(k2Call.Exchange, spot, payoff)
+	puts := settlementFee(k1Put.Exchange, spot, payoff) + settlementFee(k2Put.Exchange, spot, payoff)
+	between := settlementFee(k1Call.Exchange, spot, payoff) + settlementFee(k2Put.Exchange, spot, payoff)
+
+	return math.Max(math.Max(calls, puts), between)
+}
+
+func boxFees(payoff float64, spot float64, k1Call Order, k2Call Order, k1Put Order, k2Put Order) float64 {
+	//total fees per box taking the four given levels and holding to expiry
+	trading := takerFee(k1Call, spot) + takerFee(k2Call, spot) + takerFee(k1Put, spot) + takerFee(k2Put, spot)
+
+	return trading + boxSettlementFee(payoff, spot, k1Call, k2Call, k1Put, k2Put)
+}
@@ -0,0 +1,67 @@
+package main
+
+import "testing"
+
+func TestTakerFee(t *testing.T) {
+	//at spot 3000 aevo charges 1.5, deribit 0.9 and lyra 0.9 + 0.5 per contract, cheap options pay 12.5% of their price
+	tests := []struct {
+		venue string
+		price float64
+		want  float64
+	}{
+		{"aevo", 300, 1.5},
+		{"aevo", 10, 1.25},
+		{"deribit", 300, 0.9},
+		{"deribit", 4, 0.5},
+		{"lyra", 300, 1.4},
+		{"lyra", 4, 1},
+		{"unknown", 300, 0},
+	}
+	for _, test := range tests {
+		if got := takerFee(Order{Price: test.price, Exchange: test.venue}, 3000); !almostEqual(got, test.want) {
+			t.Errorf("%v at %v: got %v, want %v", test.venue, test.price, got, test.want)
+		}
+	}
+}
+
+func TestSettlementFee(t *testing.T) {
+	tests := []struct {
+		venue     string
+		intrinsic float64
+		want      float64
+	}{
+		{"aevo", 100, 0.45},
+		{"aevo", 2, 0.25},
+		{"deribit", 100, 0.45},
+		{"deribit", 0, 0},
+		{"lyra", 100, 0},
+		{"unknown", 100, 0},
+	}
+	for _, test := range tests {
+		if got := settlementFee(test.venue, 3000, test.intrinsic); !almostEqual(got, test.want) {
+			t.Errorf("%v with intrinsic %v: got %v, want %v", test.venue, test.intrinsic, got, test.want)
+		}
+	}
+}
+
+func TestBoxFees(t *testing.T) {
+	leg := func(venue string, price float64) Order { return Order{Price: price, Exchange: venue} }
+	tests := []struct {
+		name                         string
+		payoff                       float64
+		k1Call, k2Call, k1Put, k2Put Order
+		want                         float64
+	}{
+		{"aevo", 100, leg("aevo", 330), leg("aevo", 250), leg("aevo", 150), leg("aevo", 160), 4*1.5 + 2*0.45},
+		//the worst pair settling in the money is charged, here the K1 call and the K2 put both on aevo
+		{"mixed venues", 100, leg("aevo", 330), leg("lyra", 250), leg("lyra", 150), leg("aevo", 160), 1.5 + 1.4 + 1.4 + 1.5 + 2*0.45},
+		{"payoff caps settlement", 2, leg("deribit", 330), leg("deribit", 250), leg("deribit", 150), leg("deribit", 160), 4*0.9 + 2*0.25},
+		{"cheap legs cap trading", 100, leg("aevo", 4), leg("aevo", 2), leg("aevo", 8), leg("aevo", 6), 0.125*(4+2+8+6) + 2*0.45},
+		{"fee free venue", 100, leg("x", 330), leg("x", 250), leg("x", 150), leg("x", 160), 0},
+	}
+	for _, test := range tests {
+		if got := boxFees(test.payoff, 3000, test.k1Call, test.k2Call, test.k1Put, test.k2Put); !almostEqual(got, test.want) {
+			t.Errorf("%v: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
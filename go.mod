@@ -2,4 +2,10 @@ module box-spread-ws
 
 go 1.22.2
 
-require nhooyr.io/websocket v1.8.11
+require (
+	github.com/decred/dcrd/dcrec/secp256k1/v4 v4.4.0
+	golang.org/x/crypto v0.33.0
+	nhooyr.io/websocket v1.8.11
+)
+
+require golang.org/x/sys v0.30.0 // indirect
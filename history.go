@@ -0,0 +1,105 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const HistoryLength = 720 //points kept per box, older points are overwritten
+const HistoryRetention = 24 * time.Hour
+
+// one observation of a box, recorded whenever it is added, changes or is removed
+type historyPoint struct {
+	Time        time.Time
+	Open        bool //false once the box is no longer profitable, the profit fields are then zero
+	NetProfit   float64
+	TotalProfit float64
+	Apy         float64
+	MaxSize     float64
+}
+
+// fixed size ring buffer of the history of one box
+type profitHistory struct {
+	points [HistoryLength]historyPoint
+	next   int
+	count  int
+}
+
+func (h *profitHistory) add(point historyPoint) {
+	h.points[h.next] = point
+	h.next = (h.next + 1) % HistoryLength
+	if h.count < HistoryLength {
+		h.count++
+	}
+}
+
+func (h *profitHistory) last() historyPoint {
+	return h.points[(h.next+HistoryLength-1)%HistoryLength]
+}
+
+// ordered oldest first
+func (h *profitHistory) list() []historyPoint {
+	points := make([]historyPoint, h.count)
+	start := (h.next - h.count + HistoryLength) % HistoryLength
+	for i := range points {
+		points[i] = h.points[(start+i)%HistoryLength]
+	}
+
+	return points
+}
+
+// BoxHistoryStore keeps the profit history of every box seen in the last HistoryRetention, including closed ones
+type BoxHistoryStore struct {
+	mu        sync.Mutex
+	histories map[BoxKey]*profitHistory
+}
+
+var BoxHistory = BoxHistoryStore{histories: make(map[BoxKey]*profitHistory)}
+
+func (s *BoxHistoryStore) Record(key BoxKey, point historyPoint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	history, ok := s.histories[key]
+	if !ok {
+		history = &profitHistory{}
+		s.histories[key] = history
+	}
+	history.add(point)
+}
+
+func (s *BoxHistoryStore) Get(key BoxKey) []historyPoint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	history, ok := s.histories[key]
+	if !ok {
+		return nil
+	}
+
+	return history.list()
+}
+
+// Prune drops the histories of boxes that closed more than HistoryRetention ago
+func (s *BoxHistoryStore) Prune() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, history := range s.histories {
+		last := history.last()
+		if !last.Open && now().Sub(last.Time) > HistoryRetention {
+			delete(s.histories, key)
+		}
+	}
+}
+
+func boxHistoryPoint(box *Box) historyPoint {
+	return historyPoint{
+		Time:        now(),
+		Open:        true,
+		NetProfit:   box.NetProfit,
+		TotalProfit: box.TotalProfit,
+		Apy:         box.Apy,
+		MaxSize:     box.MaxSize,
+	}
+}
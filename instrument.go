@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const SettlementHour = 8 //options on every supported venue settle at 08:00 UTC on the expiry date
+
+const Call = "C"
+const Put = "P"
+
+// option instrument parsed from a venue's instrument name, e.g. aevo ETH-27SEP24-3000-C
+type Instrument struct {
+	Asset  string
+	Expiry int64 //unix settlement time
+	Strike float64
+	Type   string //Call or Put
+	Venue  string
+}
+
+func (i Instrument) Chain() ChainKey {
+	return ChainKey{i.Asset, i.Expiry}
+}
+
+// per venue instrument name format, all of them are ASSET-DATE-STRIKE-TYPE and differ in the date layout and strike
+// encoding
+type instrumentFormat struct {
+	dateLayout    string
+	decimalStrike string //stands for the decimal point in strikes, e.g. deribit's 0d625, empty if unused
+	linearSuffix  string //follows the asset of options settled in this currency instead of the asset, e.g. deribit's SOL_USDC
+}
+
+var instrumentFormats = map[string]instrumentFormat{
+	"aevo":    {dateLayout: "2Jan06"},
+	"deribit": {dateLayout: "2Jan06", decimalStrike: "d", linearSuffix: "_USDC"},
+	"lyra":    {dateLayout: "20060102"},
+}
+
+// parseInstrument parses an option instrument name of venue, perps, futures and unknown formats are rejected
+func parseInstrument(venue string, name string) (Instrument, error) {
+	format, ok := instrumentFormats[venue]
+	if !ok {
+		return Instrument{}, fmt.Errorf("parseInstrument: no instrument format for venue %q", venue)
+	}
+
+	components := strings.Split(name, "-")
+	if len(components) != 4 {
+		return Instrument{}, fmt.Errorf("parseInstrument: %v: %q is not an option instrument", venue, name)
+	}
+
+	asset := components[0]
+	if format.linearSuffix != "" {
+		asset = strings.TrimSuffix(asset, format.linearSuffix)
+	}
+	if !assetRegexp.MatchString(asset) {
+		return Instrument{}, fmt.Errorf("parseInstrument: %v: invalid asset in %q", venue, name)
+	}
+
+	date, err := time.Parse(format.dateLayout, components[1])
+	if err != nil {
+		return Instrument{}, fmt.Errorf("parseInstrument: %v: invalid expiry in %q: %v", venue, name, err)
+	}
+	expiry := date.Add(SettlementHour * time.Hour).Unix()
+
+	strikeStr := components[2]
+	if format.decimalStrike != "" {
+		strikeStr = strings.Replace(strikeStr, format.decimalStrike, ".", 1)
+	}
+	strike, err := strconv.ParseFloat(strikeStr, 64)
+	if err != nil || !(strike > 0) || math.IsInf(strike, 1) { //!(> 0) also rejects NaN
+		return Instrument{}, fmt.Errorf("parseInstrument: %v: invalid strike in %q", venue, name)
+	}
+
+	optionType := components[3]
+	if optionType != Call && optionType != Put {
+		return Instrument{}, fmt.Errorf("parseInstrument: %v: invalid option type in %q", venue, name)
+	}
+
+	return Instrument{Asset: asset, Expiry: expiry, Strike: strike, Type: optionType, Venue: venue}, nil
+}
+
+// optionInstruments drops the names that parseInstrument rejects, so only options are subscribed to
+func optionInstruments(venue string, names []string) []string {
+	var instruments []string
+	for _, name := range names {
+		if _, err := parseInstrument(venue, name); err != nil {
+			continue
+		}
+		instruments = append(instruments, name)
+	}
+
+	return instruments
+}
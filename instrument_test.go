@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseInstrument(t *testing.T) {
+	tests := []struct {
+		venue string
+		name  string
+		want  Instrument
+	}{
+		{"aevo", "ETH-27SEP24-3000-C", Instrument{Asset: "ETH", Expiry: 1727424000, Strike: 3000, Type: Call, Venue: "aevo"}},
+		{"aevo", "BTC-4OCT24-60000-P", Instrument{Asset: "BTC", Expiry: 1728028800, Strike: 60000, Type: Put, Venue: "aevo"}},
+		{"deribit", "ETH-27SEP24-3000-C", Instrument{Asset: "ETH", Expiry: 1727424000, Strike: 3000, Type: Call, Venue: "deribit"}},
+		{"deribit", "XRP_USDC-27SEP24-0d625-P", Instrument{Asset: "XRP", Expiry: 1727424000, Strike: 0.625, Type: Put, Venue: "deribit"}},
+		{"deribit", "SOL_USDC-27SEP24-150-C", Instrument{Asset: "SOL", Expiry: 1727424000, Strike: 150, Type: Call, Venue: "deribit"}},
+		{"lyra", "ETH-20240927-3000-C", Instrument{Asset: "ETH", Expiry: 1727424000, Strike: 3000, Type: Call, Venue: "lyra"}},
+	}
+	for _, test := range tests {
+		instrument, err := parseInstrument(test.venue, test.name)
+		if err != nil || instrument != test.want {
+			t.Errorf("%v %v: got %+v, %v, want %+v", test.venue, test.name, instrument, err, test.want)
+		}
+	}
+}
+
+func TestParseInstrumentMalformed(t *testing.T) {
+	tests := []struct {
+		venue string
+		name  string
+		err   string //part of the expected error
+	}{
+		{"binance", "ETH-27SEP24-3000-C", "no instrument format"},
+		{"aevo", "ETH-PERP", "not an option"},
+		{"deribit", "ETH-PERPETUAL", "not an option"},
+		{"deribit", "ETH-27SEP24", "not an option"},
+		{"aevo", "ETH-27SEP24-3000-C-X", "not an option"},
+		{"aevo", "", "not an option"},
+		{"aevo", "eth-27SEP24-3000-C", "invalid asset"},
+		{"aevo", "-27SEP24-3000-C", "invalid asset"},
+		{"aevo", "SOL_USDC-27SEP24-150-C", "invalid asset"}, //the suffix is deribit's
+		{"deribit", "SOL_USDT-27SEP24-150-C", "invalid asset"},
+		{"deribit", "_USDC-27SEP24-150-C", "invalid asset"},
+		{"aevo", "ETH-31SEP24-3000-C", "invalid expiry"},
+		{"aevo", "ETH-20240927-3000-C", "invalid expiry"},
+		{"lyra", "ETH-27SEP24-3000-C", "invalid expiry"},
+		{"aevo", "ETH-27SEP24-abc-C", "invalid strike"},
+		{"aevo", "ETH-27SEP24-0-C", "invalid strike"},
+		{"aevo", "ETH-27SEP24--5-C", "not an option"},
+		{"aevo", "ETH-27SEP24-NaN-C", "invalid strike"},
+		{"aevo", "ETH-27SEP24-Inf-C", "invalid strike"},
+		{"aevo", "ETH-27SEP24-0d625-C", "invalid strike"}, //decimal strikes are deribit's
+		{"aevo", "ETH-27SEP24-3000-X", "invalid option type"},
+		{"aevo", "ETH-27SEP24-3000-c", "invalid option type"},
+	}
+	for _, test := range tests {
+		instrument, err := parseInstrument(test.venue, test.name)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%v %q: got %+v, %v, want an error containing %q", test.venue, test.name, instrument, err, test.err)
+		}
+	}
+}
+
+func TestOptionInstruments(t *testing.T) {
+	names := []string{"ETH-PERPETUAL", "ETH-27SEP24-3000-C", "ETH-27SEP24", "SOL_USDC-27SEP24-150-P", "SOL_USDC-PERPETUAL"}
+	got := optionInstruments("deribit", names)
+	if strings.Join(got, ",") != "ETH-27SEP24-3000-C,SOL_USDC-27SEP24-150-P" {
+		t.Errorf("got %v, want the options only", got)
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+var LegRetries = 2           //retries of a leg that didn't fill completely before the filled legs are unwound
+var LegPriceTolerance = 0.01 //fraction of the limit a retry or unwind may pay above (buy) or receive below (sell) it
+const LegEpsilon = 1e-9      //amounts below this are treated as zero
+
+// LegOrder is one IOC limit order of a box leg
+type LegOrder struct {
+	Instrument Instrument //Venue is the exchange the order is sent to
+	Side       string     //Buy or Sell
+	Limit      float64
+	Amount     float64
+	Spot       float64 //underlying price of the box, used by executors that estimate fees
+}
+
+// LegFill is what an IOC LegOrder filled before the rest was cancelled
+type LegFill struct {
+	Filled   float64
+	AvgPrice float64
+	Fees     float64
+}
+
+// LegExecutor executes single leg orders on one or more venues, implemented by PaperEngine (simulated fills against
+// Orderbooks) and AevoExecutor (live orders)
+type LegExecutor interface {
+	ExecuteLeg(ctx context.Context, order LegOrder) (LegFill, error)
+}
+
+// ErrOrderUnknown is wrapped by order errors when the order may have reached the venue without being acknowledged, e.g.
+// on a timeout or a 5xx response. its fill is unknown, unlike a rejected order's which is known to be zero
+var ErrOrderUnknown = errors.New("order outcome unknown")
+
+// status of a BoxExecution
+const ExecRunning = "running"
+const ExecFilled = "filled"   //every leg filled the requested size
+const ExecReduced = "reduced" //a smaller box was completed, the excess of the other legs was unwound
+const ExecUnwound = "unwound" //no box could be completed and every filled leg was unwound
+const ExecExposed = "exposed" //an unwind didn't fill completely or an order's outcome is unknown, the legs don't form whole boxes
+
+// action of a legDecision
+const DecisionSequence = "sequence" //leg order chosen
+const DecisionSubmit = "submit"
+const DecisionRetry = "retry"
+const DecisionReduce = "reduce" //box size lowered to what a leg filled
+const DecisionUnwind = "unwind"
+const DecisionError = "error"     //order rejected, it filled nothing
+const DecisionUnknown = "unknown" //order outcome unknown, the execution stops
+const DecisionDone = "done"
+
+// one decision of the leg-risk controller, every step of an execution is recorded
+type legDecision struct {
+	Time   time.Time
+	Leg    int //index into BoxExecution.Legs, -1 for the whole box
+	Action string
+	Detail string
+}
+
+type executionLeg struct {
+	Order     LegOrder //Amount is the size requested when the leg was first submitted
+	Liquidity float64  //amount quoted on its venue within the limit when the execution started
+	Filled    float64
+	AvgPrice  float64
+	Fees      float64
+	Unwound   float64 //amount closed again
+	UnwindAvg float64
+	Attempts  int
+	Unknown   bool //an order of the leg wasn't acknowledged, Filled and Unwound may be short of its position
+}
+
+// BoxExecution is one box executed leg by leg by a LegRiskController, legs are in the order of Box: short call,
+// long call, short put, long put
+type BoxExecution struct {
+	Id        int
+	Mode      string //paper or live
+	Key       BoxKey
+	Size      float64 //requested
+	Boxes     float64 //completed boxes
+	Status    string
+	Started   time.Time
+	Finished  time.Time
+	Legs      [4]executionLeg
+	Decisions []legDecision
+}
+
+func (e *BoxExecution) copy() *BoxExecution {
+	copied := *e
+	copied.Decisions = append([]legDecision(nil), e.Decisions...)
+
+	return &copied
+}
+
+// unknownLeg returns the leg with an order of unknown outcome, -1 for none
+func (e *BoxExecution) unknownLeg() int {
+	for i, leg := range e.Legs {
+		if leg.Unknown {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// LegRiskController executes boxes one leg at a time, most illiquid first, so the legs least likely to fill are tried
+// before the others are exposed. A leg that fills short is retried within LegPriceTolerance, after that the box is
+// reduced to what it filled and the excess of the already filled legs is unwound. once an order's outcome is unknown
+// no further orders are sent, the position has to be checked on the venue
+type LegRiskController struct {
+	Mode      string
+	Executors map[string]LegExecutor //venue: executor, boxes with a leg on any other venue are rejected
+
+	mu         sync.Mutex
+	executions []*BoxExecution
+}
+
+func newLegRiskController(mode string, executors map[string]LegExecutor) *LegRiskController {
+	return &LegRiskController{Mode: mode, Executors: executors}
+}
+
+func (c *LegRiskController) decide(exec *BoxExecution, leg int, action string, format string, args ...any) {
+	detail := fmt.Sprintf(format, args...)
+	exec.Decisions = append(exec.Decisions, legDecision{now(), leg, action, detail})
+	log.Printf("LegRiskController: %v execution %v leg %v %v: %v\n\n", c.Mode, exec.Id, leg, action, detail)
+	c.publish(exec)
+}
+
+func (c *LegRiskController) publish(exec *BoxExecution) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.executions[exec.Id-1] = exec.copy()
+}
+
+func venueLevels(levels []Order, venue string) []Order {
+	var filtered []Order
+	for _, level := range levels {
+		if level.Exchange == venue {
+			filtered = append(filtered, level)
+		}
+	}
+
+	return filtered
+}
+
+func levelsWithin(levels []Order, side string, limit float64) float64 {
+	total := 0.0
+	for _, level := range levels {
+		if (side == Sell && level.Price < limit) || (side == Buy && level.Price > limit) {
+			break
+		}
+		total += level.Amount
+	}
+
+	return total
+}
+
+// toleranceLimit moves limit against the order by LegPriceTolerance
+func toleranceLimit(side string, limit float64) float64 {
+	if side == Buy {
+		return limit * (1 + LegPriceTolerance)
+	}
+
+	return limit * (1 - LegPriceTolerance)
+}
+
+func opposite(side string) string {
+	if side == Buy {
+		return Sell
+	}
+
+	return Buy
+}
+
+// Execute executes size boxes of key leg by leg, each leg on the venue of its best level, and returns the finished execution
+func (c *LegRiskController) Execute(ctx context.Context, key BoxKey, size float64) (*BoxExecution, error) {
+	if !(size > 0) || math.IsInf(size, 1) {
+		return nil, fmt.Errorf("Execute: size must be positive, got %v", size)
+	}
+
+	BoxContainer.Mu.Lock()
+	box, ok := BoxContainer.Boxes[key]
+	BoxContainer.Mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("Execute: no %v box %v %v %v/%v", key.Direction, key.Asset, key.Expiry, key.K1, key.K2)
+	}
+
+	spot := boxSpot(box)
+	soldStrike, boughtStrike := key.K2, key.K1 //strikes of the sold call and bought call, as in updateBoxDirection
+	if key.Direction == BoxShort {
+		soldStrike, boughtStrike = boughtStrike, soldStrike
+	}
+	boxLevels := [4][]Order{box.ShortCallBids, box.LongCallAsks, box.ShortPutBids, box.LongPutAsks}
+	strikes := [4]float64{soldStrike, boughtStrike, boughtStrike, soldStrike}
+	types := [4]string{Call, Call, Put, Put}
+	sides := [4]string{Sell, Buy, Sell, Buy}
+
+	exec := &BoxExecution{Mode: c.Mode, Key: key, Size: size, Status: ExecRunning, Started: now()}
+	for i, levels := range boxLevels {
+		venue := levels[0].Exchange
+		if c.Executors[venue] == nil {
+			return nil, fmt.Errorf("Execute: best %v %v level is on %v, which %v execution doesn't support", formatFloat(strikes[i]), types[i], venue, c.Mode)
+		}
+		levels = venueLevels(levels, venue)
+		limit := legLimit(levels, size)
+		exec.Legs[i] = executionLeg{
+			Order: LegOrder{
+				Instrument: Instrument{Asset: key.Asset, Expiry: key.Expiry, Strike: strikes[i], Type: types[i], Venue: venue},
+				Side:       sides[i],
+				Limit:      limit,
+				Amount:     size,
+				Spot:       spot,
+			},
+			Liquidity: levelsWithin(levels, sides[i], limit),
+		}
+	}
+
+	c.mu.Lock()
+	exec.Id = len(c.executions) + 1
+	c.executions = append(c.executions, exec.copy())
+	c.mu.Unlock()
+
+	c.run(ctx, exec)
+
+	return exec.copy(), nil
+}
+
+func (c *LegRiskController) run(ctx context.Context, exec *BoxExecution) {
+	sequence := []int{0, 1, 2, 3}
+	sort.SliceStable(sequence, func(a, b int) bool { return exec.Legs[sequence[a]].Liquidity < exec.Legs[sequence[b]].Liquidity })
+	c.decide(exec, -1, DecisionSequence, "legs %v by quoted liquidity within their limits", sequence)
+
+	target := exec.Size
+	var done []int //legs filled to target
+	for _, i := range sequence {
+		filled := c.fillLeg(ctx, exec, i, target)
+		if exec.unknownLeg() >= 0 {
+			break
+		}
+		if filled >= target-LegEpsilon {
+			done = append(done, i)
+			continue
+		}
+
+		c.decide(exec, i, DecisionReduce, "filled %v of %v, box size reduced to %v", formatFloat(filled), formatFloat(target), formatFloat(filled))
+		target = filled
+		for _, j := range done {
+			if exec.unknownLeg() >= 0 {
+				break
+			}
+			c.unwindLeg(ctx, exec, j, target)
+		}
+		done = append(done, i)
+		if target <= LegEpsilon || exec.unknownLeg() >= 0 {
+			break
+		}
+	}
+
+	//every leg that was tried holds exactly target when nothing is left exposed
+	exposed := false
+	for _, i := range done {
+		leg := &exec.Legs[i]
+		if math.Abs(leg.Filled-leg.Unwound-target) > LegEpsilon {
+			exposed = true
+		}
+	}
+
+	exec.Boxes = target
+	exec.Finished = now()
+	switch {
+	case exec.unknownLeg() >= 0:
+		exec.Status = ExecExposed
+		exec.Boxes = 0 //none are known to be complete
+		unknown := exec.Legs[exec.unknownLeg()].Order.Instrument
+		c.decide(exec, -1, DecisionDone, "%v, the outcome of a %v %v order is unknown, check the position on %v", exec.Status, formatFloat(unknown.Strike), unknown.Type, unknown.Venue)
+		return
+	case exposed:
+		exec.Status = ExecExposed
+	case target >= exec.Size-LegEpsilon:
+		exec.Status = ExecFilled
+	case target > LegEpsilon:
+		exec.Status = ExecReduced
+	default:
+		exec.Status = ExecUnwound
+	}
+	c.decide(exec, -1, DecisionDone, "%v, %v boxes", exec.Status, formatFloat(target))
+}
+
+// send submits order to the leg's venue. rejected orders are recorded and count as no fill, errors wrapping
+// ErrOrderUnknown mark the leg Unknown
+func (c *LegRiskController) send(ctx context.Context, exec *BoxExecution, i int, order LegOrder) LegFill {
+	fill, err := c.Executors[order.Instrument.Venue].ExecuteLeg(ctx, order)
+	if errors.Is(err, ErrOrderUnknown) {
+		exec.Legs[i].Unknown = true
+		c.decide(exec, i, DecisionUnknown, "%v", err)
+		return LegFill{}
+	}
+	if err != nil {
+		c.decide(exec, i, DecisionError, "%v", err)
+		return LegFill{}
+	}
+
+	return fill
+}
+
+// fillLeg fills leg i up to target, retrying LegRetries times with the limit moved by LegPriceTolerance
+func (c *LegRiskController) fillLeg(ctx context.Context, exec *BoxExecution, i int, target float64) float64 {
+	leg := &exec.Legs[i]
+	order := leg.Order
+
+	for attempt := 0; attempt <= LegRetries && ctx.Err() == nil && !leg.Unknown; attempt++ {
+		action := DecisionSubmit
+		if attempt > 0 {
+			action = DecisionRetry
+			order.Limit = toleranceLimit(order.Side, leg.Order.Limit)
+		}
+		order.Amount = target - leg.Filled
+		c.decide(exec, i, action, "%v %v %v %v at %v on %v", order.Side, formatFloat(order.Amount), formatFloat(order.Instrument.Strike), order.Instrument.Type, formatFloat(order.Limit), order.Instrument.Venue)
+
+		fill := c.send(ctx, exec, i, order)
+		leg.Attempts++
+		if fill.Filled > 0 {
+			leg.AvgPrice = (leg.AvgPrice*leg.Filled + fill.AvgPrice*fill.Filled) / (leg.Filled + fill.Filled)
+			leg.Filled += fill.Filled
+			leg.Fees += fill.Fees
+		}
+		if leg.Filled >= target-LegEpsilon {
+			break
+		}
+	}
+
+	return leg.Filled
+}
+
+// unwindLeg closes the part of leg i's position above target with opposite orders limited to its average fill price
+// moved by LegPriceTolerance
+func (c *LegRiskController) unwindLeg(ctx context.Context, exec *BoxExecution, i int, target float64) {
+	leg := &exec.Legs[i]
+	order := leg.Order
+	order.Side = opposite(leg.Order.Side)
+	order.Limit = toleranceLimit(order.Side, leg.AvgPrice)
+
+	for attempt := 0; attempt <= LegRetries && ctx.Err() == nil && !leg.Unknown; attempt++ {
+		order.Amount = leg.Filled - leg.Unwound - target
+		if order.Amount <= LegEpsilon {
+			return
+		}
+		c.decide(exec, i, DecisionUnwind, "%v %v %v %v at %v on %v", order.Side, formatFloat(order.Amount), formatFloat(order.Instrument.Strike), order.Instrument.Type, formatFloat(order.Limit), order.Instrument.Venue)
+
+		fill := c.send(ctx, exec, i, order)
+		if fill.Filled > 0 {
+			leg.UnwindAvg = (leg.UnwindAvg*leg.Unwound + fill.AvgPrice*fill.Filled) / (leg.Unwound + fill.Filled)
+			leg.Unwound += fill.Filled
+			leg.Fees += fill.Fees
+		}
+	}
+}
+
+// Executions returns copies of every execution, newest first
+func (c *LegRiskController) Executions() []*BoxExecution {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	executions := make([]*BoxExecution, len(c.executions))
+	for i, exec := range c.executions {
+		executions[len(executions)-1-i] = exec.copy()
+	}
+
+	return executions
+}
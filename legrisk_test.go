@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// one scripted answer of scriptedExecutor, fills are at the order's limit
+type scriptedStep struct {
+	filled float64
+	err    error
+}
+
+// scriptedExecutor answers orders with its steps in turn and records them
+type scriptedExecutor struct {
+	t      *testing.T
+	steps  []scriptedStep
+	orders []LegOrder
+}
+
+func (x *scriptedExecutor) ExecuteLeg(ctx context.Context, order LegOrder) (LegFill, error) {
+	x.orders = append(x.orders, order)
+	if len(x.orders) > len(x.steps) {
+		x.t.Errorf("unscripted order %+v", order)
+		return LegFill{}, fmt.Errorf("unscripted order")
+	}
+	step := x.steps[len(x.orders)-1]
+
+	return LegFill{Filled: step.filled, AvgPrice: order.Limit}, step.err
+}
+
+// an order the controller is expected to send for a leg
+type sentOrder struct {
+	leg    int
+	side   string
+	amount float64
+	limit  float64
+}
+
+func TestLegRiskControllerExecute(t *testing.T) {
+	retries, tolerance := LegRetries, LegPriceTolerance
+	LegRetries, LegPriceTolerance = 2, 0.01
+	defer func() { LegRetries, LegPriceTolerance = retries, tolerance }()
+
+	key := BoxKey{"ETH", time.Date(2030, 1, 25, 8, 0, 0, 0, time.UTC).Unix(), 2000, 2100, BoxLong}
+	//amounts quoted within the limits order the legs 1, 3, 0, 2
+	legs := [4]struct {
+		strike     float64
+		optionType string
+		price      float64
+		amount     float64
+	}{{2100, Call, 250, 5}, {2000, Call, 330, 2}, {2000, Put, 150, 8}, {2100, Put, 160, 3}}
+	level := func(i int) []Order {
+		return []Order{{Asset: "ETH", Price: legs[i].price, Amount: legs[i].amount, Strike: legs[i].strike, OptionType: legs[i].optionType, Exchange: "aevo"}}
+	}
+	rejected := errors.New("aevo: order rejected")
+	unknown := fmt.Errorf("aevo: no response: %w", ErrOrderUnknown)
+
+	tests := []struct {
+		name    string
+		steps   []scriptedStep
+		orders  []sentOrder
+		actions []string
+		status  string
+		boxes   float64
+		unknown int //leg whose outcome is unknown, -1 for none
+	}{
+		{"filled by liquidity",
+			[]scriptedStep{{2, nil}, {2, nil}, {2, nil}, {2, nil}},
+			[]sentOrder{{1, Buy, 2, 330}, {3, Buy, 2, 160}, {0, Sell, 2, 250}, {2, Sell, 2, 150}},
+			[]string{DecisionSequence, DecisionSubmit, DecisionSubmit, DecisionSubmit, DecisionSubmit, DecisionDone},
+			ExecFilled, 2, -1},
+		{"partial fill retried at tolerance",
+			[]scriptedStep{{1.5, nil}, {0.5, nil}, {2, nil}, {2, nil}, {2, nil}},
+			[]sentOrder{{1, Buy, 2, 330}, {1, Buy, 0.5, 333.3}, {3, Buy, 2, 160}, {0, Sell, 2, 250}, {2, Sell, 2, 150}},
+			[]string{DecisionSequence, DecisionSubmit, DecisionRetry, DecisionSubmit, DecisionSubmit, DecisionSubmit, DecisionDone},
+			ExecFilled, 2, -1},
+		{"reduced with done legs unwound",
+			[]scriptedStep{{2, nil}, {2, nil}, {1, nil}, {0, nil}, {0, nil}, {1, nil}, {1, nil}, {1, nil}},
+			[]sentOrder{{1, Buy, 2, 330}, {3, Buy, 2, 160}, {0, Sell, 2, 250}, {0, Sell, 1, 247.5}, {0, Sell, 1, 247.5},
+				{1, Sell, 1, 326.7}, {3, Sell, 1, 158.4}, {2, Sell, 1, 150}},
+			[]string{DecisionSequence, DecisionSubmit, DecisionSubmit, DecisionSubmit, DecisionRetry, DecisionRetry, DecisionReduce,
+				DecisionUnwind, DecisionUnwind, DecisionSubmit, DecisionDone},
+			ExecReduced, 1, -1},
+		{"unwind filled short",
+			[]scriptedStep{{2, nil}, {0, nil}, {0, nil}, {0, nil}, {0.5, nil}, {0, nil}, {0, nil}},
+			[]sentOrder{{1, Buy, 2, 330}, {3, Buy, 2, 160}, {3, Buy, 2, 161.6}, {3, Buy, 2, 161.6},
+				{1, Sell, 2, 326.7}, {1, Sell, 1.5, 326.7}, {1, Sell, 1.5, 326.7}},
+			[]string{DecisionSequence, DecisionSubmit, DecisionSubmit, DecisionRetry, DecisionRetry, DecisionReduce,
+				DecisionUnwind, DecisionUnwind, DecisionUnwind, DecisionDone},
+			ExecExposed, 0, -1},
+		{"rejection retried",
+			[]scriptedStep{{0, rejected}, {2, nil}, {2, nil}, {2, nil}, {2, nil}},
+			[]sentOrder{{1, Buy, 2, 330}, {1, Buy, 2, 333.3}, {3, Buy, 2, 160}, {0, Sell, 2, 250}, {2, Sell, 2, 150}},
+			[]string{DecisionSequence, DecisionSubmit, DecisionError, DecisionRetry, DecisionSubmit, DecisionSubmit, DecisionSubmit, DecisionDone},
+			ExecFilled, 2, -1},
+		{"every attempt rejected",
+			[]scriptedStep{{0, rejected}, {0, rejected}, {0, rejected}},
+			[]sentOrder{{1, Buy, 2, 330}, {1, Buy, 2, 333.3}, {1, Buy, 2, 333.3}},
+			[]string{DecisionSequence, DecisionSubmit, DecisionError, DecisionRetry, DecisionError, DecisionRetry, DecisionError,
+				DecisionReduce, DecisionDone},
+			ExecUnwound, 0, -1},
+		{"unknown outcome stops the execution",
+			[]scriptedStep{{2, nil}, {0, unknown}},
+			[]sentOrder{{1, Buy, 2, 330}, {3, Buy, 2, 160}},
+			[]string{DecisionSequence, DecisionSubmit, DecisionSubmit, DecisionUnknown, DecisionDone},
+			ExecExposed, 0, 3},
+		{"unknown unwind outcome stops the execution",
+			[]scriptedStep{{2, nil}, {2, nil}, {0, nil}, {0, nil}, {0, nil}, {0, unknown}},
+			[]sentOrder{{1, Buy, 2, 330}, {3, Buy, 2, 160}, {0, Sell, 2, 250}, {0, Sell, 2, 247.5}, {0, Sell, 2, 247.5},
+				{1, Sell, 2, 326.7}},
+			[]string{DecisionSequence, DecisionSubmit, DecisionSubmit, DecisionSubmit, DecisionRetry, DecisionRetry, DecisionReduce,
+				DecisionUnwind, DecisionUnknown, DecisionDone},
+			ExecExposed, 0, 1},
+	}
+	for _, test := range tests {
+		resetState(t)
+		BoxContainer.Boxes[key] = &Box{Key: key, ShortCallBids: level(0), LongCallAsks: level(1), ShortPutBids: level(2), LongPutAsks: level(3), Amount: 2}
+
+		executor := &scriptedExecutor{t: t, steps: test.steps}
+		exec, err := newLegRiskController("paper", map[string]LegExecutor{"aevo": executor}).Execute(context.Background(), key, 2)
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+
+		if len(executor.orders) != len(test.orders) {
+			t.Errorf("%v: got %v orders, want %v: %+v", test.name, len(executor.orders), len(test.orders), executor.orders)
+		}
+		for i := 0; i < len(executor.orders) && i < len(test.orders); i++ {
+			got, want := executor.orders[i], test.orders[i]
+			if got.Instrument.Strike != legs[want.leg].strike || got.Instrument.Type != legs[want.leg].optionType ||
+				got.Side != want.side || !almostEqual(got.Amount, want.amount) || !almostEqual(got.Limit, want.limit) {
+				t.Errorf("%v: order %v: got %v %v %v %v at %v, want leg %v %v %v at %v", test.name, i, got.Side, got.Amount,
+					got.Instrument.Strike, got.Instrument.Type, got.Limit, want.leg, want.side, want.amount, want.limit)
+			}
+		}
+
+		var actions []string
+		for _, decision := range exec.Decisions {
+			actions = append(actions, decision.Action)
+		}
+		if fmt.Sprint(actions) != fmt.Sprint(test.actions) {
+			t.Errorf("%v: got decisions %v, want %v", test.name, actions, test.actions)
+		}
+		if exec.Status != test.status || !almostEqual(exec.Boxes, test.boxes) || exec.unknownLeg() != test.unknown {
+			t.Errorf("%v: got %v, %v boxes, unknown leg %v, want %v, %v boxes, unknown leg %v", test.name, exec.Status, exec.Boxes,
+				exec.unknownLeg(), test.status, test.boxes, test.unknown)
+		}
+	}
+}
@@ -1,23 +1,104 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
-	"strconv"
 	"strings"
-	"time"
-
-	"nhooyr.io/websocket"
 )
 
 const LyraHttp string = "https://api.lyra.finance"
 const LyraWss string = "wss://api.lyra.finance/ws"
 
-func lyraMarkets(asset string) map[string]interface{} {
-	url := LyraHttp + "/public/get_instruments"
+// lyra publishes the top levels of orderbook.{instrument}.{group}.{depth} as a full snapshot on every message,
+// publish_id orders them
+type Lyra struct {
+	Http string
+	Wss  string
+
+	books LocalBooks
+}
+
+type lyraError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type lyraMarket struct {
+	InstrumentName string `json:"instrument_name"`
+	InstrumentType string `json:"instrument_type"`
+	IsActive       bool   `json:"is_active"`
+}
+
+type lyraInstrumentsResponse struct {
+	Result []lyraMarket `json:"result"`
+	Error  *lyraError   `json:"error"`
+}
+
+// JSON-RPC frame, subscription notifications have method "subscription" and the channel data in params
+type lyraMessage struct {
+	Method string          `json:"method"`
+	Result json.RawMessage `json:"result"`
+	Error  *lyraError      `json:"error"`
+	Params struct {
+		Channel string          `json:"channel"`
+		Data    json.RawMessage `json:"data"`
+	} `json:"params"`
+}
+
+type lyraOrderbookData struct {
+	InstrumentName string       `json:"instrument_name"`
+	PublishId      int64        `json:"publish_id"`
+	Timestamp      int64        `json:"timestamp"` //unix ms
+	Bids           []priceLevel `json:"bids"`      //[[price, amount]...]
+	Asks           []priceLevel `json:"asks"`
+}
+
+func init() {
+	registerExchange(&Lyra{Http: LyraHttp, Wss: LyraWss})
+}
+
+func (l *Lyra) Name() string {
+	return "lyra"
+}
+
+func (l *Lyra) WssUrl() string {
+	return l.Wss
+}
+
+func (l *Lyra) SetEndpoints(httpUrl string, wssUrl string) {
+	if httpUrl != "" {
+		l.Http = httpUrl
+	}
+	if wssUrl != "" {
+		l.Wss = wssUrl
+	}
+}
+
+func (l *Lyra) Instruments(asset string) ([]string, error) {
+	markets, err := lyraMarkets(l.Http, asset)
+	if err != nil {
+		return nil, err
+	}
+
+	return optionInstruments("lyra", lyraInstruments(markets)), nil
+}
+
+func (l *Lyra) OrderbookJson(instruments []string) []byte {
+	return lyraOrderbookJson(instruments)
+}
+
+func (l *Lyra) UnsubscribeJson(instruments []string) []byte {
+	return lyraChannelsJson("unsubscribe", instruments)
+}
+
+func (l *Lyra) ParseFrame(raw []byte) (*BookUpdate, error) {
+	return l.parseFrame(raw)
+}
+
+func lyraMarkets(httpUrl string, asset string) ([]lyraMarket, error) {
+	url := httpUrl + "/public/get_instruments"
 
 	payload := strings.NewReader(fmt.Sprintf("{\"expired\":false,\"instrument_type\":\"option\",\"currency\":\"%v\"}", asset))
 
@@ -28,43 +109,41 @@ func lyraMarkets(asset string) map[string]interface{} {
 
 	res, err := http.DefaultClient.Do(req)
 	if err != nil {
-		log.Fatalf("lyraMarkets: request error: %v", err)
+		return nil, fmt.Errorf("lyraMarkets: request error: %v", err)
 	}
 
 	defer res.Body.Close()
 
-	var markets map[string]interface{}
+	var markets lyraInstrumentsResponse
 
 	decoder := json.NewDecoder(res.Body)
 	err = decoder.Decode(&markets)
 	if err != nil {
-		log.Fatalf("markets json decode error: %v", err)
+		return nil, fmt.Errorf("lyraMarkets: json decode error: %v", err)
+	}
+	if markets.Error != nil {
+		return nil, fmt.Errorf("lyraMarkets: error response: %v: %v", markets.Error.Code, markets.Error.Message)
 	}
 
-	return markets
+	return markets.Result, nil
 }
 
-func lyraInstruments(markets map[string]interface{}) []string {
+func lyraInstruments(markets []lyraMarket) []string {
 	var instruments []string
-	result, ok := markets["result"].([]interface{})
-	if !ok {
-		log.Printf("lyraInstruments: unable to convert markets['result'] to []interface{}")
-		return instruments
-	}
-
-	var instrument string
-	var market map[string]interface{}
-	for _, item := range result {
-		market = item.(map[string]interface{})
-		instrument = market["instrument_name"].(string)
-
-		instruments = append(instruments, instrument)
+	for _, market := range markets {
+		if market.IsActive {
+			instruments = append(instruments, market.InstrumentName)
+		}
 	}
 
 	return instruments
 }
 
 func lyraOrderbookJson(instruments []string) []byte {
+	return lyraChannelsJson("subscribe", instruments)
+}
+
+func lyraChannelsJson(method string, instruments []string) []byte {
 	params := make(map[string][]string)
 	params["channels"] = []string{}
 
@@ -80,7 +159,7 @@ func lyraOrderbookJson(instruments []string) []byte {
 		Params map[string][]string `json:"params"`
 	}{
 		"2",
-		"subscribe",
+		method,
 		params,
 	}
 
@@ -92,106 +171,43 @@ func lyraOrderbookJson(instruments []string) []byte {
 	return jsonData
 }
 
-func lyraWssReqOrderbook(instruments []string, ctx context.Context, c *websocket.Conn) {
-	var data []byte
-	for i := 0; true; i += 20 {
-		if i+20 < len(instruments) {
-			data = lyraOrderbookJson(instruments[i : i+20])
-		} else {
-			data = lyraOrderbookJson(instruments[i:])
-		}
-
-		// fmt.Printf("subscribe: %v\n\n", string(data))
-		err := c.Write(ctx, 1, data)
-		if err != nil {
-			log.Fatalf("Write error: %v\n", err)
-		}
-
-		if i+20 > len(instruments) {
-			break
-		}
-
-		time.Sleep(100 * time.Millisecond)
-	}
-}
-
-func lyraUpdateOrderbooks(data map[string]interface{}) error {
-	lyraInstrument, ok := data["instrument_name"].(string)
-	bidsRaw, bidsOk := data["bids"].([]interface{})
-	asksRaw, asksOk := data["asks"].([]interface{})
-	if !ok || !(bidsOk || asksOk) {
-		return fmt.Errorf("lyraUpdateOrderbooks: unable to convert field: response: %+v", data)
-	}
-
-	if len(bidsRaw) <= 0 && len(asksRaw) <= 0 {
-		return fmt.Errorf("bidsRaw and asksRaw empty response")
-	}
-
-	components := strings.Split(lyraInstrument, "-")
-	strike, err := strconv.ParseFloat(components[2], 64)
+func (l *Lyra) updateBook(data lyraOrderbookData) (*BookUpdate, error) {
+	instrument, err := parseInstrument("lyra", data.InstrumentName)
 	if err != nil {
-		return fmt.Errorf("lyraUpdateOrderbooks: time.Parse error: %v", err)
+		return nil, err
 	}
-	expiryTs, err := time.Parse("20060102", components[1])
-	if err != nil {
-		return fmt.Errorf("lyraUpdateOrderbooks: time.Parse error: %v", err)
-	}
-	expiry := expiryTs.Unix()
-	optionType := components[3]
 
-	bids, bidsErr := unpackOrders(bidsRaw, strike, optionType, "lyra")
-	asks, asksErr := unpackOrders(asksRaw, strike, optionType, "lyra")
-	if bidsErr != nil && asksErr != nil {
-		return fmt.Errorf("unpackOrders error: \n%v\n%v", bidsErr, asksErr)
+	delta := bookDelta{Snapshot: true, Seq: data.PublishId, Bids: data.Bids, Asks: data.Asks}
+	bids, asks, err := l.books.Apply("lyra", data.InstrumentName, delta)
+	if err != nil {
+		return nil, err
 	}
 
-	updateOrderbook(expiry, bids, asks)
-
-	return nil
+	return bookUpdate(instrument, bids, asks), nil
 }
 
-func lyraWssRead(ctx context.Context, c *websocket.Conn) {
-	var res map[string]interface{}
-	raw, err := wssRead(ctx, c)
+func (l *Lyra) parseFrame(raw []byte) (*BookUpdate, error) {
+	var res lyraMessage
+	err := json.Unmarshal(raw, &res)
 	if err != nil {
-		log.Printf("lyraWssRead: %v\n(response): %v\n\n", err, string(raw))
-		return
+		return nil, fmt.Errorf("lyraParseFrame: error unmarshaling orderbookRaw: %v\n(response): %v", err, string(raw))
 	}
 
-	err = json.Unmarshal(raw, &res)
-	if err != nil {
-		log.Printf("lyraWssRead: error unmarshaling orderbookRaw: %v\n(response): %v\n\n", err, string(raw))
-		return
+	if res.Error != nil {
+		return nil, fmt.Errorf("lyraParseFrame: error response: %v: %v", res.Error.Code, res.Error.Message)
 	}
-
-	params, ok := res["params"].(map[string]interface{})
-	if !ok {
-		log.Printf("lyraWssRead: unable to convert res['params'] to map[string]interface{}: (raw response): %v\n\n", string(raw))
-		return
+	if res.Method != "subscription" { //subscribe acks
+		return nil, nil
 	}
-
-	data, ok := params["data"].(map[string]interface{})
-	channel, chanOk := params["channel"].(string)
-	if !ok || !chanOk {
-		log.Printf("lyraWssRead: unable to convert params['data'] to map[string]interface{} or params['channel'] to string: (raw response): %v\n dataOk: %v\nchannelOk: %v\n\n", string(raw), ok, chanOk)
-		return
+	if !strings.HasPrefix(res.Params.Channel, "orderbook.") {
+		return nil, nil
 	}
-	// fmt.Printf("%+v\n\n", res)
 
-	if strings.Contains(channel, "orderbook") {
-		lyraUpdateOrderbooks(data)
+	var data lyraOrderbookData
+	err = json.Unmarshal(res.Params.Data, &data)
+	if err != nil {
+		return nil, fmt.Errorf("lyraParseFrame: error unmarshaling orderbook: %v\n(response): %v", err, string(raw))
 	}
-}
-
-func lyraWssReqLoop(ctx context.Context, c *websocket.Conn) {
-	for {
-		markets := lyraMarkets("ETH")
-		instruments := lyraInstruments(markets)
-		fmt.Printf("Lyra number of instruments: %v\n\n", len(instruments))
 
-		lyraWssReqOrderbook(instruments, ctx, c)
-		log.Printf("Requested Lyra Orderbooks")
-
-		time.Sleep(time.Minute * 10)
-	}
+	return l.updateBook(data)
 }
@@ -1,293 +1,129 @@
 package main
 
 import (
-	"errors"
+	"context"
+	"flag"
 	"fmt"
-	"html/template"
 	"log"
 	"net/http"
-	"sort"
-	"strconv"
-	"strings"
+	"os"
 	"time"
-
-	"nhooyr.io/websocket"
 )
 
-//seperate slices for each exchange? [][]Order
-
-// orderbook data received from exchange comes in a 2d array structured: [[price, amount, IV (if applicable)]...], Order is one innermost item (array) of this array
-type Order struct {
-	Price      float64
-	Amount     float64
-	Iv         float64
-	Strike     float64
-	OptionType string
-	Exchange   string
-}
-
-type Orders struct {
-	CallBids map[string][]Order //exchange: []Order
-	CallAsks map[string][]Order
-	PutBids  map[string][]Order
-	PutAsks  map[string][]Order
-	Strike   float64
-}
+var BoxInterval = 250 * time.Millisecond //minimum time between box recomputations
+var SweepInterval = 5 * time.Second      //every box is recomputed this often so quotes older than MaxQuoteAge get evicted
 
-type Exchanges struct {
-	Aevo bool
-	Lyra bool
-}
-
-// expiry: strike: exchange: orderbook
-var Orderbooks = make(map[int64][]*Orders) //Orders sorted by strike
-
-func updateExistingOrderbook(order *Orders, bids []Order, asks []Order, exchange string, optionType string) {
-	_, callBidsExists := order.CallBids[exchange]
-	_, callAsksExists := order.CallAsks[exchange]
-	_, putBidsExists := order.PutBids[exchange]
-	_, putAsksExists := order.PutAsks[exchange]
-	if !callBidsExists || !callAsksExists || !putBidsExists || !putAsksExists {
-		order.CallBids = make(map[string][]Order)
-		order.CallAsks = make(map[string][]Order)
-		order.PutBids = make(map[string][]Order)
-		order.PutAsks = make(map[string][]Order)
-	}
+var now = time.Now //market data time, replayNow in replay mode
 
-	if optionType == "C" {
+func bookLoop(updates <-chan *BookUpdate) {
+	//applies updates from every exchange, recomputes the boxes of changed strikes at most every BoxInterval and all boxes every SweepInterval
 
-		order.CallBids[exchange] = bids
-		order.CallAsks[exchange] = asks
+	ticker := time.NewTicker(BoxInterval)
+	defer ticker.Stop()
 
-		//should only need to sort when modified
-		// bids should be sorted descending, asks ascending
-		// sorting should be unnecessary if exchange sends data correctly, but I'll sort for now anyway
-		sort.Slice(order.CallBids[exchange], func(i, j int) bool {
-			return order.CallBids[exchange][i].Price > order.CallBids[exchange][j].Price
-		})
-		sort.Slice(order.CallAsks[exchange], func(i, j int) bool {
-			return order.CallAsks[exchange][i].Price < order.CallAsks[exchange][j].Price
-		})
-	}
-	if optionType == "P" {
-		order.PutBids[exchange] = bids
-		order.PutAsks[exchange] = asks
-
-		sort.Slice(order.PutBids[exchange], func(i, j int) bool {
-			return order.PutBids[exchange][i].Price > order.PutBids[exchange][j].Price
-		})
-		sort.Slice(order.PutAsks[exchange], func(i, j int) bool {
-			return order.PutAsks[exchange][i].Price < order.PutAsks[exchange][j].Price
-		})
+	changed := make(map[ChainKey]map[float64]bool) //asset, expiry: strike: changed since last recomputation
+	lastSweep := time.Now()
+	for {
+		select {
+		case update := <-updates:
+			chain := update.Instrument.Chain()
+			Orderbooks.Update(update.Instrument, update.Bids, update.Asks)
+			if changed[chain] == nil {
+				changed[chain] = make(map[float64]bool)
+			}
+			changed[chain][update.Instrument.Strike] = true
+		case <-ticker.C:
+			if time.Since(lastSweep) >= SweepInterval {
+				updateBoxes()
+				lastSweep = time.Now()
+			} else if len(changed) > 0 {
+				updateChangedBoxes(changed)
+			}
+			clear(changed)
+		}
 	}
 }
 
-func updateOrderbook(expiry int64, bids []Order, asks []Order) {
-	_, exists := Orderbooks[expiry]
-	// remember to sort by strike
-	if !exists { //might be unnecessary
-		Orderbooks[expiry] = make([]*Orders, 0)
-	}
-
-	var strike float64
-	var exchange string
-	var optionType string
-
-	if len(bids) > 0 {
-		strike = bids[0].Strike
-		exchange = bids[0].Exchange
-		optionType = bids[0].OptionType
-	} else {
-		strike = asks[0].Strike
-		exchange = asks[0].Exchange
-		optionType = asks[0].OptionType
+func main() {
+	cfg, err := parseConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
 	}
-
-	strikeExists := false
-
-	for _, order := range Orderbooks[expiry] {
-		if order.Strike == strike {
-
-			updateExistingOrderbook(order, bids, asks, exchange, optionType)
-
-			// fmt.Printf("%+v\n\n", order)
-
-			strikeExists = true
-			break
-		}
+	if err != nil {
+		log.Fatal(err)
 	}
-
-	if !strikeExists {
-
-		strikeOrder := Orders{Strike: strike}
-		if optionType == "C" {
-			strikeOrder.CallBids = make(map[string][]Order)
-			strikeOrder.CallAsks = make(map[string][]Order)
-
-			strikeOrder.CallBids[exchange] = bids
-			strikeOrder.CallAsks[exchange] = asks
+	cfg.apply()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var supervisors []*ConnSupervisor
+	if cfg.Replay != "" {
+		now = replayNow
+		go func() {
+			err := replayRecording(ctx, cfg.Replay, cfg.ReplaySpeed)
+			if err != nil {
+				log.Printf("%v\n\n", err)
+			}
+		}()
+	} else {
+		var recorder *Recorder
+		if cfg.Record != "" {
+			recorder, err = newRecorder(cfg.Record)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer recorder.Close()
 		}
-		if optionType == "P" {
-			strikeOrder.PutBids = make(map[string][]Order)
-			strikeOrder.PutAsks = make(map[string][]Order)
 
-			strikeOrder.PutBids[exchange] = bids
-			strikeOrder.PutAsks[exchange] = asks
+		updates := make(chan *BookUpdate, 1024)
+		supervisors = connInit(ctx, cfg, recorder, updates)
+		for _, supervisor := range supervisors {
+			defer supervisor.Close()
 		}
-
-		Orderbooks[expiry] = append(Orderbooks[expiry], &strikeOrder)
-		// should only need to sort []Orders by Strike when new item is added
-		sort.Slice(Orderbooks[expiry], func(i, j int) bool {
-			return Orderbooks[expiry][i].Strike < Orderbooks[expiry][j].Strike
-		})
+		go bookLoop(updates)
 	}
-}
-
-func unpackOrders(orders []interface{}, strike float64, optionType string, exchange string) ([]Order, error) {
-	//takes unmarshaled json arrays of bids/asks and returns []Order
-	//expects orders []interface{} to unpack into 2d array of [[price, amount, IV]...]
 
-	unpackedOrders := make([]Order, 0)
-	for _, order := range orders {
-		orderArr, ok := order.([]interface{})
-
-		if !ok {
-			return unpackedOrders, errors.New("orders not of []interface{} type")
-		}
-		if exchange == "aevo" && len(orderArr) != 3 {
-			return unpackedOrders, errors.New("aevo orders not length 3")
-		}
-		if exchange == "lyra" && len(orderArr) != 2 {
-			return unpackedOrders, errors.New("lyra orders not length 2")
-		}
-
-		priceStr, priceOk := orderArr[0].(string)
-		amountStr, amountOk := orderArr[1].(string)
-		var ivStr string
-		var ivOk bool
-		if exchange == "aevo" {
-			ivStr, ivOk = orderArr[2].(string)
-		}
-		if exchange == "lyra" {
-			ivStr = "-1"
-			ivOk = true
-		}
-		if !priceOk || !amountOk || !ivOk {
-			return unpackedOrders, errors.New("unable to convert interface{} element to string")
-		}
-
-		price, priceErr := strconv.ParseFloat(priceStr, 64)
-		amount, amountErr := strconv.ParseFloat(amountStr, 64)
-		iv, ivErr := strconv.ParseFloat(ivStr, 64)
-		if priceErr != nil || amountErr != nil || ivErr != nil {
-			log.Printf("%v\n", priceErr)
-			log.Printf("%v\n", amountErr)
-			log.Printf("%v\n", ivErr)
-			return unpackedOrders, errors.New("error converting string to float64")
-		}
-
-		unpackedOrders = append(unpackedOrders, Order{price, amount, iv, strike, optionType, exchange})
+	http.HandleFunc("/", homeHandler(cfg))
+	http.HandleFunc("/update-table", boxTableHandler)
+	http.HandleFunc("/expiry-options", expiryOptionsHandler)
+	http.HandleFunc("/box", boxDetailHandler)
+	http.HandleFunc("/box/detail", boxDetailHandler)
+	http.HandleFunc("GET /paper", paperHandler)
+	http.HandleFunc("GET /paper/tables", paperHandler)
+	http.HandleFunc("POST /paper/trades", paperSubmitHandler)
+	http.Handle("/static/", staticHandler())
+	registerApiHandlers(http.DefaultServeMux, supervisors)
+	registerStreamHandlers(http.DefaultServeMux)
+	paperExecutors := make(map[string]LegExecutor)
+	for _, name := range cfg.Exchanges {
+		paperExecutors[name] = &Paper
 	}
-
-	return unpackedOrders, nil
-}
-
-func mainEventLoop(exchanges Exchanges, connections map[string]ConnData) {
-	for {
-		if exchanges.Aevo {
-			aevoWssRead(connections["aevo"].Ctx, connections["aevo"].Conn)
+	registerExecutionHandlers(http.DefaultServeMux, newLegRiskController("paper", paperExecutors))
+	if cfg.AevoExecution.Enabled {
+		executor, err := newAevoExecutor(cfg.AevoExecution)
+		if err != nil {
+			log.Fatal(err)
 		}
-		if exchanges.Lyra {
-			lyraWssRead(connections["lyra"].Ctx, connections["lyra"].Conn)
+		go executor.Run(ctx)
+
+		//live endpoints place real orders, they are kept off the public mux unless they require a token
+		liveMux := http.NewServeMux()
+		registerLiveHandlers(liveMux, executor)
+		registerExecutionHandlers(liveMux, newLegRiskController("live", map[string]LegExecutor{"aevo": executor}))
+		var live http.Handler = liveMux
+		if cfg.AevoExecution.AuthToken != "" {
+			live = requireToken(cfg.AevoExecution.AuthToken, liveMux)
+		}
+		if cfg.AevoExecution.Listen != "" {
+			go func() {
+				fmt.Printf("Live execution endpoints on %v...\n", cfg.AevoExecution.Listen)
+				log.Fatal(http.ListenAndServe(cfg.AevoExecution.Listen, live))
+			}()
+		} else {
+			http.Handle("/api/live/", live)
 		}
-		updateBoxes()
-	}
-}
-
-func serveHome(w http.ResponseWriter, r *http.Request) {
-	tmpl := template.Must(template.ParseFiles("templates/index.html"))
-	tmpl.Execute(w, nil)
-}
-
-func boxTableHandler(w http.ResponseWriter, r *http.Request) {
-	BoxContainer.Mu.Lock()
-	defer BoxContainer.Mu.Unlock()
-	boxTablesSlice := make([]*Box, len(BoxContainer.Boxes)) //converting to slice to sort by apy
-	keySlice := make([]BoxKey, len(BoxContainer.Boxes))
-	i := 0
-	for key, table := range BoxContainer.Boxes {
-		keySlice[i] = key
-		boxTablesSlice[i] = table
-		i++
-	}
-	sort.Slice(boxTablesSlice, func(i, j int) bool { return boxTablesSlice[i].Apy > boxTablesSlice[j].Apy })
-
-	responseStr := ""
-	for i, value := range boxTablesSlice {
-		expiryUnix := time.Unix(keySlice[i].Expiry, 0)
-		expiry := strings.ToUpper(expiryUnix.Format("02Jan06 15:04:05"))
-
-		responseStr += fmt.Sprintf(
-			`<tr>
-			<td>%s</td>
-			<td>%s</td>
-			<td>%s</td>
-			<td>%s</td>
-			<td>%s</td>
-			<td>%s</td>
-			<td>%s</td>
-			<td>%s</td>
-			<td>%s</td>
-			<td>%s</td>
-			<td>%s</td>
-			<td>%s</td>
-			<td>%s</td>
-			<td>%s</td>
-			<td>%s</td>
-			<td>%s</td>
-			<td>%s</td>
-			</tr>`,
-			expiry,
-			strconv.FormatFloat(keySlice[i].K1, 'f', 3, 64),
-			strconv.FormatFloat(keySlice[i].K2, 'f', 3, 64),
-			value.ShortCallBids[0].Exchange,
-			strconv.FormatFloat(value.ShortCallBids[0].Price, 'f', 3, 64),
-			value.LongCallAsks[0].Exchange,
-			strconv.FormatFloat(value.LongCallAsks[0].Price, 'f', 3, 64),
-			value.ShortPutBids[0].Exchange,
-			strconv.FormatFloat(value.ShortPutBids[0].Price, 'f', 3, 64),
-			value.LongPutAsks[0].Exchange,
-			strconv.FormatFloat(value.LongPutAsks[0].Price, 'f', 3, 64),
-			strconv.FormatFloat(value.Cost, 'f', 3, 64),
-			strconv.FormatFloat(value.Payoff, 'f', 3, 64),
-			strconv.FormatFloat(value.Amount, 'f', 3, 64),
-			strconv.FormatFloat(value.Profit, 'f', 3, 64),
-			strconv.FormatFloat(value.RelProfit*100, 'f', 3, 64),
-			strconv.FormatFloat(value.Apy, 'f', 3, 64),
-		)
-	}
-
-	fmt.Fprint(w, responseStr)
-}
-
-func main() {
-	exchanges := Exchanges{Aevo: true, Lyra: false}
-	connections := connInit(exchanges)
-	if exchanges.Aevo {
-		defer connections["aevo"].Cancel()
-		defer connections["aevo"].Conn.Close(websocket.StatusNormalClosure, "")
-		defer connections["aevo"].Conn.CloseNow()
-	}
-	if exchanges.Lyra {
-		defer connections["lyra"].Cancel()
-		defer connections["lyra"].Conn.Close(websocket.StatusNormalClosure, "")
-		defer connections["lyra"].Conn.CloseNow()
 	}
-
-	go mainEventLoop(exchanges, connections)
-
-	http.HandleFunc("/", serveHome)
-	http.HandleFunc("/update-table", boxTableHandler)
-	fmt.Println("Server starting on http://localhost:8081...")
-	log.Fatal(http.ListenAndServe(":8081", nil))
+	fmt.Printf("Server starting on %v...\n", cfg.Listen)
+	log.Fatal(http.ListenAndServe(cfg.Listen, nil))
 }
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"testing"
+	"time"
+)
+
+// testNow is the market data clock of the tests, fixtures quote 31DEC27 chains so they stay unexpired whatever the date
+var testNow = time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+
+func TestMain(m *testing.M) {
+	now = func() time.Time { return testNow }
+
+	os.Exit(m.Run())
+}
+
+// resetState replaces the global books, boxes and box history, tests using them must not run in parallel
+func resetState(tb testing.TB) {
+	tb.Helper()
+
+	Orderbooks = OrderbookStore{books: make(map[ChainKey][]*Orders), stale: make(map[string]bool)}
+	BoxContainer = BoxesContainer{Boxes: make(map[BoxKey]*Box)}
+	BoxHistory = BoxHistoryStore{histories: make(map[BoxKey]*profitHistory)}
+}
+
+// readFrames reads a testdata file of one raw websocket frame per line
+func readFrames(t *testing.T, path string) [][]byte {
+	t.Helper()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var frames [][]byte
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) > 0 {
+			frames = append(frames, append([]byte(nil), scanner.Bytes()...))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return frames
+}
+
+func almostEqual(a float64, b float64) bool {
+	diff := a - b
+	return diff < 1e-9 && diff > -1e-9
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// orderbook data received from exchange comes in a 2d array structured: [[price, amount, IV (if applicable)]...], Order is one innermost item (array) of this array
+type Order struct {
+	Asset      string
+	Price      float64
+	Amount     float64
+	Iv         float64
+	Strike     float64
+	OptionType string
+	Exchange   string
+	Timestamp  time.Time //receive time of the frame the order came from
+}
+
+// books of every venue at one strike, each (venue, option type, side) is replaced independently by Update
+type Orders struct {
+	CallBids map[string][]Order //exchange: []Order
+	CallAsks map[string][]Order
+	PutBids  map[string][]Order
+	PutAsks  map[string][]Order
+	Strike   float64
+}
+
+// orderbooks of one underlying asset and expiry
+type ChainKey struct {
+	Asset  string
+	Expiry int64
+}
+
+// owns all orderbook state, every read and write goes through its methods so exchanges' reader goroutines,
+// bookLoop and HTTP handlers can use it concurrently
+type OrderbookStore struct {
+	mu      sync.RWMutex
+	books   map[ChainKey][]*Orders // asset, expiry: strike: exchange: orderbook, Orders sorted by strike
+	stale   map[string]bool        // exchange: disconnected, left out of snapshots
+	cleared map[string]time.Time   // exchange: last ClearVenue, updates of levels received before are ignored
+}
+
+var Orderbooks = OrderbookStore{books: make(map[ChainKey][]*Orders), stale: make(map[string]bool)}
+
+func newOrders(strike float64) *Orders {
+	return &Orders{
+		CallBids: make(map[string][]Order),
+		CallAsks: make(map[string][]Order),
+		PutBids:  make(map[string][]Order),
+		PutAsks:  make(map[string][]Order),
+		Strike:   strike,
+	}
+}
+
+// sides returns the bid and ask maps of optionType
+func (o *Orders) sides(optionType string) (map[string][]Order, map[string][]Order) {
+	if optionType == Call {
+		return o.CallBids, o.CallAsks
+	}
+
+	return o.PutBids, o.PutAsks
+}
+
+// Update replaces the bids and asks of one instrument on its venue, the other option type and the books of other venues
+// at the strike are left untouched. Empty bids or asks clear that side of the venue
+func (s *OrderbookStore) Update(instrument Instrument, bids []Order, asks []Order) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, orders := range [][]Order{bids, asks} {
+		if len(orders) > 0 && orders[0].Timestamp.Before(s.cleared[instrument.Venue]) {
+			return //still queued when the venue's books were cleared
+		}
+	}
+
+	chain := instrument.Chain()
+	strikes := s.books[chain]
+	i := sort.Search(len(strikes), func(i int) bool { return strikes[i].Strike >= instrument.Strike })
+	if i == len(strikes) || strikes[i].Strike != instrument.Strike {
+		strikes = append(strikes, nil)
+		copy(strikes[i+1:], strikes[i:])
+		strikes[i] = newOrders(instrument.Strike)
+		s.books[chain] = strikes
+	}
+
+	bookBids, bookAsks := strikes[i].sides(instrument.Type)
+	setSide(bookBids, instrument.Venue, bids, func(a, b Order) bool { return a.Price > b.Price })
+	setSide(bookAsks, instrument.Venue, asks, func(a, b Order) bool { return a.Price < b.Price })
+}
+
+func setSide(book map[string][]Order, venue string, orders []Order, less func(a, b Order) bool) {
+	if len(orders) == 0 {
+		delete(book, venue)
+		return
+	}
+
+	// sorting should be unnecessary if exchange sends data correctly, but I'll sort for now anyway
+	sort.SliceStable(orders, func(i, j int) bool { return less(orders[i], orders[j]) })
+	book[venue] = orders
+}
+
+// SetStale marks every book of exchange as stale (disconnected) or live
+func (s *OrderbookStore) SetStale(exchange string, stale bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stale[exchange] = stale
+}
+
+// ClearVenue drops every book of exchange, its levels come back with the snapshots after it reconnects. updates of
+// levels received before t are ignored, they may still be queued from before the disconnect
+func (s *OrderbookStore) ClearVenue(exchange string, t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, strikes := range s.books {
+		for _, orders := range strikes {
+			for _, book := range []map[string][]Order{orders.CallBids, orders.CallAsks, orders.PutBids, orders.PutAsks} {
+				delete(book, exchange)
+			}
+		}
+	}
+	if s.cleared == nil {
+		s.cleared = make(map[string]time.Time)
+	}
+	s.cleared[exchange] = t
+}
+
+// EvictExpired drops the books of every chain that settled at or before t and returns their keys
+func (s *OrderbookStore) EvictExpired(t time.Time) map[ChainKey]bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expired := make(map[ChainKey]bool)
+	for chain := range s.books {
+		if chain.Expiry <= t.Unix() {
+			expired[chain] = true
+			delete(s.books, chain)
+		}
+	}
+
+	return expired
+}
+
+// Snapshot returns a deep copy of every orderbook without the books of stale exchanges, safe to read without holding any lock
+func (s *OrderbookStore) Snapshot() map[ChainKey][]*Orders {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	snapshot := make(map[ChainKey][]*Orders, len(s.books))
+	for chain, strikes := range s.books {
+		snapshot[chain] = s.copyStrikes(strikes)
+	}
+
+	return snapshot
+}
+
+// Chain returns a deep copy of the orderbooks of one asset and expiry sorted by strike, without the books of stale exchanges
+func (s *OrderbookStore) Chain(chain ChainKey) []*Orders {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.copyStrikes(s.books[chain])
+}
+
+func (s *OrderbookStore) copyStrikes(strikes []*Orders) []*Orders {
+	copied := make([]*Orders, len(strikes))
+	for i, order := range strikes {
+		copied[i] = &Orders{
+			CallBids: s.copyBook(order.CallBids),
+			CallAsks: s.copyBook(order.CallAsks),
+			PutBids:  s.copyBook(order.PutBids),
+			PutAsks:  s.copyBook(order.PutAsks),
+			Strike:   order.Strike,
+		}
+	}
+
+	return copied
+}
+
+func (s *OrderbookStore) copyBook(book map[string][]Order) map[string][]Order {
+	if book == nil {
+		return nil
+	}
+
+	copied := make(map[string][]Order, len(book))
+	for exchange, orders := range book {
+		if s.stale[exchange] {
+			continue
+		}
+		copied[exchange] = append([]Order(nil), orders...)
+	}
+
+	return copied
+}
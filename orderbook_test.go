@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// run with go test -race, writers of several exchanges update the same strikes while readers take snapshots
+func TestOrderbookStoreConcurrent(t *testing.T) {
+	store := OrderbookStore{books: make(map[ChainKey][]*Orders), stale: make(map[string]bool)}
+	chain := ChainKey{"ETH", 1798704000}
+	exchanges := []string{"aevo", "deribit", "lyra"}
+	const updates = 200
+
+	var wg sync.WaitGroup
+	for _, exchange := range exchanges {
+		wg.Add(1)
+		go func(exchange string) {
+			defer wg.Done()
+			for i := 0; i < updates; i++ {
+				instrument := Instrument{Asset: chain.Asset, Expiry: chain.Expiry, Strike: float64(2000 + 100*(i%10)), Type: Call, Venue: exchange}
+				if (i/10)%2 == 1 {
+					instrument.Type = Put
+				}
+				order := Order{Asset: chain.Asset, Price: float64(i), Amount: 1, Strike: instrument.Strike, OptionType: instrument.Type, Exchange: exchange}
+				store.Update(instrument, []Order{order}, []Order{order})
+				if i%50 == 0 {
+					store.SetStale(exchange, i%100 == 0)
+				}
+			}
+			store.SetStale(exchange, false)
+		}(exchange)
+	}
+
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				case <-time.After(100 * time.Microsecond):
+				}
+				for _, strikes := range store.Snapshot() {
+					for _, orders := range strikes {
+						for _, book := range []map[string][]Order{orders.CallBids, orders.CallAsks, orders.PutBids, orders.PutAsks} {
+							for _, levels := range book {
+								_ = levels[0].Price
+							}
+						}
+					}
+				}
+				strikes := store.Chain(chain)
+				for i := 1; i < len(strikes); i++ {
+					if strikes[i-1].Strike >= strikes[i].Strike {
+						panic(fmt.Sprintf("strikes not sorted: %v before %v", strikes[i-1].Strike, strikes[i].Strike))
+					}
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(done)
+	readers.Wait()
+
+	strikes := store.Chain(chain)
+	if len(strikes) != 10 {
+		t.Fatalf("got %v strikes, want 10", len(strikes))
+	}
+	for _, orders := range strikes {
+		for _, exchange := range exchanges {
+			if len(orders.CallBids[exchange]) != 1 || len(orders.PutAsks[exchange]) != 1 {
+				t.Errorf("strike %v: %v calls or puts missing", orders.Strike, exchange)
+			}
+		}
+	}
+}
+
+func TestOrderbookStoreSnapshotIsCopy(t *testing.T) {
+	store := OrderbookStore{books: make(map[ChainKey][]*Orders), stale: make(map[string]bool)}
+	instrument := Instrument{Asset: "ETH", Expiry: 1798704000, Strike: 2000, Type: Call, Venue: "aevo"}
+	store.Update(instrument, []Order{{Price: 10, Amount: 1, Exchange: "aevo", Timestamp: now()}}, nil)
+
+	snapshot := store.Snapshot()
+	snapshot[instrument.Chain()][0].CallBids["aevo"][0].Price = 99
+
+	if price := store.Chain(instrument.Chain())[0].CallBids["aevo"][0].Price; price != 10 {
+		t.Errorf("snapshot write changed the store: price %v", price)
+	}
+
+	store.SetStale("aevo", true)
+	if bids := store.Chain(instrument.Chain())[0].CallBids; len(bids) != 0 {
+		t.Errorf("stale exchange in snapshot: %v", bids)
+	}
+}
+
+// formatStrike formats the top price of every venue on each side of orders, sides in the order call bids, call asks,
+// put bids, put asks
+func formatStrike(orders *Orders) string {
+	var sides []string
+	for _, book := range []map[string][]Order{orders.CallBids, orders.CallAsks, orders.PutBids, orders.PutAsks} {
+		venues := make([]string, 0, len(book))
+		for venue, levels := range book {
+			venues = append(venues, fmt.Sprintf("%v:%v", venue, levels[0].Price))
+		}
+		sort.Strings(venues)
+		sides = append(sides, strings.Join(venues, " "))
+	}
+
+	return fmt.Sprintf("%v %v", orders.Strike, strings.Join(sides, " | "))
+}
+
+func TestOrderbookStoreInterleavedVenues(t *testing.T) {
+	store := OrderbookStore{books: make(map[ChainKey][]*Orders), stale: make(map[string]bool)}
+	chain := ChainKey{"ETH", 1798704000}
+	quote := func(price float64) []Order { return []Order{{Price: price, Amount: 1}} }
+
+	steps := []struct {
+		name       string
+		venue      string
+		strike     float64
+		optionType string
+		bids, asks []Order
+		want       []string //every strike of the chain after the step
+	}{
+		{"call creates the strike", "aevo", 2000, Call, quote(10), quote(11), []string{"2000 aevo:10 | aevo:11 |  | "}},
+		{"put of another venue keeps the calls", "deribit", 2000, Put, quote(20), quote(21), []string{"2000 aevo:10 | aevo:11 | deribit:20 | deribit:21"}},
+		{"call of another venue", "lyra", 2000, Call, quote(12), quote(13), []string{"2000 aevo:10 lyra:12 | aevo:11 lyra:13 | deribit:20 | deribit:21"}},
+		{"put of the first venue", "aevo", 2000, Put, quote(19), nil, []string{"2000 aevo:10 lyra:12 | aevo:11 lyra:13 | aevo:19 deribit:20 | deribit:21"}},
+		{"lower strike inserted first", "deribit", 1900, Call, nil, quote(30), []string{"1900  | deribit:30 |  | ", "2000 aevo:10 lyra:12 | aevo:11 lyra:13 | aevo:19 deribit:20 | deribit:21"}},
+		{"replace one venue's call", "aevo", 2000, Call, quote(9), quote(11.5), []string{"1900  | deribit:30 |  | ", "2000 aevo:9 lyra:12 | aevo:11.5 lyra:13 | aevo:19 deribit:20 | deribit:21"}},
+		{"empty asks clear that side only", "lyra", 2000, Call, quote(12), nil, []string{"1900  | deribit:30 |  | ", "2000 aevo:9 lyra:12 | aevo:11.5 | aevo:19 deribit:20 | deribit:21"}},
+		{"empty book clears the venue's put", "deribit", 2000, Put, nil, nil, []string{"1900  | deribit:30 |  | ", "2000 aevo:9 lyra:12 | aevo:11.5 | aevo:19 | "}},
+		{"higher strike appended", "lyra", 2100, Put, quote(40), quote(41), []string{"1900  | deribit:30 |  | ", "2000 aevo:9 lyra:12 | aevo:11.5 | aevo:19 | ", "2100  |  | lyra:40 | lyra:41"}},
+	}
+	for _, step := range steps {
+		instrument := Instrument{Asset: chain.Asset, Expiry: chain.Expiry, Strike: step.strike, Type: step.optionType, Venue: step.venue}
+		store.Update(instrument, append([]Order(nil), step.bids...), append([]Order(nil), step.asks...))
+
+		strikes := store.Chain(chain)
+		got := make([]string, len(strikes))
+		for i, orders := range strikes {
+			got[i] = formatStrike(orders)
+			if orders.CallBids == nil || orders.CallAsks == nil || orders.PutBids == nil || orders.PutAsks == nil {
+				t.Errorf("%v: strike %v has a nil side", step.name, orders.Strike)
+			}
+		}
+		if strings.Join(got, "\n") != strings.Join(step.want, "\n") {
+			t.Errorf("%v:\ngot\n%v\nwant\n%v", step.name, strings.Join(got, "\n"), strings.Join(step.want, "\n"))
+		}
+	}
+}
+
+func TestOrderbookStoreClearVenue(t *testing.T) {
+	store := OrderbookStore{books: make(map[ChainKey][]*Orders), stale: make(map[string]bool)}
+	chain := ChainKey{"ETH", 1798704000}
+	disconnect := time.Unix(1700000000, 0)
+	quote := func(venue string, price float64, received time.Time) []Order {
+		return []Order{{Price: price, Amount: 1, Exchange: venue, Timestamp: received}}
+	}
+	update := func(venue string, optionType string, price float64, received time.Time) {
+		instrument := Instrument{Asset: chain.Asset, Expiry: chain.Expiry, Strike: 2000, Type: optionType, Venue: venue}
+		store.Update(instrument, quote(venue, price, received), quote(venue, price+1, received))
+	}
+
+	update("aevo", Call, 10, disconnect.Add(-time.Second))
+	update("aevo", Put, 20, disconnect.Add(-time.Second))
+	update("deribit", Call, 11, disconnect.Add(-time.Second))
+	store.ClearVenue("aevo", disconnect)
+	if got := formatStrike(store.Chain(chain)[0]); got != "2000 deribit:11 | deribit:12 |  | " {
+		t.Errorf("after clear: got %v, want only deribit's call", got)
+	}
+
+	update("aevo", Call, 9, disconnect.Add(-time.Millisecond)) //queued before the disconnect
+	if got := formatStrike(store.Chain(chain)[0]); got != "2000 deribit:11 | deribit:12 |  | " {
+		t.Errorf("update received before the clear: got %v, want it ignored", got)
+	}
+
+	update("aevo", Put, 21, disconnect.Add(time.Second)) //snapshot after the reconnect
+	if got := formatStrike(store.Chain(chain)[0]); got != "2000 deribit:11 | deribit:12 | aevo:21 | aevo:22" {
+		t.Errorf("snapshot after the clear: got %v, want aevo's put back", got)
+	}
+}
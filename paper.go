@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+var PaperLatency = 200 * time.Millisecond //time between submitting a paper trade and its leg orders reaching the books
+var PaperFillRatio = 1.0                  //fraction of each level's amount a paper order fills, < 1 models other takers and queue position
+
+const Buy = "buy"
+const Sell = "sell"
+
+// status of a PaperTrade
+const PaperPending = "pending"   //waiting for PaperLatency
+const PaperFilled = "filled"     //every leg filled completely
+const PaperPartial = "partial"   //some legs filled partially or not at all, the unpaired fills are left as open positions
+const PaperUnfilled = "unfilled" //no leg filled
+
+// kind of a PaperCashFlow
+const PaperPremium = "premium"
+const PaperFee = "fee"
+
+// one simulated fill of a leg order against a level of Orderbooks
+type paperFill struct {
+	Exchange string
+	Price    float64
+	Amount   float64
+	Fee      float64 //total taker fee of the fill
+}
+
+// one leg of a paper trade, an IOC limit order for Amount contracts taken from every fresh exchange
+type paperLeg struct {
+	Instrument Instrument //Venue is empty, fills carry their exchange
+	Side       string     //Buy or Sell
+	Limit      float64    //worst price of the leg's levels the box needed at submission
+	Amount     float64
+	Fills      []paperFill
+}
+
+func (l *paperLeg) filled() (float64, float64, float64) {
+	//returns filled amount, average price and total fees
+	amount, notional, fees := 0.0, 0.0, 0.0
+	for _, fill := range l.Fills {
+		amount += fill.Amount
+		notional += fill.Amount * fill.Price
+		fees += fill.Fee
+	}
+	if amount == 0 {
+		return 0, 0, 0
+	}
+
+	return amount, notional / amount, fees
+}
+
+// PaperTrade is one simulated execution of Size boxes, legs are in the order of Box: short call, long call, short put, long put
+type PaperTrade struct {
+	Id             int
+	Key            BoxKey
+	Size           float64 //requested size capped at the depth the box was detected for at submission
+	Spot           float64 //implied spot at submission, used for fees
+	Submitted      time.Time
+	Executed       time.Time
+	Status         string
+	Legs           [4]paperLeg
+	ExpectedProfit float64 //net profit of Size boxes walking the depth at submission
+	Boxes          float64 //complete boxes, the smallest filled amount of the four legs
+	RealizedProfit float64 //net profit of the complete boxes at their fill prices, including settlement fees
+}
+
+func (t *PaperTrade) copy() *PaperTrade {
+	copied := *t
+	for i := range copied.Legs {
+		copied.Legs[i].Fills = append([]paperFill(nil), t.Legs[i].Fills...)
+	}
+
+	return &copied
+}
+
+// net open contracts of one instrument on one exchange
+type PaperPosition struct {
+	Instrument Instrument
+	Amount     float64 //positive long, negative short
+}
+
+// premium paid or received, or a fee, of one fill
+type PaperCashFlow struct {
+	Time     time.Time
+	TradeId  int
+	Exchange string
+	Name     string  //leg instrument, e.g. ETH 2000 C
+	Kind     string  //PaperPremium or PaperFee
+	Amount   float64 //positive received, negative paid
+}
+
+// PaperEngine simulates box trades against Orderbooks and keeps the resulting positions and cash flows. Fills don't
+// consume the displayed levels, so concurrent paper trades can fill against the same liquidity
+type PaperEngine struct {
+	mu        sync.Mutex
+	trades    []*PaperTrade
+	positions map[Instrument]float64
+	cashFlows []PaperCashFlow
+}
+
+var Paper = PaperEngine{positions: make(map[Instrument]float64)}
+
+func boxSpot(box *Box) float64 {
+	k1Call, _, k1Put, _ := strikeLegs(box.Key.Direction, box.ShortCallBids[0], box.LongCallAsks[0], box.ShortPutBids[0], box.LongPutAsks[0])
+
+	return impliedSpot(box.Key.K1, k1Call.Price, k1Put.Price)
+}
+
+func legLimit(levels []Order, size float64) float64 {
+	//price of the level at which size contracts of the leg are taken
+	total := 0.0
+	for _, level := range levels {
+		total += level.Amount
+		if total >= size {
+			return level.Price
+		}
+	}
+
+	return levels[len(levels)-1].Price
+}
+
+// Submit paper trades size boxes of key at the current quotes, its legs are executed after PaperLatency
+func (e *PaperEngine) Submit(key BoxKey, size float64) (*PaperTrade, error) {
+	if !(size > 0) || math.IsInf(size, 1) {
+		return nil, fmt.Errorf("Submit: size must be positive, got %v", size)
+	}
+
+	BoxContainer.Mu.Lock()
+	box, ok := BoxContainer.Boxes[key]
+	BoxContainer.Mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("Submit: no %v box %v %v %v/%v", key.Direction, key.Asset, key.Expiry, key.K1, key.K2)
+	}
+
+	spot := boxSpot(box)
+	size, _, expected := walkBox(key.Direction, key.Expiry, box.Payoff, spot, size, box.ShortCallBids, box.LongCallAsks, box.ShortPutBids, box.LongPutAsks)
+	if size <= 0 {
+		return nil, fmt.Errorf("Submit: box %v %v %v/%v is no longer detected", key.Asset, key.Expiry, key.K1, key.K2)
+	}
+
+	soldStrike, boughtStrike := key.K2, key.K1 //strikes of the sold call and bought call, as in updateBoxDirection
+	if key.Direction == BoxShort {
+		soldStrike, boughtStrike = boughtStrike, soldStrike
+	}
+	instrument := func(strike float64, optionType string) Instrument {
+		return Instrument{Asset: key.Asset, Expiry: key.Expiry, Strike: strike, Type: optionType}
+	}
+
+	trade := &PaperTrade{
+		Key:       key,
+		Size:      size,
+		Spot:      spot,
+		Submitted: now(),
+		Status:    PaperPending,
+		Legs: [4]paperLeg{
+			{instrument(soldStrike, Call), Sell, legLimit(box.ShortCallBids, size), size, nil},
+			{instrument(boughtStrike, Call), Buy, legLimit(box.LongCallAsks, size), size, nil},
+			{instrument(boughtStrike, Put), Sell, legLimit(box.ShortPutBids, size), size, nil},
+			{instrument(soldStrike, Put), Buy, legLimit(box.LongPutAsks, size), size, nil},
+		},
+		ExpectedProfit: expected,
+	}
+
+	e.mu.Lock()
+	trade.Id = len(e.trades) + 1
+	e.trades = append(e.trades, trade)
+	submitted := trade.copy()
+	e.mu.Unlock()
+
+	time.AfterFunc(PaperLatency, func() { e.execute(trade) })
+
+	return submitted, nil
+}
+
+// fillLeg takes the fresh levels of leg's instrument within its limit, each at most PaperFillRatio of its amount. levels
+// of every exchange are taken unless the instrument's Venue is set
+func fillLeg(leg paperLeg, spot float64) []paperFill {
+	var orders *Orders
+	for _, strike := range Orderbooks.Chain(leg.Instrument.Chain()) {
+		if strike.Strike == leg.Instrument.Strike {
+			orders = strike
+		}
+	}
+	if orders == nil {
+		return nil
+	}
+
+	bids, asks := orders.sides(leg.Instrument.Type)
+	var levels []Order
+	if leg.Side == Sell {
+		levels, _ = mergeBids(bids)
+	} else {
+		levels, _ = mergeAsks(asks)
+	}
+	if leg.Instrument.Venue != "" {
+		levels = venueLevels(levels, leg.Instrument.Venue)
+	}
+
+	var fills []paperFill
+	remaining := leg.Amount
+	for _, level := range levels {
+		if remaining <= 0 || (leg.Side == Sell && level.Price < leg.Limit) || (leg.Side == Buy && level.Price > leg.Limit) {
+			break
+		}
+		amount := math.Min(remaining, level.Amount*PaperFillRatio)
+		if amount <= 0 {
+			continue
+		}
+		fills = append(fills, paperFill{level.Exchange, level.Price, amount, takerFee(level, spot) * amount})
+		remaining -= amount
+	}
+
+	return fills
+}
+
+func (e *PaperEngine) execute(trade *PaperTrade) {
+	//levels are read before taking e.mu, Orderbooks and BoxContainer are never locked while holding it
+	var fills [4][]paperFill
+	for i, leg := range trade.Legs {
+		fills[i] = fillLeg(leg, trade.Spot)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	trade.Executed = now()
+	for i := range trade.Legs {
+		leg := &trade.Legs[i]
+		leg.Fills = fills[i]
+		e.record(trade.Executed, trade.Id, *leg)
+	}
+
+	trade.Boxes, trade.RealizedProfit = realizedProfit(trade)
+	filled := 0
+	for i := range trade.Legs {
+		if amount, _, _ := trade.Legs[i].filled(); amount > 0 {
+			filled++
+		}
+	}
+	switch {
+	case filled == 0:
+		trade.Status = PaperUnfilled
+	case trade.Boxes >= trade.Size:
+		trade.Status = PaperFilled
+	default:
+		trade.Status = PaperPartial
+	}
+}
+
+func (e *PaperEngine) record(executed time.Time, tradeId int, leg paperLeg) {
+	//books leg's fills into positions and cash flows, e.mu must be held
+	sign := 1.0
+	if leg.Side == Sell {
+		sign = -1
+	}
+	for _, fill := range leg.Fills {
+		instrument := leg.Instrument
+		instrument.Venue = fill.Exchange
+		e.positions[instrument] += sign * fill.Amount
+		if e.positions[instrument] == 0 {
+			delete(e.positions, instrument)
+		}
+
+		name := fmt.Sprintf("%v %v %v", instrument.Asset, formatFloat(instrument.Strike), instrument.Type)
+		e.cashFlows = append(e.cashFlows,
+			PaperCashFlow{executed, tradeId, fill.Exchange, name, PaperPremium, -sign * fill.Amount * fill.Price},
+			PaperCashFlow{executed, tradeId, fill.Exchange, name, PaperFee, -fill.Fee},
+		)
+	}
+}
+
+// ExecuteLeg simulates an IOC order of one leg after PaperLatency, for the LegRiskController. its fills are booked into
+// positions and cash flows with trade id 0
+func (e *PaperEngine) ExecuteLeg(ctx context.Context, order LegOrder) (LegFill, error) {
+	select {
+	case <-ctx.Done():
+		return LegFill{}, ctx.Err()
+	case <-time.After(PaperLatency):
+	}
+
+	leg := paperLeg{Instrument: order.Instrument, Side: order.Side, Limit: order.Limit, Amount: order.Amount}
+	leg.Fills = fillLeg(leg, order.Spot)
+
+	e.mu.Lock()
+	e.record(now(), 0, leg)
+	e.mu.Unlock()
+
+	filled, avg, fees := leg.filled()
+
+	return LegFill{filled, avg, fees}, nil
+}
+
+func realizedProfit(trade *PaperTrade) (float64, float64) {
+	//complete boxes and their net profit held to expiry, each leg's average price and fees pro rata to the boxes
+	boxes := math.Inf(1)
+	var legOrders [4]Order
+	for i := range trade.Legs {
+		amount, price, _ := trade.Legs[i].filled()
+		boxes = math.Min(boxes, amount)
+		if amount > 0 {
+			legOrders[i] = Order{Price: price, Exchange: trade.Legs[i].Fills[0].Exchange}
+		}
+	}
+	if boxes <= 0 {
+		return 0, 0
+	}
+
+	payoff := trade.Key.K2 - trade.Key.K1
+	price := directionSign(trade.Key.Direction) * (legOrders[1].Price - legOrders[0].Price + legOrders[3].Price - legOrders[2].Price)
+	fees := 0.0
+	for i := range trade.Legs {
+		amount, _, legFees := trade.Legs[i].filled()
+		fees += legFees / amount
+	}
+	k1Call, k2Call, k1Put, k2Put := strikeLegs(trade.Key.Direction, legOrders[0], legOrders[1], legOrders[2], legOrders[3])
+	fees += boxSettlementFee(payoff, trade.Spot, k1Call, k2Call, k1Put, k2Put)
+
+	return boxes, boxes * (directionSign(trade.Key.Direction)*(payoff-price) - fees)
+}
+
+// Trades returns copies of every paper trade, newest first
+func (e *PaperEngine) Trades() []*PaperTrade {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	trades := make([]*PaperTrade, len(e.trades))
+	for i, trade := range e.trades {
+		trades[len(trades)-1-i] = trade.copy()
+	}
+
+	return trades
+}
+
+// Positions returns the open positions and every cash flow, oldest first
+func (e *PaperEngine) Positions() ([]PaperPosition, []PaperCashFlow) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	positions := make([]PaperPosition, 0, len(e.positions))
+	for instrument, amount := range e.positions {
+		positions = append(positions, PaperPosition{instrument, amount})
+	}
+	sort.Slice(positions, func(i, j int) bool {
+		a, b := positions[i].Instrument, positions[j].Instrument
+		if a.Asset != b.Asset {
+			return a.Asset < b.Asset
+		}
+		if a.Expiry != b.Expiry {
+			return a.Expiry < b.Expiry
+		}
+		if a.Strike != b.Strike {
+			return a.Strike < b.Strike
+		}
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		return a.Venue < b.Venue
+	})
+
+	return positions, append([]PaperCashFlow(nil), e.cashFlows...)
+}
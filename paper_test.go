@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// seedPaperBooks quotes the legs of the long 2000/2100 box of chain on venue, levels as price, amount pairs
+func seedPaperBooks(chain ChainKey, venue string, received time.Time, callBids2100 []float64, callAsks2000 []float64, putBids2000 []float64, putAsks2100 []float64) {
+	levels := func(strike float64, optionType string, priceAmounts []float64) []Order {
+		var orders []Order
+		for i := 0; i < len(priceAmounts); i += 2 {
+			orders = append(orders, Order{Asset: chain.Asset, Price: priceAmounts[i], Amount: priceAmounts[i+1], Strike: strike,
+				OptionType: optionType, Exchange: venue, Timestamp: received})
+		}
+		return orders
+	}
+	instrument := func(strike float64, optionType string) Instrument {
+		return Instrument{Asset: chain.Asset, Expiry: chain.Expiry, Strike: strike, Type: optionType, Venue: venue}
+	}
+	Orderbooks.Update(instrument(2100, Call), levels(2100, Call, callBids2100), nil)
+	Orderbooks.Update(instrument(2000, Call), nil, levels(2000, Call, callAsks2000))
+	Orderbooks.Update(instrument(2000, Put), levels(2000, Put, putBids2000), nil)
+	Orderbooks.Update(instrument(2100, Put), nil, levels(2100, Put, putAsks2100))
+}
+
+// waitExecuted waits until the paper trade id is no longer pending and returns it
+func waitExecuted(t *testing.T, engine *PaperEngine, id int) *PaperTrade {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		for _, trade := range engine.Trades() {
+			if trade.Id == id && trade.Status != PaperPending {
+				return trade
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("paper trade %v still pending", id)
+
+	return nil
+}
+
+// formatPositions formats positions as strike type venue:amount
+func formatPositions(positions []PaperPosition) string {
+	formatted := make([]string, len(positions))
+	for i, position := range positions {
+		formatted[i] = fmt.Sprintf("%v %v %v:%v", position.Instrument.Strike, position.Instrument.Type, position.Instrument.Venue, position.Amount)
+	}
+
+	return strings.Join(formatted, " ")
+}
+
+func TestPaperEngineSubmit(t *testing.T) {
+	defer func(previous func() time.Time, latency time.Duration, ratio float64) {
+		now, PaperLatency, PaperFillRatio = previous, latency, ratio
+	}(now, PaperLatency, PaperFillRatio)
+	start := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return start }
+	PaperLatency = 50 * time.Millisecond
+
+	chain := ChainKey{"ETH", time.Date(2026, 12, 30, SettlementHour, 0, 0, 0, time.UTC).Unix()}
+	key := BoxKey{chain.Asset, chain.Expiry, 2000, 2100, BoxLong}
+	//walking the depth the marginal box costs 90, 91 and 92 for the 2nd, 3rd and 4th contract, 37 profit for 4 boxes.
+	//deribit takes 0.0003 * 2180 = 0.654 per contract and 2 * 0.327 settling per box, 3.27 per box
+	tests := []struct {
+		name          string
+		venue         string
+		fillRatio     float64
+		size          float64
+		afterSubmit   func() //runs within PaperLatency, before the legs are filled
+		status        string
+		boxes         float64
+		expected      float64
+		realized      float64
+		positions     string
+		premium, fees float64 //sums of the cash flows
+		legFills      [4]int
+	}{
+		{"depth walked up to the detected size", "x", 1, 10, nil,
+			PaperFilled, 4, 37, 37, "2000 C x:4 2000 P x:-4 2100 C x:-4 2100 P x:4", -363, 0, [4]int{2, 2, 1, 1}},
+		{"smaller size", "x", 1, 2, nil,
+			PaperFilled, 2, 20, 20, "2000 C x:2 2000 P x:-2 2100 C x:-2 2100 P x:2", -180, 0, [4]int{1, 1, 1, 1}},
+		//half of every level fills, the 2100 call has 2 of its 4 contracts and pairs with 2 of the others
+		{"partial fills", "x", 0.5, 4, nil,
+			PaperPartial, 2, 37, 2 * (100 - 91.125), "2000 C x:4 2000 P x:-2.5 2100 C x:-2 2100 P x:2.5", -848.5, 0, [4]int{2, 2, 1, 1}},
+		{"book changed during latency", "x", 1, 4, func() {
+			seedPaperBooks(chain, "x", start, []float64{250, 2, 249, 2}, []float64{330, 3, 331, 5}, []float64{150, 1}, []float64{160, 5})
+		}, PaperPartial, 1, 37, 100 - 90.75, "2000 C x:4 2000 P x:-1 2100 C x:-4 2100 P x:4", -813, 0, [4]int{2, 2, 1, 1}},
+		{"book gone during latency", "x", 1, 4, func() {
+			seedPaperBooks(chain, "x", start, nil, nil, nil, nil)
+		}, PaperUnfilled, 0, 37, 0, "", 0, 0, [4]int{0, 0, 0, 0}},
+		{"fees", "deribit", 1, 4, nil,
+			PaperFilled, 4, 37 - 4*3.27, 37 - 4*3.27, "2000 C deribit:4 2000 P deribit:-4 2100 C deribit:-4 2100 P deribit:4", -363, -16 * 0.654, [4]int{2, 2, 1, 1}},
+	}
+	for _, test := range tests {
+		resetState(t)
+		PaperFillRatio = test.fillRatio
+		seedPaperBooks(chain, test.venue, start, []float64{250, 2, 249, 2}, []float64{330, 3, 331, 5}, []float64{150, 5}, []float64{160, 5})
+		updateBoxes()
+
+		engine := &PaperEngine{positions: make(map[Instrument]float64)}
+		submitted, err := engine.Submit(key, test.size)
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+		if test.afterSubmit != nil {
+			test.afterSubmit()
+		}
+		if submitted.Status != PaperPending || len(submitted.Legs[0].Fills) != 0 {
+			t.Errorf("%v: got %v with fills %+v on submission, want pending until PaperLatency", test.name, submitted.Status, submitted.Legs[0].Fills)
+		}
+
+		trade := waitExecuted(t, engine, submitted.Id)
+		if trade.Status != test.status || !almostEqual(trade.Boxes, test.boxes) || !almostEqual(trade.Size, min(test.size, 4)) {
+			t.Errorf("%v: got %v, %v of %v boxes, want %v, %v of %v", test.name, trade.Status, trade.Boxes, trade.Size, test.status, test.boxes, min(test.size, 4))
+		}
+		if !almostEqual(trade.ExpectedProfit, test.expected) || !almostEqual(trade.RealizedProfit, test.realized) {
+			t.Errorf("%v: got expected profit %v realized %v, want %v %v", test.name, trade.ExpectedProfit, trade.RealizedProfit, test.expected, test.realized)
+		}
+		for i, leg := range trade.Legs {
+			if len(leg.Fills) != test.legFills[i] {
+				t.Errorf("%v: leg %v: got fills %+v, want %v", test.name, i, leg.Fills, test.legFills[i])
+			}
+		}
+
+		positions, cashFlows := engine.Positions()
+		if got := formatPositions(positions); got != test.positions {
+			t.Errorf("%v: got positions %q, want %q", test.name, got, test.positions)
+		}
+		premium, fees := 0.0, 0.0
+		for _, flow := range cashFlows {
+			if flow.TradeId != trade.Id || !flow.Time.Equal(start) {
+				t.Errorf("%v: got cash flow %+v, want trade %v at %v", test.name, flow, trade.Id, start)
+			}
+			switch flow.Kind {
+			case PaperPremium:
+				premium += flow.Amount
+			case PaperFee:
+				fees += flow.Amount
+			}
+		}
+		if !almostEqual(premium, test.premium) || !almostEqual(fees, test.fees) {
+			t.Errorf("%v: got premium %v fees %v, want %v %v", test.name, premium, fees, test.premium, test.fees)
+		}
+	}
+}
+
+func TestPaperEngineSubmitErrors(t *testing.T) {
+	resetState(t)
+
+	engine := &PaperEngine{positions: make(map[Instrument]float64)}
+	key := BoxKey{"ETH", time.Date(2026, 12, 30, SettlementHour, 0, 0, 0, time.UTC).Unix(), 2000, 2100, BoxLong}
+	for _, size := range []float64{0, -1} {
+		if _, err := engine.Submit(key, size); err == nil {
+			t.Errorf("size %v: no error", size)
+		}
+	}
+	if _, err := engine.Submit(key, 1); err == nil {
+		t.Errorf("box that isn't detected: no error")
+	}
+	if trades := engine.Trades(); len(trades) != 0 {
+		t.Errorf("got trades %+v for rejected submissions", trades)
+	}
+}
+
+func TestPaperEngineExecuteLeg(t *testing.T) {
+	defer func(previous func() time.Time, latency time.Duration, ratio float64) {
+		now, PaperLatency, PaperFillRatio = previous, latency, ratio
+	}(now, PaperLatency, PaperFillRatio)
+	start := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return start }
+	PaperLatency = 10 * time.Millisecond
+	PaperFillRatio = 1
+	resetState(t)
+
+	chain := ChainKey{"ETH", time.Date(2026, 12, 30, SettlementHour, 0, 0, 0, time.UTC).Unix()}
+	seedPaperBooks(chain, "x", start, nil, []float64{330, 3, 331, 5}, nil, nil)
+	seedPaperBooks(chain, "y", start, nil, []float64{329, 1}, nil, nil)
+	call := Instrument{Asset: chain.Asset, Expiry: chain.Expiry, Strike: 2000, Type: Call, Venue: "x"}
+
+	engine := &PaperEngine{positions: make(map[Instrument]float64)}
+	tests := []struct {
+		name   string
+		order  LegOrder
+		filled float64
+		avg    float64
+	}{
+		//y's cheaper level isn't taken, the order is on x
+		{"across levels on its venue", LegOrder{Instrument: call, Side: Buy, Limit: 331, Amount: 5}, 5, (3*330 + 2*331) / 5.0},
+		{"limit stops the walk", LegOrder{Instrument: call, Side: Buy, Limit: 330, Amount: 5}, 3, 330},
+		{"no bids to sell to", LegOrder{Instrument: call, Side: Sell, Limit: 1, Amount: 1}, 0, 0},
+	}
+	for _, test := range tests {
+		fill, err := engine.ExecuteLeg(context.Background(), test.order)
+		if err != nil || !almostEqual(fill.Filled, test.filled) || !almostEqual(fill.AvgPrice, test.avg) || fill.Fees != 0 {
+			t.Errorf("%v: got %+v, %v, want %v at %v", test.name, fill, err, test.filled, test.avg)
+		}
+	}
+
+	positions, cashFlows := engine.Positions()
+	if got := formatPositions(positions); got != "2000 C x:8" {
+		t.Errorf("got positions %q, want the 8 calls bought", got)
+	}
+	if len(cashFlows) != 6 || cashFlows[0].TradeId != 0 || cashFlows[0].Amount != -990 {
+		t.Errorf("got cash flows %+v, want a premium and a fee per fill of trade 0", cashFlows)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if fill, err := engine.ExecuteLeg(ctx, tests[0].order); err == nil || fill.Filled != 0 {
+		t.Errorf("cancelled: got %+v, %v, want an error and no fill", fill, err)
+	}
+	if _, after := engine.Positions(); len(after) != len(cashFlows) {
+		t.Errorf("cancelled order was booked")
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const RecordFlushInterval = time.Second //at most this much of a recording is lost when the process is killed
+
+// one line of a recording, a gzip compressed JSONL file
+type recordedFrame struct {
+	Time  time.Time `json:"ts"` //receive time
+	Venue string    `json:"venue"`
+	Frame string    `json:"frame"` //raw ws frame
+}
+
+// Recorder appends every raw frame read from the exchanges to a recording, see -record
+type Recorder struct {
+	mu   sync.Mutex
+	file *os.File
+	gz   *gzip.Writer
+	enc  *json.Encoder
+	done chan struct{}
+}
+
+// newRecorder opens path for appending, gzip readers read the members appended by every run as one stream
+func newRecorder(path string) (*Recorder, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("newRecorder: %v", err)
+	}
+
+	gz := gzip.NewWriter(file)
+	r := &Recorder{file: file, gz: gz, enc: json.NewEncoder(gz), done: make(chan struct{})}
+	go r.flushLoop()
+
+	return r, nil
+}
+
+func (r *Recorder) Record(venue string, received time.Time, raw []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.enc == nil { //closed
+		return
+	}
+	err := r.enc.Encode(recordedFrame{received, venue, string(raw)})
+	if err != nil {
+		log.Printf("Recorder: %v\n\n", err)
+	}
+}
+
+func (r *Recorder) flushLoop() {
+	ticker := time.NewTicker(RecordFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+			r.mu.Lock()
+			if r.gz != nil {
+				r.gz.Flush()
+			}
+			r.mu.Unlock()
+		}
+	}
+}
+
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.enc == nil {
+		return nil
+	}
+	close(r.done)
+	r.enc = nil
+
+	err := r.gz.Close()
+	r.gz = nil
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// in replay mode quote ages, apys and history are computed at the receive time of the last replayed frame
+var replayNanos atomic.Int64
+
+func replayNow() time.Time {
+	return time.Unix(0, replayNanos.Load())
+}
+
+// replayRecording feeds the frames of the recording at path through the exchanges' parsers, the same way wssReadLoop
+// does, and applies each frame's update and recomputes its boxes before the next frame is read. the clock is the
+// receive time of the frame and boxes are swept every SweepInterval of recorded time, so unlike bookLoop nothing depends
+// on the wall clock or scheduling and a recording always produces the same boxes. speed 1 replays in real time, 10 ten
+// times faster and 0 without waiting between frames
+func replayRecording(ctx context.Context, path string, speed float64) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("replayRecording: %v", err)
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(bufio.NewReader(file))
+	if err != nil {
+		return fmt.Errorf("replayRecording: %v: %v", path, err)
+	}
+	defer gz.Close()
+
+	decoder := json.NewDecoder(gz)
+	updates := make(chan *BookUpdate, 1) //dispatchFrame pushes at most one update per frame
+	var start, first, lastSweep time.Time
+	frames := 0
+	for ctx.Err() == nil {
+		var frame recordedFrame
+		err = decoder.Decode(&frame)
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) { //the recording process was killed mid write
+			log.Printf("replayRecording: %v is truncated, stopping\n\n", path)
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("replayRecording: %v: frame %v: %v", path, frames+1, err)
+		}
+
+		ex, err := getExchange(frame.Venue)
+		if err != nil {
+			return fmt.Errorf("replayRecording: %v: frame %v: %v", path, frames+1, err)
+		}
+
+		if frames == 0 {
+			start, first = time.Now(), frame.Time
+		}
+		if speed > 0 {
+			wait := time.Duration(float64(frame.Time.Sub(first))/speed) - time.Since(start)
+			if wait > 0 && !sleepCtx(ctx, wait) {
+				break
+			}
+		}
+
+		replayNanos.Store(frame.Time.UnixNano())
+		if gap := dispatchFrame(ex, []byte(frame.Frame), frame.Time, updates); gap != nil {
+			log.Printf("replayRecording: %v, its book is rebuilt from the next recorded snapshot\n\n", gap)
+		}
+		select {
+		case update := <-updates:
+			Orderbooks.Update(update.Instrument, update.Bids, update.Asks)
+			if frame.Time.Sub(lastSweep) >= SweepInterval {
+				updateBoxes()
+				lastSweep = frame.Time
+			} else {
+				updateChangedBoxes(map[ChainKey]map[float64]bool{update.Instrument.Chain(): {update.Instrument.Strike: true}})
+			}
+		default:
+		}
+		frames++
+	}
+
+	log.Printf("replayRecording: replayed %v frames of %v\n\n", frames, path)
+
+	return nil
+}
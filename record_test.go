@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// writeRecording records frames, venue and raw frame each, one second apart from start
+func writeRecording(t *testing.T, start time.Time, frames [][2]string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "recording.jsonl.gz")
+	recorder, err := newRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, frame := range frames {
+		recorder.Record(frame[0], start.Add(time.Duration(i)*time.Second), []byte(frame[1]))
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// replayedBoxes replays the recording at path into fresh state and returns the boxes and the history of key
+func replayedBoxes(t *testing.T, path string, speed float64, key BoxKey) (map[BoxKey]Box, []historyPoint) {
+	t.Helper()
+	resetState(t)
+
+	err := replayRecording(context.Background(), path, speed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	boxes := make(map[BoxKey]Box)
+	for boxKey, box := range BoxContainer.Boxes {
+		boxes[boxKey] = *box
+	}
+
+	return boxes, BoxHistory.Get(key)
+}
+
+func TestReplayDeterministic(t *testing.T) {
+	defer func(previous func() time.Time) { now = previous }(now)
+	now = replayNow
+
+	//deribit's 2000 call asks and 2100 put asks with aevo's bids form a long box, deribit then goes quiet and its
+	//quotes age out at the sweep of the last aevo frame
+	var frames [][2]string
+	for _, frame := range readFrames(t, "testdata/deribit_frames.jsonl") {
+		frames = append(frames, [2]string{"deribit", string(frame)})
+	}
+	opening := len(frames) + 1 //aevo's put completes the box
+	frames = append(frames,
+		[2]string{"aevo", `{"channel":"orderbook:ETH-31DEC27-2100-C","data":{"type":"snapshot","instrument_name":"ETH-31DEC27-2100-C","bids":[["250","4","0.5"]],"asks":[],"last_updated":"1"}}`},
+		[2]string{"aevo", `{"channel":"orderbook:ETH-31DEC27-2000-P","data":{"type":"snapshot","instrument_name":"ETH-31DEC27-2000-P","bids":[["150","6","0.5"]],"asks":[],"last_updated":"1"}}`},
+	)
+	for i := 0; i < 40; i++ { //aevo acks until deribit's quotes are older than MaxQuoteAge
+		frames = append(frames, [2]string{"aevo", `{"id":1,"data":[]}`})
+	}
+	frames = append(frames, [2]string{"aevo", `{"channel":"orderbook:ETH-31DEC27-2100-C","data":{"type":"update","instrument_name":"ETH-31DEC27-2100-C","bids":[["251","1","0.5"]],"asks":[],"last_updated":"2"}}`})
+
+	start := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	path := writeRecording(t, start, frames)
+	key := BoxKey{"ETH", time.Date(2027, 12, 31, SettlementHour, 0, 0, 0, time.UTC).Unix(), 2000, 2100, BoxLong}
+
+	boxes, history := replayedBoxes(t, path, 0, key)
+	if len(history) != 2 || !history[0].Open || history[1].Open {
+		t.Fatalf("history: got %+v, want the box opened and then closed", history)
+	}
+	if opened := history[0].Time; !opened.Equal(start.Add(time.Duration(opening) * time.Second)) {
+		t.Errorf("opened at %v, want the receive time of aevo's put", opened)
+	}
+	if closed := history[1].Time; !closed.Equal(start.Add(time.Duration(len(frames)-1) * time.Second)) {
+		t.Errorf("closed at %v, want the receive time of the last frame", closed)
+	}
+	if _, ok := boxes[key]; ok {
+		t.Errorf("box on stale deribit quotes still open")
+	}
+
+	//the same recording replayed again, and faster than real time, ends in the same state
+	for _, speed := range []float64{0, 1000} {
+		againBoxes, againHistory := replayedBoxes(t, path, speed, key)
+		if !reflect.DeepEqual(againBoxes, boxes) || !reflect.DeepEqual(againHistory, history) {
+			t.Errorf("speed %v: got boxes %+v history %+v, want %+v %+v", speed, againBoxes, againHistory, boxes, history)
+		}
+	}
+}
+
+func TestReplayStopsOnCancel(t *testing.T) {
+	defer func(previous func() time.Time) { now = previous }(now)
+	now = replayNow
+	resetState(t)
+
+	start := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	path := writeRecording(t, start, [][2]string{{"aevo", `{"id":1,"data":[]}`}, {"aevo", `{"id":2,"data":[]}`}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- replayRecording(ctx, path, 0.001) }() //the second frame is 1000s away
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("replay kept waiting for the next frame after ctx was cancelled")
+	}
+}
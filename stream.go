@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+const BoxAdded = "box-added"
+const BoxUpdated = "box-updated"
+const BoxRemoved = "box-removed"
+
+const StreamBuffer = 256 //events buffered per client, a client that falls further behind is disconnected
+const StreamKeepAlive = 15 * time.Second
+
+type BoxEvent struct {
+	Version int    `json:"version"`
+	Type    string `json:"type"`
+	Box     apiBox `json:"box"` //last known state for box-removed
+}
+
+type streamClient struct {
+	filter BoxFilter
+	events chan BoxEvent
+	closed bool
+	seen   map[BoxKey]bool //boxes the client was sent box-added for and not yet box-removed
+}
+
+// fans BoxContainer changes out to stream clients, Publish never blocks so slow clients can't stall updateBoxes
+type BoxStreamHub struct {
+	mu      sync.Mutex
+	clients map[*streamClient]bool
+}
+
+var BoxStream = BoxStreamHub{clients: make(map[*streamClient]bool)}
+
+// Publish sends each client the change as it looks through the client's filter: a box entering the filter is
+// box-added, one leaving it is box-removed with its new state, whatever eventType was
+func (h *BoxStreamHub) Publish(eventType string, box *Box) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.clients) == 0 {
+		return
+	}
+
+	apiBox := toApiBox(box)
+	for client := range h.clients {
+		seen := client.seen[box.Key]
+		match := eventType != BoxRemoved && client.filter.Match(box)
+
+		var event BoxEvent
+		switch {
+		case match && seen:
+			event = BoxEvent{ApiVersion, BoxUpdated, apiBox}
+		case match:
+			event = BoxEvent{ApiVersion, BoxAdded, apiBox}
+			client.seen[box.Key] = true
+		case seen:
+			event = BoxEvent{ApiVersion, BoxRemoved, apiBox}
+			delete(client.seen, box.Key)
+		default:
+			continue
+		}
+
+		select {
+		case client.events <- event:
+		default:
+			log.Printf("BoxStream: client too slow, disconnecting\n\n")
+			h.remove(client)
+		}
+	}
+}
+
+// Subscribe registers a client and queues a box-added event for every current box matching filter
+func (h *BoxStreamHub) Subscribe(filter BoxFilter) *streamClient {
+	//BoxContainer.Mu is held so no change can be published between the snapshot and registration
+	BoxContainer.Mu.Lock()
+	defer BoxContainer.Mu.Unlock()
+
+	var snapshot []BoxEvent
+	seen := make(map[BoxKey]bool)
+	for _, box := range BoxContainer.Boxes {
+		if filter.Match(box) {
+			snapshot = append(snapshot, BoxEvent{ApiVersion, BoxAdded, toApiBox(box)})
+			seen[box.Key] = true
+		}
+	}
+
+	client := &streamClient{filter: filter, events: make(chan BoxEvent, StreamBuffer+len(snapshot)), seen: seen}
+	for _, event := range snapshot {
+		client.events <- event
+	}
+
+	h.mu.Lock()
+	h.clients[client] = true
+	h.mu.Unlock()
+
+	return client
+}
+
+func (h *BoxStreamHub) Unsubscribe(client *streamClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.remove(client)
+}
+
+func (h *BoxStreamHub) remove(client *streamClient) {
+	//caller holds h.mu
+	if client.closed {
+		return
+	}
+	client.closed = true
+	delete(h.clients, client)
+	close(client.events)
+}
+
+func boxStreamSseHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseBoxFilter(r.URL.Query())
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, err)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJsonError(w, http.StatusInternalServerError, fmt.Errorf("streaming not supported"))
+		return
+	}
+
+	client := BoxStream.Subscribe(filter)
+	defer BoxStream.Unsubscribe(client)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(StreamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case event, ok := <-client.events:
+			if !ok { //disconnected for falling behind
+				return
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				log.Printf("boxStreamSseHandler: %v\n\n", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+			flusher.Flush()
+		}
+	}
+}
+
+func boxStreamWsHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseBoxFilter(r.URL.Query())
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	c, err := websocket.Accept(w, r, nil)
+	if err != nil {
+		log.Printf("boxStreamWsHandler: %v\n\n", err)
+		return
+	}
+	defer c.CloseNow()
+
+	client := BoxStream.Subscribe(filter)
+	defer BoxStream.Unsubscribe(client)
+
+	ctx := c.CloseRead(r.Context()) //clients only receive, ctx is cancelled when the client closes
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-client.events:
+			if !ok {
+				c.Close(websocket.StatusPolicyViolation, "client too slow")
+				return
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				log.Printf("boxStreamWsHandler: %v\n\n", err)
+				continue
+			}
+
+			writeCtx, cancel := context.WithTimeout(ctx, StreamKeepAlive)
+			err = c.Write(writeCtx, websocket.MessageText, data)
+			cancel()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+func registerStreamHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/stream/boxes", boxStreamSseHandler)
+	mux.HandleFunc("GET /api/stream/boxes/ws", boxStreamWsHandler)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// receiveEvents drains the events queued for client, as "type k2" strings
+func receiveEvents(client *streamClient) []string {
+	var events []string
+	for {
+		select {
+		case event := <-client.events:
+			events = append(events, fmt.Sprint(event.Type, " ", event.Box.K2))
+		default:
+			return events
+		}
+	}
+}
+
+func TestBoxStreamFilterTransitions(t *testing.T) {
+	resetState(t)
+	hub := BoxStreamHub{clients: make(map[*streamClient]bool)}
+	expiry := now().Add(30 * 24 * time.Hour).Unix()
+
+	box := func(k2 float64, apy float64) *Box {
+		return &Box{Key: BoxKey{"ETH", expiry, 2000, k2, BoxLong}, Apy: apy}
+	}
+	BoxContainer.Boxes[box(2100, 0.2).Key] = box(2100, 0.2)
+	BoxContainer.Boxes[box(2200, 0.01).Key] = box(2200, 0.01)
+
+	client := hub.Subscribe(BoxFilter{MinApy: 0.1})
+	steps := []struct {
+		name      string
+		eventType string
+		box       *Box
+		want      []string
+	}{
+		{"snapshot", "", nil, []string{"box-added 2100"}},
+		{"update below the filter", BoxUpdated, box(2200, 0.05), nil},
+		{"update entering the filter", BoxUpdated, box(2200, 0.15), []string{"box-added 2200"}},
+		{"update inside the filter", BoxUpdated, box(2200, 0.3), []string{"box-updated 2200"}},
+		{"update leaving the filter", BoxUpdated, box(2100, 0.02), []string{"box-removed 2100"}},
+		{"removal of a box outside the filter", BoxRemoved, box(2100, 0.02), nil},
+		{"new box outside the filter", BoxAdded, box(2300, 0.01), nil},
+		{"new box inside the filter", BoxAdded, box(2400, 0.5), []string{"box-added 2400"}},
+		{"removal of a box inside the filter", BoxRemoved, box(2400, 0.5), []string{"box-removed 2400"}},
+		{"removed box added again", BoxAdded, box(2400, 0.5), []string{"box-added 2400"}},
+	}
+	for _, step := range steps {
+		if step.box != nil {
+			hub.Publish(step.eventType, step.box)
+		}
+		got := receiveEvents(client)
+		if len(got) != len(step.want) {
+			t.Errorf("%v: got %v, want %v", step.name, got, step.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != step.want[i] {
+				t.Errorf("%v: got %v, want %v", step.name, got, step.want)
+				break
+			}
+		}
+	}
+
+	hub.Unsubscribe(client)
+	if _, ok := <-client.events; ok {
+		t.Errorf("events left after unsubscribe")
+	}
+}
@@ -0,0 +1,603 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// one row of the box table, every field preformatted for templates/box_rows.html
+type boxRow struct {
+	Asset             string
+	Expiry            string
+	K1                string
+	K2                string
+	Direction         string
+	ShortCallExchange string
+	ShortCallPrice    string
+	LongCallExchange  string
+	LongCallPrice     string
+	ShortPutExchange  string
+	ShortPutPrice     string
+	LongPutExchange   string
+	LongPutPrice      string
+	Cost              string
+	Payoff            string
+	Amount            string
+	Profit            string
+	Fees              string
+	NetProfit         string
+	RelProfit         string //percent
+	Apy               string
+	BorrowRate        string //percent, short boxes only
+	MaxSize           string
+	VwapCost          string
+	TotalProfit       string
+	Detail            string //drill-down url
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', 3, 64)
+}
+
+func formatExpiry(expiry int64) string {
+	return strings.ToUpper(time.Unix(expiry, 0).UTC().Format("02Jan06 15:04:05"))
+}
+
+func formatBorrowRate(box *Box) string {
+	if box.Key.Direction != BoxShort {
+		return "-"
+	}
+
+	return formatFloat(box.BorrowRate * 100)
+}
+
+func newBoxRow(box *Box) boxRow {
+	return boxRow{
+		Asset:             box.Key.Asset,
+		Expiry:            formatExpiry(box.Key.Expiry),
+		K1:                formatFloat(box.Key.K1),
+		K2:                formatFloat(box.Key.K2),
+		Direction:         box.Key.Direction,
+		ShortCallExchange: box.ShortCallBids[0].Exchange,
+		ShortCallPrice:    formatFloat(box.ShortCallBids[0].Price),
+		LongCallExchange:  box.LongCallAsks[0].Exchange,
+		LongCallPrice:     formatFloat(box.LongCallAsks[0].Price),
+		ShortPutExchange:  box.ShortPutBids[0].Exchange,
+		ShortPutPrice:     formatFloat(box.ShortPutBids[0].Price),
+		LongPutExchange:   box.LongPutAsks[0].Exchange,
+		LongPutPrice:      formatFloat(box.LongPutAsks[0].Price),
+		Cost:              formatFloat(box.Cost),
+		Payoff:            formatFloat(box.Payoff),
+		Amount:            formatFloat(box.Amount),
+		Profit:            formatFloat(box.Profit),
+		Fees:              formatFloat(box.Fees),
+		NetProfit:         formatFloat(box.NetProfit),
+		RelProfit:         formatFloat(box.RelProfit * 100),
+		Apy:               formatFloat(box.Apy),
+		BorrowRate:        formatBorrowRate(box),
+		MaxSize:           formatFloat(box.MaxSize),
+		VwapCost:          formatFloat(box.VwapCost),
+		TotalProfit:       formatFloat(box.TotalProfit),
+		Detail:            "/box?" + boxKeyQuery(box.Key).Encode(),
+	}
+}
+
+func boxKeyQuery(key BoxKey) url.Values {
+	query := url.Values{}
+	query.Set("asset", key.Asset)
+	query.Set("expiry", strconv.FormatInt(key.Expiry, 10))
+	query.Set("k1", strconv.FormatFloat(key.K1, 'f', -1, 64))
+	query.Set("k2", strconv.FormatFloat(key.K2, 'f', -1, 64))
+	query.Set("direction", key.Direction)
+
+	return query
+}
+
+func parseBoxKey(query url.Values) (BoxKey, error) {
+	var key BoxKey
+	var err error
+
+	key.Asset = query.Get("asset")
+	if key.Asset == "" {
+		return key, fmt.Errorf("asset: required")
+	}
+	key.Expiry, err = strconv.ParseInt(query.Get("expiry"), 10, 64)
+	if err != nil {
+		return key, fmt.Errorf("expiry: expected unix timestamp, got %q", query.Get("expiry"))
+	}
+	key.K1, err = strconv.ParseFloat(query.Get("k1"), 64)
+	if err != nil || math.IsNaN(key.K1) {
+		return key, fmt.Errorf("k1: expected number, got %q", query.Get("k1"))
+	}
+	key.K2, err = strconv.ParseFloat(query.Get("k2"), 64)
+	if err != nil || math.IsNaN(key.K2) {
+		return key, fmt.Errorf("k2: expected number, got %q", query.Get("k2"))
+	}
+	key.Direction = query.Get("direction")
+	if key.Direction == "" {
+		key.Direction = BoxLong
+	}
+	if key.Direction != BoxLong && key.Direction != BoxShort {
+		return key, fmt.Errorf("direction: expected %v or %v, got %q", BoxLong, BoxShort, key.Direction)
+	}
+
+	return key, nil
+}
+
+// boxRows returns the rows of the boxes matching the filter and sort query parameters of /api/boxes
+func boxRows(query url.Values) ([]boxRow, error) {
+	filter, err := parseBoxFilter(query)
+	if err != nil {
+		return nil, err
+	}
+	sortValue, asc, err := parseBoxSort(query)
+	if err != nil {
+		return nil, err
+	}
+
+	boxes := filteredBoxes(filter, sortValue, asc)
+	rows := make([]boxRow, len(boxes))
+	for i, box := range boxes {
+		rows[i] = newBoxRow(box)
+	}
+
+	return rows, nil
+}
+
+func boxTableHandler(w http.ResponseWriter, r *http.Request) {
+	rows, err := boxRows(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = Templates.ExecuteTemplate(w, "box-rows", rows)
+	if err != nil {
+		log.Printf("boxTableHandler: %v\n\n", err)
+	}
+}
+
+type exchangeOption struct {
+	Name    string
+	Checked bool
+}
+
+type expiryOption struct {
+	Value    string
+	Label    string
+	Selected bool
+}
+
+// state of the dashboard filter form, read back from the page url so a reload keeps sort and filters
+type dashboardView struct {
+	Assets    []string
+	Asset     string
+	Expiry    string
+	Direction string
+	MinApy    string
+	MinProfit string
+	MinSize   string
+	Exchanges []exchangeOption
+	Sort      string
+	Order     string
+}
+
+func newDashboardView(query url.Values, assets []string, exchanges []string) dashboardView {
+	view := dashboardView{
+		Assets:    assets,
+		Asset:     query.Get("asset"),
+		Expiry:    query.Get("expiry"),
+		Direction: query.Get("direction"),
+		MinApy:    query.Get("min_apy"),
+		MinProfit: query.Get("min_profit"),
+		MinSize:   query.Get("min_size"),
+		Sort:      query.Get("sort"),
+		Order:     query.Get("order"),
+	}
+	if view.Sort == "" {
+		view.Sort = "apy"
+	}
+	if view.Order == "" {
+		view.Order = "desc"
+	}
+
+	//no exchanges parameter means all of them, as in BoxFilter
+	checked := make(map[string]bool)
+	for _, value := range query["exchanges"] {
+		for _, exchange := range splitList(value) {
+			checked[exchange] = true
+		}
+	}
+	for _, exchange := range exchanges {
+		view.Exchanges = append(view.Exchanges, exchangeOption{exchange, len(checked) == 0 || checked[exchange]})
+	}
+
+	return view
+}
+
+func homeHandler(cfg Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+
+		err := Templates.ExecuteTemplate(w, "index.html", newDashboardView(r.URL.Query(), cfg.Assets, cfg.Exchanges))
+		if err != nil {
+			log.Printf("homeHandler: %v\n\n", err)
+		}
+	}
+}
+
+// expiryOptions lists the expiries of the orderbooks of asset (all assets if empty), selected marks the current filter
+func expiryOptions(asset string, selected string) []expiryOption {
+	seen := make(map[int64]bool)
+	var expiries []int64
+	for chain := range Orderbooks.Snapshot() {
+		if (asset == "" || chain.Asset == asset) && !seen[chain.Expiry] {
+			seen[chain.Expiry] = true
+			expiries = append(expiries, chain.Expiry)
+		}
+	}
+	sort.Slice(expiries, func(i, j int) bool { return expiries[i] < expiries[j] })
+
+	options := make([]expiryOption, len(expiries))
+	for i, expiry := range expiries {
+		value := strconv.FormatInt(expiry, 10)
+		options[i] = expiryOption{value, formatExpiry(expiry), value == selected}
+	}
+
+	return options
+}
+
+func expiryOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	err := Templates.ExecuteTemplate(w, "expiry-options", expiryOptions(query.Get("asset"), query.Get("expiry")))
+	if err != nil {
+		log.Printf("expiryOptionsHandler: %v\n\n", err)
+	}
+}
+
+type levelRow struct {
+	Exchange string
+	Price    string
+	Amount   string
+	Iv       string
+	Age      string
+}
+
+// full merged depth of one leg of a box
+type legView struct {
+	Name   string
+	Strike string
+	Levels []levelRow
+}
+
+type historyRow struct {
+	Time        string
+	Open        bool
+	NetProfit   string
+	TotalProfit string
+	Apy         string
+	MaxSize     string
+}
+
+// drill-down of one BoxKey for templates/box_detail.html, Box is nil while the box isn't profitable
+type boxDetail struct {
+	Title     string
+	Query     string     //BoxKey query parameters for the refresh url
+	Key       url.Values //BoxKey form fields of the paper trade form
+	Box       *boxRow
+	Legs      []legView
+	History   []historyRow //newest first
+	Sparkline string       //svg polyline points of the net profit history
+}
+
+const SparklineWidth = 600
+const SparklineHeight = 80
+const HistoryRows = 50 //rows of history shown, the sparkline covers all of it
+
+func newLevelRows(orders []Order) []levelRow {
+	rows := make([]levelRow, len(orders))
+	for i, order := range orders {
+		iv := "-"
+		if order.Iv >= 0 {
+			iv = formatFloat(order.Iv)
+		}
+		rows[i] = levelRow{
+			Exchange: order.Exchange,
+			Price:    formatFloat(order.Price),
+			Amount:   formatFloat(order.Amount),
+			Iv:       iv,
+			Age:      now().Sub(order.Timestamp).Round(time.Millisecond).String(),
+		}
+	}
+
+	return rows
+}
+
+// boxLegs returns the current depth of the four legs of key from Orderbooks, merged across exchanges like updateBoxDirection
+func boxLegs(key BoxKey) []legView {
+	var orders1, orders2 *Orders
+	for _, orders := range Orderbooks.Chain(ChainKey{key.Asset, key.Expiry}) {
+		switch orders.Strike {
+		case key.K1:
+			orders1 = orders
+		case key.K2:
+			orders2 = orders
+		}
+	}
+
+	sold, bought := orders2, orders1 //strikes of the sold call and bought call, as in updateBoxDirection
+	soldStrike, boughtStrike := formatFloat(key.K2), formatFloat(key.K1)
+	if key.Direction == BoxShort {
+		sold, bought = orders1, orders2
+		soldStrike, boughtStrike = boughtStrike, soldStrike
+	}
+
+	var callBids, callAsks, putBids, putAsks []Order
+	if sold != nil {
+		callBids, _ = mergeBids(sold.CallBids)
+		putAsks, _ = mergeAsks(sold.PutAsks)
+	}
+	if bought != nil {
+		callAsks, _ = mergeAsks(bought.CallAsks)
+		putBids, _ = mergeBids(bought.PutBids)
+	}
+
+	return []legView{
+		{"Short Call (bids)", soldStrike, newLevelRows(callBids)},
+		{"Long Call (asks)", boughtStrike, newLevelRows(callAsks)},
+		{"Short Put (bids)", boughtStrike, newLevelRows(putBids)},
+		{"Long Put (asks)", soldStrike, newLevelRows(putAsks)},
+	}
+}
+
+func sparkline(points []historyPoint) string {
+	if len(points) < 2 {
+		return ""
+	}
+
+	start, end := points[0].Time, points[len(points)-1].Time
+	low, high := 0.0, 0.0 //closed points are plotted at zero, so zero is always in range
+	for _, point := range points {
+		low = math.Min(low, point.NetProfit)
+		high = math.Max(high, point.NetProfit)
+	}
+	span := end.Sub(start).Seconds()
+	if span <= 0 || high == low {
+		return ""
+	}
+
+	coords := make([]string, len(points))
+	for i, point := range points {
+		x := point.Time.Sub(start).Seconds() / span * SparklineWidth
+		y := (high - point.NetProfit) / (high - low) * SparklineHeight
+		coords[i] = strconv.FormatFloat(x, 'f', 1, 64) + "," + strconv.FormatFloat(y, 'f', 1, 64)
+	}
+
+	return strings.Join(coords, " ")
+}
+
+func newBoxDetail(key BoxKey) boxDetail {
+	detail := boxDetail{
+		Title: fmt.Sprintf("%v %v %v/%v %v", key.Asset, formatExpiry(key.Expiry), formatFloat(key.K1), formatFloat(key.K2), key.Direction),
+		Query: boxKeyQuery(key).Encode(),
+		Key:   boxKeyQuery(key),
+		Legs:  boxLegs(key),
+	}
+
+	BoxContainer.Mu.Lock()
+	box, ok := BoxContainer.Boxes[key]
+	BoxContainer.Mu.Unlock()
+	if ok {
+		row := newBoxRow(box)
+		detail.Box = &row
+	}
+
+	points := BoxHistory.Get(key)
+	detail.Sparkline = sparkline(points)
+	for i := len(points) - 1; i >= 0 && len(detail.History) < HistoryRows; i-- {
+		point := points[i]
+		detail.History = append(detail.History, historyRow{
+			Time:        point.Time.UTC().Format("15:04:05.000"),
+			Open:        point.Open,
+			NetProfit:   formatFloat(point.NetProfit),
+			TotalProfit: formatFloat(point.TotalProfit),
+			Apy:         formatFloat(point.Apy),
+			MaxSize:     formatFloat(point.MaxSize),
+		})
+	}
+
+	return detail
+}
+
+// boxDetailHandler serves the drill-down page of /box and, for /box/detail, only its refreshed contents
+func boxDetailHandler(w http.ResponseWriter, r *http.Request) {
+	key, err := parseBoxKey(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name := "box.html"
+	if r.URL.Path == "/box/detail" {
+		name = "box-detail"
+	}
+
+	err = Templates.ExecuteTemplate(w, name, newBoxDetail(key))
+	if err != nil {
+		log.Printf("boxDetailHandler: %v\n\n", err)
+	}
+}
+
+type paperLegRow struct {
+	Leg      string //e.g. sell 2100 C
+	Limit    string
+	Filled   string //filled / amount
+	AvgPrice string
+	Fills    string //exchange amount@price of every fill
+}
+
+type paperTradeRow struct {
+	Id             int
+	Box            string
+	Detail         string //box drill-down url
+	Size           string
+	Status         string
+	Submitted      string
+	Latency        string //submission to execution
+	Legs           []paperLegRow
+	ExpectedProfit string
+	Boxes          string
+	RealizedProfit string
+	Slippage       string //realized - expected profit of the boxes filled, empty while pending
+}
+
+type paperPositionRow struct {
+	Instrument string
+	Exchange   string
+	Amount     string
+}
+
+type paperCashRow struct {
+	Exchange string
+	Premium  string
+	Fees     string
+	Total    string
+}
+
+// paper trading page, templates/paper.html
+type paperView struct {
+	Trades    []paperTradeRow
+	Positions []paperPositionRow
+	Cash      []paperCashRow //per exchange
+}
+
+func newPaperTradeRow(trade *PaperTrade) paperTradeRow {
+	key := trade.Key
+	row := paperTradeRow{
+		Id:             trade.Id,
+		Box:            fmt.Sprintf("%v %v %v/%v %v", key.Asset, formatExpiry(key.Expiry), formatFloat(key.K1), formatFloat(key.K2), key.Direction),
+		Detail:         "/box?" + boxKeyQuery(key).Encode(),
+		Size:           formatFloat(trade.Size),
+		Status:         trade.Status,
+		Submitted:      trade.Submitted.UTC().Format("15:04:05.000"),
+		ExpectedProfit: formatFloat(trade.ExpectedProfit),
+	}
+	if trade.Status != PaperPending {
+		row.Latency = trade.Executed.Sub(trade.Submitted).Round(time.Millisecond).String()
+		row.Boxes = formatFloat(trade.Boxes)
+		row.RealizedProfit = formatFloat(trade.RealizedProfit)
+		row.Slippage = formatFloat(trade.RealizedProfit - trade.ExpectedProfit*trade.Boxes/trade.Size)
+	}
+
+	for _, leg := range trade.Legs {
+		filled, avgPrice, _ := leg.filled()
+		fills := make([]string, len(leg.Fills))
+		for i, fill := range leg.Fills {
+			fills[i] = fmt.Sprintf("%v %v@%v", fill.Exchange, formatFloat(fill.Amount), formatFloat(fill.Price))
+		}
+		row.Legs = append(row.Legs, paperLegRow{
+			Leg:      fmt.Sprintf("%v %v %v", leg.Side, formatFloat(leg.Instrument.Strike), leg.Instrument.Type),
+			Limit:    formatFloat(leg.Limit),
+			Filled:   formatFloat(filled) + " / " + formatFloat(leg.Amount),
+			AvgPrice: formatFloat(avgPrice),
+			Fills:    strings.Join(fills, ", "),
+		})
+	}
+
+	return row
+}
+
+func newPaperView() paperView {
+	var view paperView
+	for _, trade := range Paper.Trades() {
+		view.Trades = append(view.Trades, newPaperTradeRow(trade))
+	}
+
+	positions, cashFlows := Paper.Positions()
+	for _, position := range positions {
+		instrument := position.Instrument
+		view.Positions = append(view.Positions, paperPositionRow{
+			Instrument: fmt.Sprintf("%v %v %v %v", instrument.Asset, formatExpiry(instrument.Expiry), formatFloat(instrument.Strike), instrument.Type),
+			Exchange:   instrument.Venue,
+			Amount:     formatFloat(position.Amount),
+		})
+	}
+
+	premiums := make(map[string]float64)
+	fees := make(map[string]float64)
+	var exchanges []string
+	for _, flow := range cashFlows {
+		if _, seen := premiums[flow.Exchange]; !seen {
+			exchanges = append(exchanges, flow.Exchange)
+			premiums[flow.Exchange] = 0
+		}
+		if flow.Kind == PaperFee {
+			fees[flow.Exchange] += flow.Amount
+		} else {
+			premiums[flow.Exchange] += flow.Amount
+		}
+	}
+	sort.Strings(exchanges)
+	for _, exchange := range exchanges {
+		view.Cash = append(view.Cash, paperCashRow{
+			Exchange: exchange,
+			Premium:  formatFloat(premiums[exchange]),
+			Fees:     formatFloat(fees[exchange]),
+			Total:    formatFloat(premiums[exchange] + fees[exchange]),
+		})
+	}
+
+	return view
+}
+
+// paperHandler serves the paper trading page of /paper and, for /paper/tables, only its refreshed contents
+func paperHandler(w http.ResponseWriter, r *http.Request) {
+	name := "paper.html"
+	if r.URL.Path == "/paper/tables" {
+		name = "paper-tables"
+	}
+
+	err := Templates.ExecuteTemplate(w, name, newPaperView())
+	if err != nil {
+		log.Printf("paperHandler: %v\n\n", err)
+	}
+}
+
+// paperSubmitHandler paper trades the box of the posted form, see templates/box.html, and redirects to /paper
+func paperSubmitHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	key, err := parseBoxKey(r.PostForm)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	size, err := strconv.ParseFloat(r.PostForm.Get("size"), 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("size: expected number, got %q", r.PostForm.Get("size")), http.StatusBadRequest)
+		return
+	}
+
+	_, err = Paper.Submit(key, size)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	http.Redirect(w, r, "/paper", http.StatusSeeOther)
+}
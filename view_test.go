@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the testdata/*.golden files with the rendered output")
+
+// checkGolden compares got with testdata/name, or rewrites it with -update
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+
+	path := "testdata/" + name
+	if *updateGolden {
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v, run go test -update to create it", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%v differs, run go test -update and review the diff\ngot:\n%s", path, got)
+	}
+}
+
+// goldenBoxes fills BoxContainer with boxes whose legs, strikes and expiries all differ, so a row mixing two boxes
+// shows up in the golden files
+func goldenBoxes(t *testing.T) {
+	t.Helper()
+	resetState(t)
+
+	received := time.Unix(1798000000, 0)
+	leg := func(exchange string, price float64, amount float64) []Order {
+		return []Order{{Price: price, Amount: amount, Exchange: exchange, Iv: -1, Timestamp: received}}
+	}
+	boxes := []*Box{
+		{
+			Key:           BoxKey{"ETH", 1798704000, 2000, 2100, BoxLong},
+			ShortCallBids: leg("aevo", 250, 4), LongCallAsks: leg("deribit", 280, 2), ShortPutBids: leg("aevo", 150, 6), LongPutAsks: leg("deribit", 180, 4),
+			Payoff: 100, Cost: 60, Amount: 2, Profit: 40, Fees: 1.5, NetProfit: 38.5, RelProfit: 38.5 / 61.5, Apy: 0.62,
+			MaxSize: 2, VwapCost: 60, TotalProfit: 77,
+		},
+		{
+			Key:           BoxKey{"BTC", 1801123200, 60000, 62000, BoxShort},
+			ShortCallBids: leg("deribit", 3100, 1), LongCallAsks: leg("lyra", 1900, 3), ShortPutBids: leg("lyra", 2600, 2), LongPutAsks: leg("deribit", 1500, 5),
+			Payoff: 2000, Cost: 2100, Amount: 1, Profit: 100, Fees: 20, NetProfit: 80, RelProfit: 80 / 2080.0, Apy: 0.04, BorrowRate: -0.05,
+			MaxSize: 1, VwapCost: 2100, TotalProfit: 80,
+		},
+		{
+			Key:           BoxKey{"ETH", 1801123200, 3000, 3500, BoxLong},
+			ShortCallBids: leg("lyra", 400, 10), LongCallAsks: leg("lyra", 700, 10), ShortPutBids: leg("aevo", 300, 10), LongPutAsks: leg("aevo", 480, 10),
+			Payoff: 500, Cost: 480, Amount: 10, Profit: 20, Fees: 5, NetProfit: 15, RelProfit: 15 / 485.0, Apy: 0.1,
+			MaxSize: 6.5, VwapCost: 481.25, TotalProfit: 89.375,
+		},
+	}
+	for _, box := range boxes {
+		BoxContainer.Boxes[box.Key] = box
+	}
+}
+
+func TestBoxTableGolden(t *testing.T) {
+	goldenBoxes(t)
+
+	tests := []struct {
+		query  string
+		golden string
+	}{
+		{"", "box_rows_apy.golden"},
+		{"?sort=k1&order=asc", "box_rows_k1_asc.golden"},
+		{"?asset=ETH&direction=long&min_apy=0.5", "box_rows_filtered.golden"},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		boxTableHandler(recorder, httptest.NewRequest("GET", "/update-table"+test.query, nil))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("%q: status %v %s", test.query, recorder.Code, recorder.Body.Bytes())
+		}
+		checkGolden(t, test.golden, recorder.Body.Bytes())
+	}
+
+	recorder := httptest.NewRecorder()
+	boxTableHandler(recorder, httptest.NewRequest("GET", "/update-table?sort=vega", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("unknown sort key: status %v, want 400", recorder.Code)
+	}
+}
+
+func TestBoxDetailGolden(t *testing.T) {
+	goldenBoxes(t)
+	defer func(previous func() time.Time) { now = previous }(now)
+	now = func() time.Time { return time.Unix(1798000002, 0) }
+
+	key := BoxKey{"ETH", 1798704000, 2000, 2100, BoxLong}
+	for _, venue := range []string{"aevo", "deribit"} {
+		for strike, price := range map[float64]float64{2000: 270, 2100: 240} {
+			instrument := Instrument{Asset: key.Asset, Expiry: key.Expiry, Strike: strike, Type: Call, Venue: venue}
+			order := Order{Price: price, Amount: 3, Exchange: venue, Iv: 0.55, Timestamp: time.Unix(1798000001, 0)}
+			Orderbooks.Update(instrument, []Order{order}, []Order{{Price: price + 10, Amount: 1, Exchange: venue, Iv: -1, Timestamp: order.Timestamp}})
+		}
+	}
+	BoxHistory.Record(key, historyPoint{Time: time.Unix(1798000000, 0), Open: true, NetProfit: 30, TotalProfit: 60, Apy: 0.5, MaxSize: 2})
+	BoxHistory.Record(key, historyPoint{Time: time.Unix(1798000001, 0), Open: true, NetProfit: 38.5, TotalProfit: 77, Apy: 0.62, MaxSize: 2})
+	BoxHistory.Record(key, historyPoint{Time: time.Unix(1798000002, 0)})
+
+	recorder := httptest.NewRecorder()
+	boxDetailHandler(recorder, httptest.NewRequest("GET", "/box/detail?"+boxKeyQuery(key).Encode(), nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status %v %s", recorder.Code, recorder.Body.Bytes())
+	}
+	checkGolden(t, "box_detail.golden", recorder.Body.Bytes())
+}
+
+func TestPagesLoadHtmx(t *testing.T) {
+	resetState(t)
+
+	recorder := httptest.NewRecorder()
+	homeHandler(Config{Assets: []string{"ETH"}, Exchanges: []string{"aevo"}})(recorder, httptest.NewRequest("GET", "/", nil))
+	if want := `<script src="/static/htmx.min.js"></script>`; !bytes.Contains(recorder.Body.Bytes(), []byte(want)) {
+		t.Errorf("dashboard doesn't load %v", want)
+	}
+	for _, name := range []string{"static/htmx.min.js", "static/htmx.LICENSE"} {
+		if _, err := staticFiles.ReadFile(name); err != nil {
+			t.Skipf("%v isn't vendored, run go generate: %v", name, err)
+		}
+	}
+}